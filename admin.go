@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+const (
+	// whoxToken tells our WHOX replies apart from the ones girc sends
+	// itself, which use 1.
+	whoxToken = "518"
+
+	whoxTimeout     = 5 * time.Second
+	accountCacheTTL = 60 * time.Second
+)
+
+type cachedAccount struct {
+	Account string
+	Checked time.Time
+}
+
+// AccountTracker remembers which services account a nick is logged in to
+// for nicks girc does not track itself, i.e. users that only talk to the
+// bot in private. Entries follow nick changes and are dropped on quit.
+type AccountTracker struct {
+	mu       sync.Mutex
+	accounts map[string]cachedAccount
+	waiters  map[string][]chan string
+}
+
+var (
+	accountTrackersMu sync.RWMutex
+	accountTrackers   = make(map[*girc.Client]*AccountTracker)
+)
+
+func NewAccountTracker() *AccountTracker {
+	return &AccountTracker{
+		accounts: make(map[string]cachedAccount),
+		waiters:  make(map[string][]chan string),
+	}
+}
+
+func getAccountTracker(client *girc.Client) *AccountTracker {
+	accountTrackersMu.RLock()
+	defer accountTrackersMu.RUnlock()
+
+	return accountTrackers[client]
+}
+
+func (tracker *AccountTracker) set(nick, account string) {
+	nick = strings.ToLower(nick)
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	tracker.accounts[nick] = cachedAccount{Account: account, Checked: time.Now()}
+
+	for _, waiter := range tracker.waiters[nick] {
+		waiter <- account
+	}
+
+	delete(tracker.waiters, nick)
+}
+
+func (tracker *AccountTracker) rename(oldNick, newNick string) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	cached, ok := tracker.accounts[strings.ToLower(oldNick)]
+	if !ok {
+		return
+	}
+
+	delete(tracker.accounts, strings.ToLower(oldNick))
+	tracker.accounts[strings.ToLower(newNick)] = cached
+}
+
+func (tracker *AccountTracker) forget(nick string) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	delete(tracker.accounts, strings.ToLower(nick))
+}
+
+// lookup returns the account for a nick, asking the server with WHOX if we
+// don't have a recent answer. An empty string means not logged in.
+func (tracker *AccountTracker) lookup(client *girc.Client, nick string) string {
+	key := strings.ToLower(nick)
+
+	tracker.mu.Lock()
+
+	if cached, ok := tracker.accounts[key]; ok && time.Since(cached.Checked) < accountCacheTTL {
+		tracker.mu.Unlock()
+
+		return cached.Account
+	}
+
+	waiter := make(chan string, 1)
+	tracker.waiters[key] = append(tracker.waiters[key], waiter)
+	tracker.mu.Unlock()
+
+	if _, ok := client.GetServerOption("WHOX"); !ok {
+		tracker.set(nick, "")
+
+		return ""
+	}
+
+	client.Cmd.SendRawf("WHO %s %%tna,%s", nick, whoxToken) //nolint: errcheck
+
+	select {
+	case account := <-waiter:
+		return account
+	case <-time.After(whoxTimeout):
+		slog.Warn("WHOX timed out", "nick", nick)
+
+		return ""
+	}
+}
+
+func trackAccounts(ctx context.Context, irc *girc.Client) *AccountTracker {
+	tracker := NewAccountTracker()
+
+	accountTrackersMu.Lock()
+	accountTrackers[irc] = tracker
+	accountTrackersMu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		accountTrackersMu.Lock()
+		delete(accountTrackers, irc)
+		accountTrackersMu.Unlock()
+	}()
+
+	irc.Handlers.AddBg(girc.RPL_WHOSPCRPL, func(_ *girc.Client, event girc.Event) {
+		// <me> <token> <nick> <account>
+		if len(event.Params) != 4 || event.Params[1] != whoxToken { //nolint: mnd,gomnd
+			return
+		}
+
+		account := event.Params[3]
+		if account == "0" {
+			account = ""
+		}
+
+		tracker.set(event.Params[2], account)
+	})
+
+	irc.Handlers.AddBg(girc.RPL_ENDOFWHO, func(_ *girc.Client, event girc.Event) {
+		if len(event.Params) < 2 { //nolint: mnd,gomnd
+			return
+		}
+
+		// no reply for the nick before the end of the list means there is
+		// no such user.
+		tracker.mu.Lock()
+		_, waiting := tracker.waiters[strings.ToLower(event.Params[1])]
+		tracker.mu.Unlock()
+
+		if waiting {
+			tracker.set(event.Params[1], "")
+		}
+	})
+
+	irc.Handlers.AddBg(girc.CAP_ACCOUNT, func(_ *girc.Client, event girc.Event) {
+		if event.Source == nil || len(event.Params) == 0 {
+			return
+		}
+
+		account := event.Params[0]
+		if account == "*" {
+			account = ""
+		}
+
+		tracker.set(event.Source.Name, account)
+	})
+
+	irc.Handlers.AddBg(girc.NICK, func(_ *girc.Client, event girc.Event) {
+		if event.Source == nil || len(event.Params) == 0 {
+			return
+		}
+
+		tracker.rename(event.Source.Name, event.Params[0])
+	})
+
+	irc.Handlers.AddBg(girc.QUIT, func(_ *girc.Client, event girc.Event) {
+		if event.Source != nil {
+			tracker.forget(event.Source.Name)
+		}
+	})
+
+	return tracker
+}
+
+// sourceAccount finds the services account behind an event. It prefers the
+// account-tag, then girc's own state and finally asks the server.
+func sourceAccount(client *girc.Client, event girc.Event) string {
+	if account := eventAccount(client, event); account != "" {
+		return account
+	}
+
+	if event.Source == nil || !client.IsConnected() {
+		return ""
+	}
+
+	// with account-tag a missing tag means not logged in, and users girc
+	// tracks already have their account kept up to date.
+	if client.HasCapability("account-tag") || client.LookupUser(event.Source.Name) != nil {
+		return ""
+	}
+
+	if tracker := getAccountTracker(client); tracker != nil {
+		return tracker.lookup(client, event.Source.Name)
+	}
+
+	return ""
+}
+
+// adminMatch reports whether an event comes from an admin and how that was
+// decided. Nicks in the admins list only count if the user is logged in to
+// the account of the same name, unless insecureNickAdmins is set.
+func adminMatch(client *girc.Client, event girc.Event, appConfig *TomlConfig) (string, string, bool) {
+	if event.Source == nil {
+		return "", "", false
+	}
+
+	mask := event.Source.String()
+
+	for _, adminMask := range appConfig.AdminMasks {
+		if matchGlob(adminMask, mask) {
+			return "", "mask " + adminMask, true
+		}
+	}
+
+	var nickIsAdmin bool
+
+	for _, admin := range appConfig.Admins {
+		if strings.EqualFold(event.Source.Name, admin) {
+			nickIsAdmin = true
+
+			break
+		}
+	}
+
+	if len(appConfig.AdminAccounts) == 0 && !nickIsAdmin {
+		return "", "", false
+	}
+
+	account := ""
+	if client != nil {
+		account = sourceAccount(client, event)
+	}
+
+	if account != "" {
+		for _, adminAccount := range appConfig.AdminAccounts {
+			if strings.EqualFold(account, adminAccount) {
+				return account, "account " + adminAccount, true
+			}
+		}
+
+		if nickIsAdmin && strings.EqualFold(account, event.Source.Name) {
+			return account, "nick and account " + account, true
+		}
+	}
+
+	if nickIsAdmin && appConfig.InsecureNickAdmins {
+		return account, "nick " + event.Source.Name, true
+	}
+
+	return account, "", false
+}
+
+// isAdmin checks an event without recording anything. It is only used where
+// the decision is recorded elsewhere, commands go through checkPermission
+// and everything else through checkAdmin.
+func isAdmin(client *girc.Client, event girc.Event, appConfig *TomlConfig) bool {
+	_, _, ok := adminMatch(client, event, appConfig)
+
+	return ok
+}
+
+// checkAdmin is the admin check for what admins may do outside of commands,
+// e.g. talk to the bot with adminOnly set or get past the ignore list. action
+// says which one it is. Every call is logged and, if there is a database,
+// stored in the admin_audit table.
+func checkAdmin(client *girc.Client, event girc.Event, appConfig *TomlConfig, action string) bool {
+	account, reason, ok := adminMatch(client, event, appConfig)
+
+	mask := ""
+	if event.Source != nil {
+		mask = event.Source.String()
+	}
+
+	if ok {
+		slog.Info("admin check allowed", "network", appConfig.IRCDName, "action", action,
+			"mask", mask, "account", account, "reason", reason)
+	} else {
+		slog.Info("admin check denied", "network", appConfig.IRCDName, "action", action, "mask", mask, "account", account)
+	}
+
+	go recordAdminCheck(appConfig, mask, account, action, ok)
+
+	return ok
+}
+
+func createAdminAuditTable(appConfig *TomlConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx, `create table if not exists admin_audit (
+			id serial primary key,
+			network text not null,
+			mask text not null,
+			account text not null,
+			command text not null,
+			allowed boolean not null,
+			dateadded timestamp default current_timestamp
+		)`)
+
+	return err
+}
+
+func recordAdminCheck(appConfig *TomlConfig, mask, account, action string, allowed bool) {
+	if appConfig.pool == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx,
+		"insert into admin_audit (network, mask, account, command, allowed) values ($1, $2, $3, $4, $5)",
+		appConfig.IRCDName, mask, account, action, allowed)
+	if err != nil {
+		LogError(err)
+	}
+}
+
+func warnAboutNickAdmins(appConfig *TomlConfig) {
+	if len(appConfig.Admins) > 0 && appConfig.InsecureNickAdmins {
+		slog.Warn("insecureNickAdmins is set, anyone using an admin's nick is treated as an admin", "network", appConfig.IRCDName)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lrstanley/girc"
+)
+
+func TestAdminMatch(t *testing.T) {
+	client := girc.New(girc.Config{Server: "irc.example.com", Nick: "milla", User: "milla"})
+
+	tests := []struct {
+		name      string
+		appConfig TomlConfig
+		source    string
+		account   string
+		want      bool
+	}{
+		{"mask", TomlConfig{AdminMasks: []string{"*!*@admin.example.com"}}, "anyone!user@admin.example.com", "", true},
+		{"other mask", TomlConfig{AdminMasks: []string{"*!*@admin.example.com"}}, "anyone!user@example.com", "", false},
+		{"account", TomlConfig{AdminAccounts: []string{"Boss"}}, "nick!user@host", "boss", true},
+		{"other account", TomlConfig{AdminAccounts: []string{"boss"}}, "nick!user@host", "intern", false},
+		{"no account", TomlConfig{AdminAccounts: []string{"boss"}}, "boss!user@host", "", false},
+		{"nick and account", TomlConfig{Admins: []string{"boss"}}, "Boss!user@host", "boss", true},
+		{"nick without account", TomlConfig{Admins: []string{"boss"}}, "boss!user@host", "", false},
+		{"nick with another account", TomlConfig{Admins: []string{"boss"}}, "boss!user@host", "intern", false},
+		{"insecure nick", TomlConfig{Admins: []string{"boss"}, InsecureNickAdmins: true}, "boss!user@host", "", true},
+		{"nothing configured", TomlConfig{}, "boss!user@host", "boss", false},
+	}
+
+	for _, test := range tests {
+		event := girc.Event{Source: girc.ParseSource(test.source), Command: girc.PRIVMSG, Params: []string{"#milla", "hi"}}
+		if test.account != "" {
+			event.Tags = girc.Tags{"account": test.account}
+		}
+
+		if _, _, got := adminMatch(client, event, &test.appConfig); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	if _, _, ok := adminMatch(client, girc.Event{Command: girc.PRIVMSG}, &TomlConfig{InsecureNickAdmins: true}); ok {
+		t.Error("an event without a source is an admin")
+	}
+}
+
+func TestAccountTracker(t *testing.T) {
+	tracker := NewAccountTracker()
+
+	tracker.set("Nick", "account")
+	tracker.rename("nick", "newnick")
+
+	if _, ok := tracker.accounts["nick"]; ok {
+		t.Error("the old nick is still tracked after a rename")
+	}
+
+	if cached := tracker.accounts["newnick"]; cached.Account != "account" {
+		t.Errorf("got account %q for the new nick, want account", cached.Account)
+	}
+
+	tracker.forget("NewNick")
+
+	if len(tracker.accounts) != 0 {
+		t.Errorf("still tracking %v after a quit", tracker.accounts)
+	}
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+const (
+	maxRecentErrors    = 100
+	maxAdminBodyBytes  = 65536
+	adminDefaultListen = "127.0.0.1:8091"
+)
+
+var (
+	errAdminToken      = errors.New("the admin api needs a token")
+	errUnknownNetwork  = errors.New("unknown network")
+	errNotConnected    = errors.New("the network is not connected")
+	errUnknownCommand  = errors.New("no custom command with that name")
+	errMissingArgument = errors.New("missing argument")
+	errUnauthorized    = errors.New("unauthorized")
+)
+
+type loggedError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// errorRing keeps the last errors passed to LogError for the admin api.
+type errorRing struct {
+	mu      sync.Mutex
+	entries []loggedError
+	next    int
+}
+
+var recentErrors = &errorRing{}
+
+func (ring *errorRing) Add(message string) {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	entry := loggedError{Time: time.Now().UTC(), Message: message}
+
+	if len(ring.entries) < maxRecentErrors {
+		ring.entries = append(ring.entries, entry)
+
+		return
+	}
+
+	ring.entries[ring.next] = entry
+	ring.next = (ring.next + 1) % maxRecentErrors
+}
+
+// List returns the errors oldest first.
+func (ring *errorRing) List() []loggedError {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	entries := make([]loggedError, 0, len(ring.entries))
+	entries = append(entries, ring.entries[ring.next:]...)
+
+	return append(entries, ring.entries[:ring.next]...)
+}
+
+type networkStatus struct {
+	Name      string          `json:"name"`
+	Server    string          `json:"server"`
+	Nick      string          `json:"nick"`
+	Connected bool            `json:"connected"`
+	Channels  []channelStatus `json:"channels"`
+}
+
+type channelStatus struct {
+	Name     string `json:"name"`
+	Joined   bool   `json:"joined"`
+	InConfig bool   `json:"inConfig"`
+}
+
+func describeNetwork(network *Network) networkStatus {
+	client := network.Client
+	appConfig := network.Config.current()
+	status := networkStatus{
+		Name:      network.Name,
+		Server:    appConfig.IrcServer,
+		Nick:      client.GetNick(),
+		Connected: client.IsConnected(),
+		Channels:  []channelStatus{},
+	}
+
+	wanted := configChannels(appConfig)
+
+	for _, channel := range wanted {
+		status.Channels = append(status.Channels, channelStatus{
+			Name:     channel[0],
+			Joined:   client.IsInChannel(channel[0]),
+			InConfig: true,
+		})
+	}
+
+	for _, channel := range client.ChannelList() {
+		if _, ok := wanted[strings.ToLower(channel)]; !ok {
+			status.Channels = append(status.Channels, channelStatus{Name: channel, Joined: true})
+		}
+	}
+
+	sort.Slice(status.Channels, func(i, j int) bool {
+		return status.Channels[i].Name < status.Channels[j].Name
+	})
+
+	return status
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		slog.Error("admin api", "error", err)
+	}
+}
+
+func writeJSONError(writer http.ResponseWriter, status int, err error) {
+	writeJSON(writer, status, map[string]string{"error": err.Error()})
+}
+
+func readJSON(writer http.ResponseWriter, request *http.Request, value any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(writer, request.Body, maxAdminBodyBytes))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(value); err != nil {
+		writeJSONError(writer, http.StatusBadRequest, err)
+
+		return false
+	}
+
+	return true
+}
+
+// adminNetwork looks up the network named in the path. With connected set it
+// also has to be connected.
+func adminNetwork(writer http.ResponseWriter, request *http.Request, connected bool) *Network {
+	network := getNetwork(request.PathValue("network"))
+	if network == nil {
+		writeJSONError(writer, http.StatusNotFound, errUnknownNetwork)
+
+		return nil
+	}
+
+	if connected && !network.Client.IsConnected() {
+		writeJSONError(writer, http.StatusServiceUnavailable, errNotConnected)
+
+		return nil
+	}
+
+	return network
+}
+
+// adminEvent is the event commands run from the api act on, as if the bot
+// had said something in target.
+func adminEvent(client *girc.Client, target string) girc.Event {
+	return girc.Event{
+		Source:  &girc.Source{Name: client.GetNick()},
+		Command: girc.PRIVMSG,
+		Params:  []string{target, ""},
+	}
+}
+
+// saveOverride keeps a change made through the api like the same change made
+// with an IRC command. The change itself has already been made, so a failure
+// only means it won't survive a restart.
+func saveOverride(writer http.ResponseWriter, network *Network, override Override) {
+	if err := recordOverride(network.Config, override); err != nil {
+		LogError(err)
+		writeJSON(writer, http.StatusOK, map[string]string{"warning": "could not save the change: " + err.Error()})
+
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+type adminAPI struct{}
+
+func (adminAPI) networks(writer http.ResponseWriter, _ *http.Request) {
+	statuses := []networkStatus{}
+
+	for _, network := range getNetworks() {
+		statuses = append(statuses, describeNetwork(network))
+	}
+
+	writeJSON(writer, http.StatusOK, statuses)
+}
+
+func (adminAPI) network(writer http.ResponseWriter, request *http.Request) {
+	network := adminNetwork(writer, request, false)
+	if network == nil {
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, describeNetwork(network))
+}
+
+func (adminAPI) message(writer http.ResponseWriter, request *http.Request) {
+	var body struct {
+		Target  string `json:"target"`
+		Message string `json:"message"`
+	}
+
+	if !readJSON(writer, request, &body) {
+		return
+	}
+
+	if body.Target == "" || body.Message == "" {
+		writeJSONError(writer, http.StatusBadRequest, fmt.Errorf("%w: target and message", errMissingArgument))
+
+		return
+	}
+
+	network := adminNetwork(writer, request, true)
+	if network == nil {
+		return
+	}
+
+	for _, line := range strings.Split(body.Message, "\n") {
+		if line != "" {
+			QueueMessage(network.Client, PriorityInteractive, body.Target, line)
+		}
+	}
+
+	writeJSON(writer, http.StatusAccepted, map[string]string{"status": "queued"})
+}
+
+func (adminAPI) join(writer http.ResponseWriter, request *http.Request) {
+	var body struct {
+		Channel string `json:"channel"`
+		Key     string `json:"key"`
+	}
+
+	if !readJSON(writer, request, &body) {
+		return
+	}
+
+	if !girc.IsValidChannel(body.Channel) {
+		writeJSONError(writer, http.StatusBadRequest, fmt.Errorf("%w: channel", errMissingArgument))
+
+		return
+	}
+
+	network := adminNetwork(writer, request, true)
+	if network == nil {
+		return
+	}
+
+	channel := []string{body.Channel}
+	if body.Key != "" {
+		channel = append(channel, body.Key)
+	}
+
+	IrcJoin(network.Client, channel)
+
+	saveOverride(writer, network, Override{Kind: OverrideJoin, Name: body.Channel, Value: body.Key})
+}
+
+func (adminAPI) part(writer http.ResponseWriter, request *http.Request) {
+	var body struct {
+		Channel string `json:"channel"`
+	}
+
+	if !readJSON(writer, request, &body) {
+		return
+	}
+
+	if !girc.IsValidChannel(body.Channel) {
+		writeJSONError(writer, http.StatusBadRequest, fmt.Errorf("%w: channel", errMissingArgument))
+
+		return
+	}
+
+	network := adminNetwork(writer, request, true)
+	if network == nil {
+		return
+	}
+
+	IrcPart(network.Client, body.Channel)
+
+	saveOverride(writer, network, Override{Kind: OverrideLeave, Name: body.Channel})
+}
+
+func (adminAPI) plugins(writer http.ResponseWriter, request *http.Request) {
+	network := adminNetwork(writer, request, false)
+	if network == nil {
+		return
+	}
+
+	appConfig := network.Config.current()
+	commands := make(map[string]string)
+
+	for name, command := range appConfig.LuaCommands {
+		commands[name] = command.Path
+	}
+
+	plugins := slices.Clone(appConfig.Plugins)
+	if plugins == nil {
+		plugins = []string{}
+	}
+
+	writeJSON(writer, http.StatusOK, map[string]any{"plugins": plugins, "commands": commands})
+}
+
+func (adminAPI) loadPlugin(writer http.ResponseWriter, request *http.Request) {
+	var body struct {
+		Path string `json:"path"`
+	}
+
+	if !readJSON(writer, request, &body) {
+		return
+	}
+
+	if body.Path == "" {
+		writeJSONError(writer, http.StatusBadRequest, fmt.Errorf("%w: path", errMissingArgument))
+
+		return
+	}
+
+	network := adminNetwork(writer, request, false)
+	if network == nil {
+		return
+	}
+
+	go RunScript(body.Path, network.Client, network.Config)
+
+	saveOverride(writer, network, Override{Kind: OverrideLoad, Name: body.Path})
+}
+
+func (adminAPI) unloadPlugin(writer http.ResponseWriter, request *http.Request) {
+	var body struct {
+		Path string `json:"path"`
+	}
+
+	if !readJSON(writer, request, &body) {
+		return
+	}
+
+	if body.Path == "" {
+		writeJSONError(writer, http.StatusBadRequest, fmt.Errorf("%w: path", errMissingArgument))
+
+		return
+	}
+
+	network := adminNetwork(writer, request, false)
+	if network == nil {
+		return
+	}
+
+	unloadPlugin(network.Config, body.Path)
+
+	saveOverride(writer, network, Override{Kind: OverrideUnload, Name: body.Path})
+}
+
+// runCustomCommand runs a custom command as if the bot had used it in a
+// channel, the results go to that channel.
+func (adminAPI) runCustomCommand(writer http.ResponseWriter, request *http.Request) {
+	var body struct {
+		Channel string `json:"channel"`
+	}
+
+	if !readJSON(writer, request, &body) {
+		return
+	}
+
+	if body.Channel == "" {
+		writeJSONError(writer, http.StatusBadRequest, fmt.Errorf("%w: channel", errMissingArgument))
+
+		return
+	}
+
+	network := adminNetwork(writer, request, true)
+	if network == nil {
+		return
+	}
+
+	appConfig := network.Config.current()
+
+	name := request.PathValue("name")
+	if _, ok := appConfig.CustomCommands[name]; !ok {
+		writeJSONError(writer, http.StatusNotFound, errUnknownCommand)
+
+		return
+	}
+
+	go handleCustomCommand([]string{"cmd", name}, network.Client, adminEvent(network.Client, body.Channel), appConfig)
+
+	writeJSON(writer, http.StatusAccepted, map[string]string{"status": "started"})
+}
+
+// getConfig returns a config value. Secrets are masked, the api is for
+// operating the bot and not for reading its credentials back.
+func (adminAPI) getConfig(writer http.ResponseWriter, request *http.Request) {
+	network := adminNetwork(writer, request, false)
+	if network == nil {
+		return
+	}
+
+	appConfig := network.Config.current()
+	name := request.PathValue("name")
+
+	field, ok := reflect.TypeOf(*appConfig).FieldByName(name)
+	if !ok || !field.IsExported() {
+		writeJSONError(writer, http.StatusNotFound, errUnknConfig)
+
+		return
+	}
+
+	value := maskConfigValue(name, reflect.ValueOf(*appConfig).FieldByIndex(field.Index).Interface())
+
+	writeJSON(writer, http.StatusOK, map[string]any{"name": name, "value": value})
+}
+
+func (adminAPI) setConfig(writer http.ResponseWriter, request *http.Request) {
+	var body struct {
+		Value string `json:"value"`
+	}
+
+	if !readJSON(writer, request, &body) {
+		return
+	}
+
+	network := adminNetwork(writer, request, false)
+	if network == nil {
+		return
+	}
+
+	name := request.PathValue("name")
+
+	err := network.Config.update(func(next *TomlConfig) error {
+		return setFieldByName(reflect.ValueOf(next).Elem(), name, body.Value)
+	})
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errUnknConfig) {
+			status = http.StatusNotFound
+		}
+
+		writeJSONError(writer, status, err)
+
+		return
+	}
+
+	saveOverride(writer, network, Override{Kind: OverrideSet, Name: name, Value: body.Value})
+}
+
+func (adminAPI) reload(writer http.ResponseWriter, _ *http.Request) {
+	changes, err := ReloadConfig()
+	if err != nil {
+		writeJSONError(writer, http.StatusInternalServerError, err)
+
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, map[string][]string{"changes": changes})
+}
+
+func (adminAPI) listErrors(writer http.ResponseWriter, _ *http.Request) {
+	writeJSON(writer, http.StatusOK, recentErrors.List())
+}
+
+// newAdminHandler returns the admin api. Every request has to send the token
+// as a bearer token.
+func newAdminHandler(token string) http.Handler {
+	var api adminAPI
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /api/networks", api.networks)
+	mux.HandleFunc("GET /api/networks/{network}", api.network)
+	mux.HandleFunc("POST /api/networks/{network}/message", api.message)
+	mux.HandleFunc("POST /api/networks/{network}/join", api.join)
+	mux.HandleFunc("POST /api/networks/{network}/part", api.part)
+	mux.HandleFunc("GET /api/networks/{network}/plugins", api.plugins)
+	mux.HandleFunc("POST /api/networks/{network}/plugins/load", api.loadPlugin)
+	mux.HandleFunc("POST /api/networks/{network}/plugins/unload", api.unloadPlugin)
+	mux.HandleFunc("POST /api/networks/{network}/commands/{name}", api.runCustomCommand)
+	mux.HandleFunc("GET /api/networks/{network}/config/{name}", api.getConfig)
+	mux.HandleFunc("PUT /api/networks/{network}/config/{name}", api.setConfig)
+	mux.HandleFunc("POST /api/reload", api.reload)
+	mux.HandleFunc("GET /api/errors", api.listErrors)
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		got, found := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writer.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(writer, http.StatusUnauthorized, errUnauthorized)
+
+			return
+		}
+
+		mux.ServeHTTP(writer, request)
+	})
+}
+
+var (
+	adminMu     sync.Mutex
+	adminConfig AdminAPI
+
+	// adminSwapMu is held while the listener is replaced, runningAdmin and
+	// runningAdminConfig only change under it.
+	adminSwapMu        sync.Mutex
+	runningAdmin       *httpListener
+	runningAdminConfig AdminAPI
+)
+
+// setAdminAPI starts, stops or restarts the admin api to match the config.
+// A reload through the admin api is served by the listener that is
+// replaced, shutting it down waits for that request, so the listener is
+// swapped in the background and the request gets its answer first.
+func setAdminAPI(updated AdminAPI) {
+	adminMu.Lock()
+	adminConfig = updated
+	adminMu.Unlock()
+
+	go swapAdminAPI()
+}
+
+// swapAdminAPI brings the listener in line with the latest admin config.
+// When setAdminAPI runs twice in a row the second swap finds the latest
+// config already applied.
+func swapAdminAPI() {
+	adminSwapMu.Lock()
+	defer adminSwapMu.Unlock()
+
+	adminMu.Lock()
+	updated := adminConfig
+	adminMu.Unlock()
+
+	if runningAdmin != nil && updated == runningAdminConfig {
+		return
+	}
+
+	if runningAdmin != nil {
+		runningAdmin.shutdown()
+
+		runningAdmin = nil
+	}
+
+	if !updated.Enabled {
+		return
+	}
+
+	if updated.Token == "" {
+		slog.Warn("admin api", "error", errAdminToken)
+
+		return
+	}
+
+	listen := updated.Listen
+	if listen == "" {
+		listen = adminDefaultListen
+	}
+
+	listener, err := serveHTTP("admin api", listen, newAdminHandler(updated.Token))
+	if err != nil {
+		slog.Error("admin api", "error", err)
+
+		return
+	}
+
+	runningAdmin = listener
+	runningAdminConfig = updated
+}
+
+func adminAPIDiffers(updated AdminAPI) bool {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	return updated != adminConfig
+}
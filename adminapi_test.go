@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+const testAdminToken = "test token"
+
+// addTestNetwork registers a network that is never connected.
+func addTestNetwork(t *testing.T, appConfig TomlConfig) *Network {
+	t.Helper()
+
+	appConfig.publish()
+
+	ctx, stop := context.WithCancel(context.Background())
+	network := &Network{
+		Name:   appConfig.IRCDName,
+		Client: girc.New(girc.Config{Server: appConfig.IrcServer, Nick: appConfig.IrcNick, User: appConfig.IrcNick}),
+		Config: &appConfig,
+		ctx:    ctx,
+		stop:   stop,
+	}
+
+	registerNetwork(network)
+
+	t.Cleanup(func() {
+		stop()
+		unregisterNetwork(network)
+	})
+
+	return network
+}
+
+func adminRequest(t *testing.T, handler http.Handler, method, path, authorization string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	request := httptest.NewRequest(method, path, nil)
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+func TestAdminAPIRejectsBadTokens(t *testing.T) {
+	handler := newAdminHandler(testAdminToken)
+
+	for _, authorization := range []string{"", "Bearer", "Bearer wrong token", testAdminToken, "Basic " + testAdminToken} {
+		recorder := adminRequest(t, handler, http.MethodGet, "/api/networks", authorization)
+
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("authorization %q: got status %d, want %d", authorization, recorder.Code, http.StatusUnauthorized)
+		}
+
+		if recorder.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("authorization %q: no WWW-Authenticate header", authorization)
+		}
+	}
+}
+
+func TestAdminAPIListsNetworks(t *testing.T) {
+	addTestNetwork(t, TomlConfig{
+		IRCDName:    "testnet",
+		IrcServer:   "irc.example.com",
+		IrcNick:     "milla",
+		IrcChannels: [][]string{{"#milla"}},
+	})
+
+	recorder := adminRequest(t, newAdminHandler(testAdminToken), http.MethodGet, "/api/networks", "Bearer "+testAdminToken)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+
+	var statuses []networkStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &statuses); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(statuses) != 1 {
+		t.Fatalf("got %d networks, want 1: %+v", len(statuses), statuses)
+	}
+
+	status := statuses[0]
+	if status.Name != "testnet" || status.Server != "irc.example.com" || status.Nick != "milla" || status.Connected {
+		t.Errorf("unexpected network %+v", status)
+	}
+
+	want := channelStatus{Name: "#milla", Joined: false, InConfig: true}
+	if len(status.Channels) != 1 || status.Channels[0] != want {
+		t.Errorf("got channels %+v, want [%+v]", status.Channels, want)
+	}
+}
+
+func TestAdminAPIMasksSecrets(t *testing.T) {
+	addTestNetwork(t, TomlConfig{
+		IRCDName:    "testnet",
+		IrcServer:   "irc.example.com",
+		IrcNick:     "milla",
+		Apikey:      "sk-secret",
+		IrcSaslPass: "sasl secret",
+	})
+
+	handler := newAdminHandler(testAdminToken)
+
+	for name, want := range map[string]string{"Apikey": redacted, "IrcSaslPass": redacted, "IrcServer": "irc.example.com"} {
+		recorder := adminRequest(t, handler, http.MethodGet, "/api/networks/testnet/config/"+name, "Bearer "+testAdminToken)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, want %d", name, recorder.Code, http.StatusOK)
+		}
+
+		var body struct {
+			Value string `json:"value"`
+		}
+
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		if body.Value != want {
+			t.Errorf("%s: got %q, want %q", name, body.Value, want)
+		}
+	}
+}
+
+// waitForAdminToken polls the running admin api until it accepts token.
+func waitForAdminToken(t *testing.T, address, token string) {
+	t.Helper()
+
+	for range 100 {
+		request, _ := http.NewRequest(http.MethodGet, "http://"+address+"/api/networks", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+
+		if response, err := http.DefaultClient.Do(request); err == nil {
+			response.Body.Close()
+
+			if response.StatusCode == http.StatusOK {
+				return
+			}
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("the admin api on %s never accepted %q", address, token)
+}
+
+func TestAdminAPIReloadReplacesItsOwnListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := listener.Addr().String()
+	listener.Close()
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	config := fmt.Sprintf("[admin]\nenabled = true\nlisten = %q\ntoken = \"second token\"\n", address)
+
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldConfigFile := configFile
+	configFile = path
+
+	t.Cleanup(func() {
+		configFile = oldConfigFile
+
+		setAdminAPI(AdminAPI{})
+	})
+
+	setAdminAPI(AdminAPI{Enabled: true, Listen: address, Token: testAdminToken})
+	waitForAdminToken(t, address, testAdminToken)
+
+	request, _ := http.NewRequest(http.MethodPost, "http://"+address+"/api/reload", nil)
+	request.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	client := &http.Client{Timeout: httpShutdownTimeout / 2}
+	start := time.Now()
+
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("the reload did not answer: %v", err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", response.StatusCode, http.StatusOK)
+	}
+
+	if took := time.Since(start); took >= httpShutdownTimeout/2 {
+		t.Errorf("the reload took %v, it waited for its own listener", took)
+	}
+
+	waitForAdminToken(t, address, "second token")
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+var (
+	channelStatesMu sync.RWMutex
+	channelStates   = make(map[*girc.Client]*ChannelState)
+)
+
+type desiredChannel struct {
+	Name string
+	Key  string
+}
+
+// ChannelState is the list of channels the bot should be in. girc keeps
+// track of the ones it is actually in, the two are compared to put the bot
+// back where it belongs.
+type ChannelState struct {
+	mu      sync.Mutex
+	desired map[string]desiredChannel
+}
+
+func NewChannelState() *ChannelState {
+	return &ChannelState{desired: make(map[string]desiredChannel)}
+}
+
+func getChannelState(client *girc.Client) *ChannelState {
+	channelStatesMu.RLock()
+	defer channelStatesMu.RUnlock()
+
+	return channelStates[client]
+}
+
+func (state *ChannelState) Want(name, key string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.desired[strings.ToLower(name)] = desiredChannel{Name: name, Key: key}
+}
+
+func (state *ChannelState) Unwant(name string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	delete(state.desired, strings.ToLower(name))
+}
+
+func (state *ChannelState) Wanted(name string) (desiredChannel, bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	channel, ok := state.desired[strings.ToLower(name)]
+
+	return channel, ok
+}
+
+func (state *ChannelState) Desired() []desiredChannel {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	channels := make([]desiredChannel, 0, len(state.desired))
+	for _, channel := range state.desired {
+		channels = append(channels, channel)
+	}
+
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+
+	return channels
+}
+
+// Missing returns the channels the bot should be in but isn't.
+func (state *ChannelState) Missing(client *girc.Client) []desiredChannel {
+	var missing []desiredChannel
+
+	for _, channel := range state.Desired() {
+		if !client.IsInChannel(channel.Name) {
+			missing = append(missing, channel)
+		}
+	}
+
+	return missing
+}
+
+// Extra returns the channels the bot is in but was never asked to join.
+func (state *ChannelState) Extra(client *girc.Client) []string {
+	var extra []string
+
+	for _, channel := range client.ChannelList() {
+		if _, ok := state.Wanted(channel); !ok {
+			extra = append(extra, channel)
+		}
+	}
+
+	sort.Strings(extra)
+
+	return extra
+}
+
+// IrcPart leaves a channel and stops the bot from rejoining it.
+func IrcPart(irc *girc.Client, channel string) {
+	if state := getChannelState(irc); state != nil {
+		state.Unwant(channel)
+	}
+
+	irc.Cmd.Part(channel)
+}
+
+func rejoinMissing(client *girc.Client, state *ChannelState, appConfig *TomlConfig) {
+	if !client.IsConnected() {
+		return
+	}
+
+	for _, channel := range state.Missing(client) {
+		slog.Info("not in channel, joining it again", "network", appConfig.IRCDName, "channel", channel.Name)
+
+		IrcJoin(client, []string{channel.Name, channel.Key})
+	}
+}
+
+// regainNick asks NickServ to free up the configured nick. GHOST and
+// RECOVER only disconnect or hold the other user so the nick change is
+// done by the bot, REGAIN does it for us.
+func regainNick(client *girc.Client, appConfig *TomlConfig) {
+	if appConfig.NickRegain == "" || !client.IsConnected() ||
+		strings.EqualFold(client.GetNick(), appConfig.IrcNick) {
+		return
+	}
+
+	command := strings.ToUpper(appConfig.NickRegain)
+
+	switch command {
+	case "GHOST", "REGAIN", "RECOVER":
+	default:
+		slog.Warn("unknown nickRegain method", "network", appConfig.IRCDName, "method", appConfig.NickRegain)
+
+		return
+	}
+
+	message := command + " " + appConfig.IrcNick
+	if appConfig.IrcSaslPass != "" {
+		message += " " + appConfig.IrcSaslPass
+	}
+
+	slog.Info("regaining nick", "network", appConfig.IRCDName, "nick", client.GetNick(),
+		"nickserv", appConfig.NickServName, "command", command, "want", appConfig.IrcNick)
+
+	client.Cmd.Message(appConfig.NickServName, message)
+
+	if command != "REGAIN" {
+		time.AfterFunc(time.Duration(appConfig.RejoinDelay)*time.Second, func() {
+			client.Cmd.Nick(appConfig.IrcNick)
+		})
+	}
+}
+
+// rejoinRuntime joins the channels the bot was asked to join at runtime,
+// e.g. with /join or an invite, the ones from the config are joined by
+// runIRC.
+func rejoinRuntime(client *girc.Client, state *ChannelState, appConfig *TomlConfig) {
+	fromConfig := configChannels(appConfig)
+
+	for _, channel := range state.Desired() {
+		if _, ok := fromConfig[strings.ToLower(channel.Name)]; !ok {
+			IrcJoin(client, []string{channel.Name, channel.Key})
+		}
+	}
+}
+
+// manageChannels keeps the bot in the channels it should be in and on its
+// nick until ctx is cancelled, which happens when the network is stopped.
+func manageChannels(ctx context.Context, irc *girc.Client, appConfig *TomlConfig) {
+	state := NewChannelState()
+
+	channelStatesMu.Lock()
+	channelStates[irc] = state
+	channelStatesMu.Unlock()
+
+	irc.Handlers.AddBg(girc.CONNECTED, func(client *girc.Client, _ girc.Event) {
+		appConfig := appConfig.current()
+
+		rejoinRuntime(client, state, appConfig)
+		regainNick(client, appConfig)
+	})
+
+	irc.Handlers.AddBg(girc.KICK, func(client *girc.Client, event girc.Event) {
+		appConfig := appConfig.current()
+
+		if len(event.Params) < 2 || !strings.EqualFold(client.GetNick(), event.Params[1]) { //nolint: mnd,gomnd
+			return
+		}
+
+		channel := event.Params[0]
+		kicker := ""
+
+		if event.Source != nil {
+			kicker = event.Source.Name
+		}
+
+		slog.Info("kicked", "network", appConfig.IRCDName, "channel", channel, "by", kicker)
+		logMessageContent(nil, "kick reason", "network", appConfig.IRCDName, "channel", channel, "reason", event.Last())
+
+		if !appConfig.RejoinOnKick {
+			state.Unwant(channel)
+
+			return
+		}
+
+		time.AfterFunc(time.Duration(appConfig.RejoinDelay)*time.Second, func() {
+			if wanted, ok := state.Wanted(channel); ok && client.IsConnected() && !client.IsInChannel(channel) {
+				IrcJoin(client, []string{wanted.Name, wanted.Key})
+			}
+		})
+	})
+
+	irc.Handlers.AddBg(girc.INVITE, func(client *girc.Client, event girc.Event) {
+		appConfig := appConfig.current()
+
+		if len(event.Params) < 2 || event.Source == nil { //nolint: mnd,gomnd
+			return
+		}
+
+		channel := event.Last()
+
+		if !appConfig.AcceptInvites || !checkAdmin(client, event, appConfig, "invite") {
+			slog.Info("ignoring invite", "network", appConfig.IRCDName, "channel", channel, "from", event.Source.String())
+
+			return
+		}
+
+		slog.Info("invited", "network", appConfig.IRCDName, "channel", channel, "by", event.Source.String())
+
+		IrcJoin(client, []string{channel})
+	})
+
+	// someone else had our nick, take it back as soon as it's free.
+	irc.Handlers.AddBg(girc.QUIT, func(client *girc.Client, event girc.Event) {
+		appConfig := appConfig.current()
+
+		if event.Source != nil && strings.EqualFold(event.Source.Name, appConfig.IrcNick) &&
+			!strings.EqualFold(client.GetNick(), appConfig.IrcNick) {
+			client.Cmd.Nick(appConfig.IrcNick)
+		}
+	})
+
+	irc.Handlers.AddBg(girc.NICK, func(client *girc.Client, event girc.Event) {
+		appConfig := appConfig.current()
+
+		if event.Source != nil && strings.EqualFold(event.Source.Name, appConfig.IrcNick) &&
+			!strings.EqualFold(client.GetNick(), appConfig.IrcNick) {
+			client.Cmd.Nick(appConfig.IrcNick)
+		}
+	})
+
+	go func() {
+		defer func() {
+			channelStatesMu.Lock()
+			delete(channelStates, irc)
+			channelStatesMu.Unlock()
+		}()
+
+		var tick <-chan time.Time
+
+		if appConfig.ChannelCheckInterval > 0 {
+			ticker := time.NewTicker(time.Duration(appConfig.ChannelCheckInterval) * time.Second)
+			defer ticker.Stop()
+
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+				rejoinMissing(irc, state, appConfig.current())
+				regainNick(irc, appConfig.current())
+			}
+		}
+	}()
+}
+
+// channelsStatus is the answer to the channels command.
+func channelsStatus(client *girc.Client) []string {
+	state := getChannelState(client)
+	if state == nil {
+		return []string{"channel tracking is disabled"}
+	}
+
+	var lines []string
+
+	for _, channel := range state.Desired() {
+		status := "joined"
+		if !client.IsInChannel(channel.Name) {
+			status = "not joined"
+		}
+
+		lines = append(lines, fmt.Sprintf("%s: %s", channel.Name, status))
+	}
+
+	for _, channel := range state.Extra(client) {
+		lines = append(lines, fmt.Sprintf("%s: joined, not in config", channel))
+	}
+
+	if len(lines) == 0 {
+		lines = append(lines, "no channels")
+	}
+
+	return lines
+}
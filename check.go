@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/chroma/v2/formatters"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/lrstanley/girc"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+var (
+	errUnknownKey       = errors.New("unknown key, check the spelling")
+	errNoServer         = errors.New("ircServer is not set, the network will not be started")
+	errUnknownProvider  = errors.New("unknown provider, has to be one of ollama, chatgpt, gemini or openrouter")
+	errUnknownFormatter = errors.New("unknown chroma formatter")
+	errUnknownStyle     = errors.New("unknown chroma style")
+	errUnknownEventType = errors.New("unknown event type")
+	errNoFeedURL        = errors.New("feed has no url")
+	errEmptyRSSConfig   = errors.New("rss file has no config in it")
+	errNoSinkURL        = errors.New("sink has no url")
+	errNoNetwork        = errors.New("no network with that name in the config")
+)
+
+var providers = []string{"", "ollama", "chatgpt", "gemini", "openrouter"}
+
+// watchlistEventTypes are the IRC commands a watchlist can match on, the
+// first parameter has to be the channel.
+var watchlistEventTypes = []string{
+	girc.PRIVMSG, girc.NOTICE, girc.TOPIC, girc.JOIN, girc.PART, girc.KICK, girc.MODE,
+}
+
+// triggeredScriptTypes are the events triggered scripts can run on.
+var triggeredScriptTypes = []string{girc.PRIVMSG}
+
+var sinkEventTypes = []string{EventWatchlist, EventCommand, EventConnect, EventDisconnect, EventError}
+
+// configCheck collects what is wrong with a config, every problem is
+// prefixed with where in the config it is.
+type configCheck struct {
+	problems []string
+}
+
+func (check *configCheck) report(path string, err error) {
+	if err != nil {
+		check.problems = append(check.problems, fmt.Sprintf("%s: %s", path, strings.TrimSpace(err.Error())))
+	}
+}
+
+func (check *configCheck) oneOf(path string, allowed []string, value string, err error) {
+	if !slices.Contains(allowed, value) {
+		check.report(path, fmt.Errorf("%w: %q", err, value))
+	}
+}
+
+// flattenErrors undoes errors.Join, so every error gets its own line.
+func flattenErrors(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error }) //nolint: errorlint
+	if !ok {
+		return []error{err}
+	}
+
+	var flat []error
+
+	for _, inner := range joined.Unwrap() {
+		flat = append(flat, flattenErrors(inner)...)
+	}
+
+	return flat
+}
+
+func checkLuaFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = parse.Parse(file, path)
+
+	return err
+}
+
+func checkTimezone(timezone string) error {
+	if timezone == "" {
+		return nil
+	}
+
+	_, err := time.LoadLocation(timezone)
+
+	return err
+}
+
+func (check *configCheck) network(name string, config TomlConfig) {
+	prefix := joinConfigPath("ircd", name)
+
+	if config.IrcServer == "" {
+		check.report(prefix, errNoServer)
+	}
+
+	check.oneOf(prefix+".provider", providers, config.Provider, errUnknownProvider)
+
+	if _, ok := formatters.Registry[config.ChromaFormatter]; !ok {
+		check.report(prefix+".chromaFormatter", fmt.Errorf("%w: %q", errUnknownFormatter, config.ChromaFormatter))
+	}
+
+	if _, ok := styles.Registry[config.ChromaStyle]; !ok {
+		check.report(prefix+".chromaStyle", fmt.Errorf("%w: %q", errUnknownStyle, config.ChromaStyle))
+	}
+
+	check.report(prefix+".defaultTimezone", checkTimezone(config.DefaultTimezone))
+
+	for i, plugin := range config.Plugins {
+		check.report(fmt.Sprintf("%s.plugins[%d]", prefix, i), checkLuaFile(plugin))
+	}
+
+	for _, scriptName := range slices.Sorted(maps.Keys(config.TriggeredScripts)) {
+		script := config.TriggeredScripts[scriptName]
+		path := joinConfigPath(prefix+".triggeredScripts", scriptName)
+
+		check.report(path+".path", checkLuaFile(script.Path))
+
+		for _, triggerType := range script.TriggerTypes {
+			check.oneOf(path+".triggerTypes", triggeredScriptTypes, triggerType, errUnknownEventType)
+		}
+	}
+
+	for _, watchlistName := range slices.Sorted(maps.Keys(config.WatchLists)) {
+		watchlist := config.WatchLists[watchlistName]
+		path := joinConfigPath(prefix+".watchList", watchlistName)
+
+		for i, watchFile := range watchlist.WatchFiles {
+			_, err := os.Stat(watchFile)
+			check.report(fmt.Sprintf("%s.watchFiles[%d]", path, i), err)
+		}
+
+		for _, eventType := range watchlist.EventTypes {
+			check.oneOf(path+".eventTypes", watchlistEventTypes, eventType, errUnknownEventType)
+		}
+	}
+
+	for _, rssName := range slices.Sorted(maps.Keys(config.Rss)) {
+		path := joinConfigPath(prefix+".rss", rssName) + ".rssFile"
+
+		rssConfig, err := readRSSConfig(config.Rss[rssName].RssFile)
+		if err != nil {
+			check.report(path, err)
+
+			continue
+		}
+
+		for _, feed := range rssConfig.Feeds {
+			if feed.URL == "" {
+				check.report(path, fmt.Errorf("%w: %q", errNoFeedURL, feed.Name))
+			}
+		}
+	}
+
+	for _, scheduleName := range slices.Sorted(maps.Keys(config.Schedules)) {
+		schedule := config.Schedules[scheduleName]
+		path := joinConfigPath(prefix+".schedules", scheduleName)
+
+		check.report(path, validateSchedule(schedule))
+		check.report(path+".timezone", checkTimezone(schedule.Timezone))
+	}
+}
+
+func (check *configCheck) app(config AppConfig) {
+	for _, name := range slices.Sorted(maps.Keys(config.Ircd)) {
+		check.network(name, config.Ircd[name])
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(config.Relays)) {
+		path := joinConfigPath("relay", name)
+
+		ends, err := config.Relays[name].parseEnds()
+		check.report(path, err)
+
+		for _, end := range ends {
+			if _, ok := config.Ircd[end.Network]; !ok {
+				check.report(path+".ends", fmt.Errorf("%w: %q", errNoNetwork, end.Network))
+			}
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(config.Webhooks.Routes)) {
+		route := config.Webhooks.Routes[name]
+		path := joinConfigPath("webhooks.routes", name)
+
+		_, err := parseWebhookRoute(route)
+		check.report(path, err)
+
+		if _, ok := config.Ircd[route.Network]; !ok && route.Network != "" {
+			check.report(path+".network", fmt.Errorf("%w: %q", errNoNetwork, route.Network))
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(config.Sinks)) {
+		sink := config.Sinks[name]
+		path := joinConfigPath("sink", name)
+
+		if sink.URL == "" {
+			check.report(path, errNoSinkURL)
+		} else if _, err := url.ParseRequestURI(sink.URL); err != nil {
+			check.report(path+".url", err)
+		}
+
+		for _, event := range sink.Events {
+			check.oneOf(path+".events", sinkEventTypes, event, errUnknownEventType)
+		}
+	}
+
+	_, err := newLogHandler(io.Discard, config.Logging.Format)
+	check.report("logging.format", err)
+
+	if config.Logging.Level != "" {
+		var level slog.Level
+		check.report("logging.level", level.UnmarshalText([]byte(config.Logging.Level)))
+	}
+}
+
+// checkConfig loads a config the way milla would and returns everything that
+// is wrong with it. It does not connect to anything.
+func checkConfig(path string) []string {
+	config, meta, err := decodeConfig(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	check := &configCheck{}
+
+	for _, key := range meta.Undecoded() {
+		check.report(key.String(), errUnknownKey)
+	}
+
+	if err := resolveSecrets(reflect.ValueOf(&config).Elem(), ""); err != nil {
+		for _, secretErr := range flattenErrors(err) {
+			check.problems = append(check.problems, secretErr.Error())
+		}
+	}
+
+	addNetworkDefaults(&config)
+
+	check.app(config)
+
+	return check.problems
+}
+
+// runCheck is the check subcommand, it prints the problems with the config
+// and returns the exit code.
+func runCheck(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	configPath := flags.String("config", "./config.toml", "path to the config file")
+
+	_ = flags.Parse(args)
+
+	problems := checkConfig(*configPath)
+	if len(problems) == 0 {
+		fmt.Printf("%s: ok\n", *configPath)
+
+		return 0
+	}
+
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, problem)
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: %d problem(s)\n", *configPath, len(problems))
+
+	return 1
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidCron = errors.New("invalid cron expression")
+
+// cronSearchLimit is how far ahead Next looks before it gives up on an
+// expression that never matches, e.g. the 30th of February.
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+var cronShorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, //nolint: mnd,gomnd
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12, //nolint: mnd,gomnd
+}
+
+var cronDayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6, //nolint: mnd,gomnd
+}
+
+// CronSchedule is a parsed five field cron expression: minute, hour, day of
+// the month, month and day of the week.
+type CronSchedule struct {
+	minutes     uint64
+	hours       uint64
+	daysOfMonth uint64
+	months      uint64
+	daysOfWeek  uint64
+	// like in vixie cron, if both day fields are restricted a day matches
+	// when either of them does. A field starting with * counts as not
+	// restricted, so */2 in one of them doesn't turn that into an or.
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+func parseCronField(field string, low, high int, names map[string]int) (uint64, error) {
+	var bits uint64
+
+	value := func(text string) (int, error) {
+		if number, ok := names[strings.ToLower(text)]; ok {
+			return number, nil
+		}
+
+		number, err := strconv.Atoi(text)
+		if err != nil || number < low || number > high {
+			return 0, fmt.Errorf("%w: %q is not between %d and %d", errInvalidCron, text, low, high)
+		}
+
+		return number, nil
+	}
+
+	for _, part := range strings.Split(field, ",") {
+		rangeText, stepText, hasStep := strings.Cut(part, "/")
+
+		step := 1
+
+		if hasStep {
+			var err error
+
+			step, err = strconv.Atoi(stepText)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("%w: bad step %q", errInvalidCron, stepText)
+			}
+		}
+
+		start, end := low, high
+
+		switch {
+		case rangeText == "*":
+		case strings.Contains(rangeText, "-"):
+			startText, endText, _ := strings.Cut(rangeText, "-")
+
+			var err error
+
+			if start, err = value(startText); err != nil {
+				return 0, err
+			}
+
+			if end, err = value(endText); err != nil {
+				return 0, err
+			}
+
+			if start > end {
+				return 0, fmt.Errorf("%w: bad range %q", errInvalidCron, rangeText)
+			}
+		default:
+			var err error
+
+			if start, err = value(rangeText); err != nil {
+				return 0, err
+			}
+
+			end = start
+			if hasStep {
+				end = high
+			}
+		}
+
+		for number := start; number <= end; number += step {
+			bits |= 1 << uint(number)
+		}
+	}
+
+	return bits, nil
+}
+
+func ParseCron(expression string) (*CronSchedule, error) {
+	if shorthand, ok := cronShorthands[strings.ToLower(strings.TrimSpace(expression))]; ok {
+		expression = shorthand
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 { //nolint: mnd,gomnd
+		return nil, fmt.Errorf("%w: want 5 fields, got %d", errInvalidCron, len(fields))
+	}
+
+	var (
+		schedule CronSchedule
+		err      error
+	)
+
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil { //nolint: mnd,gomnd
+		return nil, err
+	}
+
+	if schedule.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil { //nolint: mnd,gomnd
+		return nil, err
+	}
+
+	if schedule.daysOfMonth, err = parseCronField(fields[2], 1, 31, nil); err != nil { //nolint: mnd,gomnd
+		return nil, err
+	}
+
+	if schedule.months, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil { //nolint: mnd,gomnd
+		return nil, err
+	}
+
+	// 7 is sunday too.
+	if schedule.daysOfWeek, err = parseCronField(fields[4], 0, 7, cronDayNames); err != nil { //nolint: mnd,gomnd
+		return nil, err
+	}
+
+	if schedule.daysOfWeek&(1<<7) != 0 {
+		schedule.daysOfWeek |= 1
+	}
+
+	schedule.anyDayOfMonth = strings.HasPrefix(fields[2], "*")
+	schedule.anyDayOfWeek = strings.HasPrefix(fields[4], "*")
+
+	return &schedule, nil
+}
+
+func (schedule *CronSchedule) dayMatches(t time.Time) bool {
+	dayOfMonth := schedule.daysOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := schedule.daysOfWeek&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case schedule.anyDayOfMonth && schedule.anyDayOfWeek:
+		return true
+	case schedule.anyDayOfMonth:
+		return dayOfWeek
+	case schedule.anyDayOfWeek:
+		return dayOfMonth
+	default:
+		return dayOfMonth || dayOfWeek
+	}
+}
+
+// Next returns the first time after t the schedule fires, in t's location.
+// It returns the zero time if there is none.
+func (schedule *CronSchedule) Next(t time.Time) time.Time {
+	limit := t.Add(cronSearchLimit)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	for t.Before(limit) {
+		if schedule.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+
+			continue
+		}
+
+		if !schedule.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+
+			continue
+		}
+
+		if schedule.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+
+			continue
+		}
+
+		if schedule.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
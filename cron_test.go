@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expression := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"10-5 * * * *",
+		"1-x * * * *",
+		"* * * foo *",
+		"@sometimes",
+	} {
+		if _, err := ParseCron(expression); !errors.Is(err, errInvalidCron) {
+			t.Errorf("%q: got %v, want %v", expression, err, errInvalidCron)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// a wednesday.
+	start := time.Date(2025, 1, 1, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		expression string
+		want       time.Time
+	}{
+		{"* * * * *", time.Date(2025, 1, 1, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, 1, 1, 10, 15, 0, 0, time.UTC)},
+		{"5 * * * *", time.Date(2025, 1, 1, 11, 5, 0, 0, time.UTC)},
+		{"0,30 9-17 * * *", time.Date(2025, 1, 1, 10, 30, 0, 0, time.UTC)},
+		{"10-20/5 * * * *", time.Date(2025, 1, 1, 10, 10, 0, 0, time.UTC)},
+		{"7/20 * * * *", time.Date(2025, 1, 1, 10, 27, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", time.Date(2025, 1, 2, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * sat,sun", time.Date(2025, 1, 4, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2025, 1, 5, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jun *", time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2025, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2025, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// both day fields restricted: either one matching is enough.
+		{"0 0 15 * fri", time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC)},
+		// a day field starting with * is not restricted, so only the other
+		// one counts.
+		{"0 0 */2 * mon", time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC)},
+		{"0 0 15 * */2", time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, test := range tests {
+		schedule, err := ParseCron(test.expression)
+		if err != nil {
+			t.Errorf("%q: %v", test.expression, err)
+
+			continue
+		}
+
+		if got := schedule.Next(start); !got.Equal(test.want) {
+			t.Errorf("%q: got %v, want %v", test.expression, got, test.want)
+		}
+	}
+}
@@ -133,6 +133,74 @@ func AddSaneDefaults(config *TomlConfig) {
 		config.DbBackOffMaxInterval = 60
 	}
 
+	if config.SendQueueGlobalRate == 0 {
+		config.SendQueueGlobalRate = 2
+	}
+
+	if config.SendQueueGlobalBurst == 0 {
+		config.SendQueueGlobalBurst = 5
+	}
+
+	if config.SendQueueTargetRate == 0 {
+		config.SendQueueTargetRate = 1
+	}
+
+	if config.SendQueueTargetBurst == 0 {
+		config.SendQueueTargetBurst = 3
+	}
+
+	if config.SendQueueMaxDepth == 0 {
+		config.SendQueueMaxDepth = 500
+	}
+
+	if config.PrivateRateLimit == 0 {
+		config.PrivateRateLimit = 6
+	}
+
+	if config.PrivateRateBurst == 0 {
+		config.PrivateRateBurst = 3
+	}
+
+	if config.LoopReplyWindow == 0 {
+		config.LoopReplyWindow = 3
+	}
+
+	if config.LoopStrikes == 0 {
+		config.LoopStrikes = 3
+	}
+
+	if config.LoopIgnoreDuration == 0 {
+		config.LoopIgnoreDuration = 600
+	}
+
+	if config.RejoinDelay == 0 {
+		config.RejoinDelay = 10
+	}
+
+	if config.ChannelCheckInterval == 0 {
+		config.ChannelCheckInterval = 300
+	}
+
+	if config.NickServName == "" {
+		config.NickServName = "NickServ"
+	}
+
+	if config.URLFetchTimeout == 0 {
+		config.URLFetchTimeout = 10
+	}
+
+	if config.URLFetchMaxBytes == 0 {
+		config.URLFetchMaxBytes = 1048576
+	}
+
+	if config.DefaultTimezone == "" {
+		config.DefaultTimezone = "UTC"
+	}
+
+	if config.QuietMode == "" {
+		config.QuietMode = "q"
+	}
+
 	if config.OllamaThink == "" {
 		config.OllamaThink = "false"
 	}
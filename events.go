@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v5"
+	"github.com/lrstanley/girc"
+)
+
+// The kinds of events sinks get.
+const (
+	EventWatchlist  = "watchlist"
+	EventCommand    = "command"
+	EventConnect    = "connect"
+	EventDisconnect = "disconnect"
+	EventError      = "error"
+)
+
+// BotEvent is the JSON body posted to sinks.
+type BotEvent struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Network   string    `json:"network,omitempty"`
+	Channel   string    `json:"channel,omitempty"`
+	Nick      string    `json:"nick,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Watchlist string    `json:"watchlist,omitempty"`
+	Word      string    `json:"word,omitempty"`
+	Command   string    `json:"command,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Allowed   *bool     `json:"allowed,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+const (
+	defaultSinkTimeout        = 10
+	defaultSinkMaxTries       = 5
+	defaultSinkMaxElapsedTime = 300
+)
+
+var (
+	sinksMu     sync.RWMutex
+	sinks       map[string]Sink
+	sinksConfig map[string]Sink
+)
+
+// setSinks replaces the sinks, it is called at startup and on reload.
+func setSinks(updated map[string]Sink) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+
+	sinksConfig = updated
+	sinks = make(map[string]Sink, len(updated))
+
+	for name, sink := range updated {
+		if sink.URL == "" {
+			slog.Warn("sink has no url", "sink", name)
+
+			continue
+		}
+
+		if sink.Timeout == 0 {
+			sink.Timeout = defaultSinkTimeout
+		}
+
+		if sink.MaxTries == 0 {
+			sink.MaxTries = defaultSinkMaxTries
+		}
+
+		if sink.MaxElapsedTime == 0 {
+			sink.MaxElapsedTime = defaultSinkMaxElapsedTime
+		}
+
+		sinks[name] = sink
+	}
+}
+
+func sinksDiffer(updated map[string]Sink) bool {
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+
+	if len(updated) == 0 && len(sinksConfig) == 0 {
+		return false
+	}
+
+	return !reflect.DeepEqual(updated, sinksConfig)
+}
+
+func matchesFilter(filter []string, value string) bool {
+	return len(filter) == 0 || slices.ContainsFunc(filter, func(item string) bool {
+		return strings.EqualFold(item, value)
+	})
+}
+
+// wants tells whether an event passes the sink's filter. An empty list lets
+// everything through.
+func (sink Sink) wants(event BotEvent) bool {
+	if !matchesFilter(sink.Events, event.Type) {
+		return false
+	}
+
+	if len(sink.Networks) > 0 && !matchesFilter(sink.Networks, event.Network) {
+		return false
+	}
+
+	if len(sink.Channels) > 0 && !matchesFilter(sink.Channels, event.Channel) {
+		return false
+	}
+
+	if len(sink.Watchlists) > 0 && event.Type == EventWatchlist && !matchesFilter(sink.Watchlists, event.Watchlist) {
+		return false
+	}
+
+	return true
+}
+
+// emitEvent posts an event to every sink that wants it. Deliveries run in
+// the background, so this never blocks the caller.
+func emitEvent(event BotEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+
+	for name, sink := range sinks {
+		if !sink.wants(event) {
+			continue
+		}
+
+		go deliverEvent(name, sink, event)
+	}
+}
+
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverEvent posts an event to a sink, retrying with exponential backoff
+// on network errors and on 429 and 5xx responses. Failures are only logged,
+// never passed to LogError, so a broken sink can't feed itself error events.
+func deliverEvent(name string, sink Sink, event BotEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("sink", "sink", name, "error", err)
+
+		return
+	}
+
+	timeout := time.Duration(sink.Timeout) * time.Second
+	client := &http.Client{Timeout: timeout}
+
+	post := func() (int, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, sink.URL, bytes.NewReader(body))
+		if err != nil {
+			return 0, backoff.Permanent(err)
+		}
+
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("User-Agent", "milla")
+		request.Header.Set("X-Milla-Event", event.Type)
+
+		if sink.Secret != "" {
+			request.Header.Set("X-Milla-Signature-256", signPayload(sink.Secret, body))
+		}
+
+		for header, value := range sink.Headers {
+			request.Header.Set(header, value)
+		}
+
+		response, err := client.Do(request)
+		if err != nil {
+			return 0, err
+		}
+		defer response.Body.Close()
+
+		switch {
+		case response.StatusCode < 300: //nolint: mnd,gomnd
+			return response.StatusCode, nil
+		case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500: //nolint: mnd,gomnd
+			return 0, errors.New(response.Status)
+		default:
+			return 0, backoff.Permanent(errors.New(response.Status))
+		}
+	}
+
+	_, err = backoff.Retry(context.Background(), post,
+		backoff.WithBackOff(backoff.NewExponentialBackOff()),
+		backoff.WithMaxTries(sink.MaxTries),
+		backoff.WithMaxElapsedTime(time.Duration(sink.MaxElapsedTime)*time.Second))
+	if err != nil {
+		slog.Warn("could not deliver event", "sink", name, "type", event.Type, "error", err)
+	}
+}
+
+// setupEvents reports a network's connects and disconnects to the sinks.
+func setupEvents(irc *girc.Client, appConfig *TomlConfig) {
+	irc.Handlers.AddBg(girc.CONNECTED, func(client *girc.Client, _ girc.Event) {
+		appConfig := appConfig.current()
+
+		emitEvent(BotEvent{Type: EventConnect, Network: appConfig.IRCDName, Nick: client.GetNick()})
+	})
+
+	irc.Handlers.AddBg(girc.DISCONNECTED, func(_ *girc.Client, _ girc.Event) {
+		appConfig := appConfig.current()
+
+		emitEvent(BotEvent{Type: EventDisconnect, Network: appConfig.IRCDName})
+	})
+}
@@ -4,10 +4,8 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 
 	"github.com/alecthomas/chroma/v2/quick"
@@ -44,7 +42,9 @@ func DoGeminiRequest(
 	appConfig *TomlConfig,
 	geminiMemory *[]*genai.Content,
 	prompt, systemPrompt string,
-) (string, error) {
+) (_ string, err error) {
+	defer func(start time.Time) { observeLLMRequest("gemini", appConfig.Model, start, err) }(time.Now())
+
 	httpProxyClient := &http.Client{Transport: &ProxyRoundTripper{
 		APIKey:   appConfig.Apikey,
 		ProxyURL: appConfig.LLMProxy,
@@ -58,7 +58,7 @@ func DoGeminiRequest(
 		HTTPClient: httpProxyClient,
 	})
 	if err != nil {
-		return "", fmt.Errorf("Could not create a genai client.", err)
+		return "", fmt.Errorf("Could not create a genai client: %w", err)
 	}
 
 	*geminiMemory = append(*geminiMemory, genai.NewContentFromText(prompt, "user"))
@@ -99,7 +99,11 @@ func DoGeminiRequest(
 		// },
 	})
 	if err != nil {
-		return "", fmt.Errorf("Gemini: Could not generate content", err)
+		return "", fmt.Errorf("Gemini: Could not generate content: %w", err)
+	}
+
+	if usage := result.UsageMetadata; usage != nil {
+		countLLMTokens("gemini", appConfig.Model, int(usage.PromptTokenCount), int(usage.CandidatesTokenCount))
 	}
 
 	return result.Text(), nil
@@ -114,12 +118,12 @@ func GeminiRequestProcessor(
 ) string {
 	geminiResponse, err := DoGeminiRequest(appConfig, geminiMemory, prompt, systemPrompt)
 	if err != nil {
-		client.Cmd.ReplyTo(event, "error: "+err.Error())
+		QueueReplyTo(client, event, "error: "+err.Error())
 
 		return ""
 	}
 
-	log.Println(geminiResponse)
+	logMessageContent(nil, "gemini response", "content", geminiResponse)
 
 	if len(*geminiMemory) > appConfig.MemoryLimit {
 		*geminiMemory = []*genai.Content{}
@@ -141,7 +145,7 @@ func GeminiRequestProcessor(
 		appConfig.ChromaFormatter,
 		appConfig.ChromaStyle)
 	if err != nil {
-		client.Cmd.ReplyTo(event, "error: "+err.Error())
+		QueueReplyTo(client, event, "error: "+err.Error())
 
 		return ""
 	}
@@ -155,34 +159,32 @@ func GeminiHandler(
 	geminiMemory *[]*genai.Content,
 ) {
 	irc.Handlers.AddBg(girc.PRIVMSG, func(client *girc.Client, event girc.Event) {
-		if !strings.HasPrefix(event.Last(), appConfig.IrcNick+": ") {
+		appConfig := appConfig.current()
+
+		match, ok := extractPrompt(client, event, appConfig)
+		if !ok {
 			return
 		}
 
-		if appConfig.AdminOnly {
-			byAdmin := false
+		prompt := match.Text
 
-			for _, admin := range appConfig.Admins {
-				if event.Source.Name == admin {
-					byAdmin = true
-				}
-			}
+		logger := eventLogger(appConfig, event)
+		logMessageContent(logger, "prompt", "text", prompt)
 
-			if !byAdmin {
-				return
-			}
-		}
-
-		prompt := strings.TrimPrefix(event.Last(), appConfig.IrcNick+": ")
-		log.Println(prompt)
-
-		if string(prompt[0]) == "/" {
+		if match.IsCommand {
+			logger.Info("running a command")
 			runCommand(client, event, appConfig)
 
 			return
 		}
 
+		logger.Info("asking the llm", "provider", "gemini", "model", appConfig.Model)
+
+		start := time.Now()
+		stopTyping := StartTyping(client, event)
 		result := GeminiRequestProcessor(appConfig, client, event, geminiMemory, prompt, appConfig.SystemPrompt)
+		stopTyping()
+		logger.Info("answered", "duration", time.Since(start), "ok", result != "")
 
 		if result != "" {
 			SendToIRC(client, event, result, appConfig.ChromaFormatter)
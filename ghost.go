@@ -14,6 +14,52 @@ import (
 	"golang.org/x/net/proxy"
 )
 
+type ghostListener struct {
+	Config   GhostNetwork
+	Listener net.Listener
+}
+
+var (
+	ghostListenersMu sync.Mutex
+	ghostListeners   = make(map[string]*ghostListener)
+)
+
+// StopGhost closes a ghost's listener. Clients that are already connected
+// keep their connections.
+func StopGhost(name string) {
+	ghostListenersMu.Lock()
+	defer ghostListenersMu.Unlock()
+
+	if ghost, ok := ghostListeners[name]; ok {
+		ghost.Listener.Close()
+		delete(ghostListeners, name)
+	}
+}
+
+func runningGhosts() []string {
+	ghostListenersMu.Lock()
+	defer ghostListenersMu.Unlock()
+
+	names := make([]string, 0, len(ghostListeners))
+	for name := range ghostListeners {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func getGhostConfig(name string) (GhostNetwork, bool) {
+	ghostListenersMu.Lock()
+	defer ghostListenersMu.Unlock()
+
+	ghost, ok := ghostListeners[name]
+	if !ok {
+		return GhostNetwork{}, false
+	}
+
+	return ghost.Config, true
+}
+
 func RunGhost(ghostNetwork GhostNetwork, name string) {
 	var listener net.Listener
 
@@ -53,11 +99,21 @@ func RunGhost(ghostNetwork GhostNetwork, name string) {
 
 	defer listener.Close()
 
+	ghostListenersMu.Lock()
+	ghostListeners[name] = &ghostListener{Config: ghostNetwork, Listener: listener}
+	ghostListenersMu.Unlock()
+
 	log.Printf("Ghost %s: IRC Bouncer listening on %s", name, ghostNetwork.ListenAddress)
 	log.Printf("Ghost %s: Connecting clients to IRC server: %s", name, ghostNetwork.ServerAddress)
 
 	for {
 		clientConn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			log.Printf("Ghost %s: stopped listening on %s", name, ghostNetwork.ListenAddress)
+
+			return
+		}
+
 		if err != nil {
 			log.Printf("Ghost %s: Failed to accept client connection: %v", name, err)
 
@@ -191,6 +247,11 @@ func handleClientConnection(clientConn net.Conn, ghostNetwork GhostNetwork, name
 
 	log.Printf("Ghost %s: Successfully connected to IRC server: %s", name, ghostNetwork.ServerAddress)
 
+	ghostConnections.Add(1, name)
+	ghostConnectionsTotal.Inc(name)
+
+	defer ghostConnections.Add(-1, name)
+
 	done := make(chan struct{})
 
 	var once sync.Once
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+const (
+	IgnoreNick    = "nick"
+	IgnoreMask    = "mask"
+	IgnoreAccount = "account"
+)
+
+var errUnknIgnoreKind = errors.New("ignore kind must be one of nick, mask or account")
+
+const ignoreAddedByConfig = "config"
+
+var (
+	ignoreListsMu sync.RWMutex
+	ignoreLists   = make(map[*girc.Client]*IgnoreList)
+)
+
+type IgnoreEntry struct {
+	Kind    string
+	Pattern string
+	AddedBy string
+	// Until is set for temporary ignores, e.g. the ones the loop detector
+	// adds. Those are never written to the database.
+	Until time.Time
+	// FromConfig is set for the ignores from the config file, a reload
+	// replaces those.
+	FromConfig bool
+}
+
+type loopState struct {
+	strikes int
+	last    time.Time
+}
+
+// outgoingReply is the last answer the bot sent to a target and the nick it
+// answered.
+type outgoingReply struct {
+	to   string
+	sent time.Time
+}
+
+// IgnoreList holds the ignores of one network along with the state the
+// bot-loop detector needs.
+type IgnoreList struct {
+	mu           sync.Mutex
+	entries      []IgnoreEntry
+	loops        map[string]*loopState
+	lastOutgoing map[string]outgoingReply
+	lastPrune    time.Time
+}
+
+func NewIgnoreList() *IgnoreList {
+	return &IgnoreList{
+		loops:        make(map[string]*loopState),
+		lastOutgoing: make(map[string]outgoingReply),
+		lastPrune:    time.Now(),
+	}
+}
+
+func (list *IgnoreList) Add(entry IgnoreEntry) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	for index, existing := range list.entries {
+		if existing.Kind == entry.Kind && strings.EqualFold(existing.Pattern, entry.Pattern) {
+			// a temporary ignore must not turn a permanent one into one that
+			// runs out.
+			if existing.Until.IsZero() && !entry.Until.IsZero() {
+				return false
+			}
+
+			list.entries[index] = entry
+
+			return false
+		}
+	}
+
+	list.entries = append(list.entries, entry)
+
+	return true
+}
+
+func (list *IgnoreList) Remove(kind, pattern string) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	for index, existing := range list.entries {
+		if existing.Kind == kind && strings.EqualFold(existing.Pattern, pattern) {
+			list.entries = append(list.entries[:index], list.entries[index+1:]...)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// RemoveFromConfig drops the entries from the config file so a reload can
+// add them again.
+func (list *IgnoreList) RemoveFromConfig() {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	kept := list.entries[:0]
+
+	for _, entry := range list.entries {
+		if !entry.FromConfig {
+			kept = append(kept, entry)
+		}
+	}
+
+	list.entries = kept
+}
+
+func (list *IgnoreList) Entries() []IgnoreEntry {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	now := time.Now()
+	entries := make([]IgnoreEntry, 0, len(list.entries))
+
+	for _, entry := range list.entries {
+		if !entry.Until.IsZero() && now.After(entry.Until) {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func eventAccount(client *girc.Client, event girc.Event) string {
+	if account, ok := event.Tags.Get("account"); ok && account != "*" {
+		return account
+	}
+
+	if event.Source == nil || client == nil || !client.IsConnected() {
+		return ""
+	}
+
+	if user := client.LookupUser(event.Source.Name); user != nil && user.Extras.Account != "*" {
+		return user.Extras.Account
+	}
+
+	return ""
+}
+
+func (list *IgnoreList) Matches(client *girc.Client, event girc.Event) (IgnoreEntry, bool) {
+	if event.Source == nil {
+		return IgnoreEntry{}, false
+	}
+
+	account := eventAccount(client, event)
+	mask := event.Source.String()
+	now := time.Now()
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	for _, entry := range list.entries {
+		if !entry.Until.IsZero() && now.After(entry.Until) {
+			continue
+		}
+
+		switch entry.Kind {
+		case IgnoreNick:
+			if strings.EqualFold(entry.Pattern, event.Source.Name) {
+				return entry, true
+			}
+		case IgnoreMask:
+			if matchGlob(entry.Pattern, mask) {
+				return entry, true
+			}
+		case IgnoreAccount:
+			if account != "" && strings.EqualFold(entry.Pattern, account) {
+				return entry, true
+			}
+		}
+	}
+
+	return IgnoreEntry{}, false
+}
+
+func (list *IgnoreList) noteReply(target, to string) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	list.lastOutgoing[strings.ToLower(target)] = outgoingReply{to: strings.ToLower(to), sent: time.Now()}
+}
+
+// prune forgets nicks and targets that have been quiet for longer than the
+// reply window, their strikes would be reset anyway.
+func (list *IgnoreList) prune(now time.Time, window time.Duration) {
+	for nick, state := range list.loops {
+		if now.Sub(state.last) > window {
+			delete(list.loops, nick)
+		}
+	}
+
+	for target, reply := range list.lastOutgoing {
+		if now.Sub(reply.sent) > window {
+			delete(list.lastOutgoing, target)
+		}
+	}
+
+	list.lastPrune = now
+}
+
+// checkLoop counts how often a nick triggers the bot right after the bot
+// answered that nick. Humans need a few seconds to read an answer, another
+// bot doesn't. Returns true once the nick has done that often enough in a
+// row to count as a loop.
+func (list *IgnoreList) checkLoop(event girc.Event, appConfig *TomlConfig) bool {
+	target := replyTarget(event)
+	nick := strings.ToLower(event.Source.Name)
+	window := time.Duration(appConfig.LoopReplyWindow) * time.Second
+	now := time.Now()
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	if now.Sub(list.lastPrune) > sendQueuePruneInterval {
+		list.prune(now, window)
+	}
+
+	state, ok := list.loops[nick]
+	if !ok {
+		state = &loopState{}
+		list.loops[nick] = state
+	}
+
+	state.last = now
+
+	// someone else talking right after the bot answered a third nick is not
+	// a loop.
+	lastOutgoing, ok := list.lastOutgoing[strings.ToLower(target)]
+	if !ok || lastOutgoing.to != nick || now.Sub(lastOutgoing.sent) > window {
+		state.strikes = 0
+
+		return false
+	}
+
+	state.strikes++
+
+	if state.strikes < appConfig.LoopStrikes {
+		return false
+	}
+
+	state.strikes = 0
+
+	return true
+}
+
+func isBotEvent(event girc.Event) bool {
+	if _, ok := event.Tags.Get("bot"); ok {
+		return true
+	}
+
+	_, ok := event.Tags.Get("draft/bot")
+
+	return ok
+}
+
+// isIgnored is checked before the bot reacts to a message. It only checks,
+// the loop detector is fed by checkBotLoop. Admins are never ignored so they
+// can't lock themselves out, that is only checked for messages that would
+// be ignored so not every message ends up in the audit.
+func isIgnored(client *girc.Client, event girc.Event, appConfig *TomlConfig) bool {
+	if appConfig.ignoreList == nil || event.Source == nil {
+		return false
+	}
+
+	if !appConfig.AllowBots && isBotEvent(event) {
+		if checkAdmin(client, event, appConfig, "ignore bypass") {
+			return false
+		}
+
+		slog.Debug("ignoring message from bot", "network", appConfig.IRCDName, "nick", event.Source.Name)
+
+		return true
+	}
+
+	if entry, ok := appConfig.ignoreList.Matches(client, event); ok {
+		if checkAdmin(client, event, appConfig, "ignore bypass") {
+			return false
+		}
+
+		slog.Debug("ignoring message", "network", appConfig.IRCDName, "nick", event.Source.Name,
+			"kind", entry.Kind, "pattern", entry.Pattern)
+
+		return true
+	}
+
+	return false
+}
+
+// checkBotLoop is called once for every message that matched a trigger. It
+// adds a strike if the message came right after the bot answered someone
+// there, and ignores the nick for a while once it has enough of them.
+// Returns true if the nick was just ignored.
+func checkBotLoop(client *girc.Client, event girc.Event, appConfig *TomlConfig) bool {
+	if appConfig.ignoreList == nil || event.Source == nil || appConfig.LoopStrikes <= 0 {
+		return false
+	}
+
+	if !appConfig.ignoreList.checkLoop(event, appConfig) || checkAdmin(client, event, appConfig, "loop bypass") {
+		return false
+	}
+
+	appConfig.ignoreList.Add(IgnoreEntry{
+		Kind:    IgnoreNick,
+		Pattern: event.Source.Name,
+		AddedBy: appConfig.IrcNick,
+		Until:   time.Now().Add(time.Duration(appConfig.LoopIgnoreDuration) * time.Second),
+	})
+
+	slog.Warn("looks like a bot stuck in a loop with us, ignoring it", "network", appConfig.IRCDName,
+		"nick", event.Source.Name, "seconds", appConfig.LoopIgnoreDuration)
+
+	return true
+}
+
+// noteReply is called when the bot sends an answer so the loop detector
+// knows when and whom the bot last answered in a target. RSS, relay, webhook
+// and other bulk lines don't count, nobody is answering those.
+func noteReply(client *girc.Client, target, to string) {
+	ignoreListsMu.RLock()
+	list := ignoreLists[client]
+	ignoreListsMu.RUnlock()
+
+	if list != nil {
+		list.noteReply(target, to)
+	}
+}
+
+func createIgnoreTable(appConfig *TomlConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx, `create table if not exists ignores (
+			id serial primary key,
+			network text not null,
+			kind text not null,
+			pattern text not null,
+			added_by text not null,
+			dateadded timestamp default current_timestamp,
+			unique (network, kind, pattern)
+		)`)
+
+	return err
+}
+
+func loadIgnores(appConfig *TomlConfig) {
+	if appConfig.pool == nil {
+		return
+	}
+
+	err := createIgnoreTable(appConfig)
+	if err != nil {
+		LogError(err)
+
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	rows, err := appConfig.pool.Query(ctx, "select kind, pattern, added_by from ignores where network = $1", appConfig.IRCDName)
+	if err != nil {
+		LogError(err)
+
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry IgnoreEntry
+
+		err := rows.Scan(&entry.Kind, &entry.Pattern, &entry.AddedBy)
+		if err != nil {
+			LogError(err)
+
+			continue
+		}
+
+		appConfig.ignoreList.Add(entry)
+	}
+
+	slog.Info("loaded ignores", "network", appConfig.IRCDName, "count", len(appConfig.ignoreList.Entries()))
+}
+
+func saveIgnore(appConfig *TomlConfig, entry IgnoreEntry) error {
+	if appConfig.pool == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx,
+		`insert into ignores (network, kind, pattern, added_by) values ($1, $2, $3, $4)
+			on conflict (network, kind, pattern) do update set added_by = excluded.added_by`,
+		appConfig.IRCDName, entry.Kind, entry.Pattern, entry.AddedBy)
+
+	return err
+}
+
+func deleteIgnore(appConfig *TomlConfig, kind, pattern string) error {
+	if appConfig.pool == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx,
+		"delete from ignores where network = $1 and kind = $2 and lower(pattern) = lower($3)",
+		appConfig.IRCDName, kind, pattern)
+
+	return err
+}
+
+// parseIgnoreArgs takes either "<kind> <pattern>" or just "<pattern>", in
+// which case anything that looks like a hostmask is a mask and everything
+// else a nick.
+func parseIgnoreArgs(args []string) (string, string, error) {
+	if len(args) == 0 {
+		return "", "", errNotEnoughArgs
+	}
+
+	if len(args) == 1 {
+		if strings.ContainsAny(args[0], "!@*?") {
+			return IgnoreMask, args[0], nil
+		}
+
+		return IgnoreNick, args[0], nil
+	}
+
+	switch args[0] {
+	case IgnoreNick, IgnoreMask, IgnoreAccount:
+		return args[0], args[1], nil
+	default:
+		return "", "", errUnknIgnoreKind
+	}
+}
+
+func handleIgnoreCommand(
+	args []string,
+	client *girc.Client,
+	event girc.Event,
+	appConfig *TomlConfig,
+) {
+	if len(args) < 2 { //nolint: mnd,gomnd
+		QueueReply(client, event, errNotEnoughArgs.Error())
+
+		return
+	}
+
+	switch args[1] {
+	case "add":
+		kind, pattern, err := parseIgnoreArgs(args[2:])
+		if err != nil {
+			QueueReply(client, event, err.Error())
+
+			return
+		}
+
+		entry := IgnoreEntry{Kind: kind, Pattern: pattern, AddedBy: event.Source.Name}
+		appConfig.ignoreList.Add(entry)
+
+		err = saveIgnore(appConfig, entry)
+		if err != nil {
+			LogError(err)
+			QueueReply(client, event, "ignoring "+kind+" "+pattern+" until restart, could not save it: "+err.Error())
+
+			return
+		}
+
+		QueueReply(client, event, "ignoring "+kind+" "+pattern)
+	case "del":
+		kind, pattern, err := parseIgnoreArgs(args[2:])
+		if err != nil {
+			QueueReply(client, event, err.Error())
+
+			return
+		}
+
+		if !appConfig.ignoreList.Remove(kind, pattern) {
+			QueueReply(client, event, "not ignoring "+kind+" "+pattern)
+
+			return
+		}
+
+		err = deleteIgnore(appConfig, kind, pattern)
+		if err != nil {
+			LogError(err)
+			QueueReply(client, event, "error: "+err.Error())
+
+			return
+		}
+
+		QueueReply(client, event, "no longer ignoring "+kind+" "+pattern)
+	case "list":
+		entries := appConfig.ignoreList.Entries()
+		if len(entries) == 0 {
+			QueueReply(client, event, "the ignore list is empty")
+
+			return
+		}
+
+		for _, entry := range entries {
+			line := fmt.Sprintf("%s %s (by %s)", entry.Kind, entry.Pattern, entry.AddedBy)
+			if !entry.Until.IsZero() {
+				line += " until " + entry.Until.Format(time.RFC3339)
+			}
+
+			QueueReply(client, event, line)
+		}
+	default:
+		QueueReply(client, event, errUnknCmd.Error())
+	}
+}
+
+// seedIgnores adds the ignores from the config file.
+func seedIgnores(appConfig *TomlConfig) {
+	for _, nick := range appConfig.IgnoredNicks {
+		appConfig.ignoreList.Add(IgnoreEntry{Kind: IgnoreNick, Pattern: nick, AddedBy: ignoreAddedByConfig, FromConfig: true})
+	}
+
+	for _, mask := range appConfig.IgnoredMasks {
+		appConfig.ignoreList.Add(IgnoreEntry{Kind: IgnoreMask, Pattern: mask, AddedBy: ignoreAddedByConfig, FromConfig: true})
+	}
+
+	for _, account := range appConfig.IgnoredAccounts {
+		appConfig.ignoreList.Add(IgnoreEntry{Kind: IgnoreAccount, Pattern: account, AddedBy: ignoreAddedByConfig, FromConfig: true})
+	}
+}
+
+func setupIgnores(ctx context.Context, irc *girc.Client, appConfig *TomlConfig) {
+	appConfig.ignoreList = NewIgnoreList()
+
+	seedIgnores(appConfig)
+
+	ignoreListsMu.Lock()
+	ignoreLists[irc] = appConfig.ignoreList
+	ignoreListsMu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		ignoreListsMu.Lock()
+		delete(ignoreLists, irc)
+		ignoreListsMu.Unlock()
+	}()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+func ignoreEvent(source, target string) girc.Event {
+	return girc.Event{
+		Source:  girc.ParseSource(source),
+		Command: girc.PRIVMSG,
+		Params:  []string{target, "milla: hello"},
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		input   string
+		want    bool
+	}{
+		{"*!*@example.com", "nick!user@example.com", true},
+		{"*!*@EXAMPLE.com", "nick!user@example.com", true},
+		{"*!*@example.com", "nick!user@sub.example.com", false},
+		{"*!*@*.example.com", "nick!user@sub.example.com", true},
+		{"nick!?ser@*", "nick!user@host", true},
+		{"nick!?ser@*", "nick!uuser@host", false},
+		{"a.b!*@*", "axb!user@host", false},
+		{"[bot]*!*@*", "[bot]milla!user@host", true},
+		{"", "nick!user@host", false},
+	}
+
+	for _, test := range tests {
+		if got := matchGlob(test.pattern, test.input); got != test.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", test.pattern, test.input, got, test.want)
+		}
+	}
+}
+
+func TestIgnoreListMatches(t *testing.T) {
+	list := NewIgnoreList()
+	list.Add(IgnoreEntry{Kind: IgnoreNick, Pattern: "Spammer"})
+	list.Add(IgnoreEntry{Kind: IgnoreMask, Pattern: "*!*@bad.example.com"})
+	list.Add(IgnoreEntry{Kind: IgnoreAccount, Pattern: "troll"})
+	list.Add(IgnoreEntry{Kind: IgnoreNick, Pattern: "gone", Until: time.Now().Add(-time.Minute)})
+
+	tests := []struct {
+		source  string
+		account string
+		want    bool
+	}{
+		{"spammer!user@host", "", true},
+		{"nick!user@bad.example.com", "", true},
+		{"nick!user@host", "troll", true},
+		{"nick!user@host", "", false},
+		{"gone!user@host", "", false},
+	}
+
+	for _, test := range tests {
+		event := ignoreEvent(test.source, "#milla")
+		if test.account != "" {
+			event.Tags = girc.Tags{"account": test.account}
+		}
+
+		if _, got := list.Matches(nil, event); got != test.want {
+			t.Errorf("%s (account %q): got %v, want %v", test.source, test.account, got, test.want)
+		}
+	}
+}
+
+func TestIgnoreListAdd(t *testing.T) {
+	list := NewIgnoreList()
+
+	if !list.Add(IgnoreEntry{Kind: IgnoreNick, Pattern: "nick"}) {
+		t.Fatal("a new entry was not added")
+	}
+
+	if list.Add(IgnoreEntry{Kind: IgnoreNick, Pattern: "NICK", Until: time.Now().Add(time.Minute)}) {
+		t.Error("the same pattern was added twice")
+	}
+
+	if entries := list.Entries(); len(entries) != 1 || !entries[0].Until.IsZero() {
+		t.Errorf("a temporary ignore replaced a permanent one: %+v", entries)
+	}
+
+	if !list.Remove(IgnoreNick, "Nick") || len(list.Entries()) != 0 {
+		t.Error("the entry was not removed")
+	}
+}
+
+func TestIgnoreListRemoveFromConfig(t *testing.T) {
+	list := NewIgnoreList()
+	list.Add(IgnoreEntry{Kind: IgnoreNick, Pattern: "seeded", AddedBy: ignoreAddedByConfig, FromConfig: true})
+	list.Add(IgnoreEntry{Kind: IgnoreNick, Pattern: "runtime", AddedBy: "config"})
+
+	list.RemoveFromConfig()
+
+	entries := list.Entries()
+	if len(entries) != 1 || entries[0].Pattern != "runtime" {
+		t.Errorf("got %+v, want only the ignore added by the nick config", entries)
+	}
+}
+
+func TestParseIgnoreArgs(t *testing.T) {
+	tests := []struct {
+		args    []string
+		kind    string
+		pattern string
+		err     error
+	}{
+		{[]string{"nick"}, IgnoreNick, "nick", nil},
+		{[]string{"*!*@host"}, IgnoreMask, "*!*@host", nil},
+		{[]string{"account", "troll"}, IgnoreAccount, "troll", nil},
+		{[]string{"channel", "#milla"}, "", "", errUnknIgnoreKind},
+		{nil, "", "", errNotEnoughArgs},
+	}
+
+	for _, test := range tests {
+		kind, pattern, err := parseIgnoreArgs(test.args)
+		if kind != test.kind || pattern != test.pattern || !errors.Is(err, test.err) {
+			t.Errorf("%q: got %q %q %v, want %q %q %v", test.args, kind, pattern, err, test.kind, test.pattern, test.err)
+		}
+	}
+}
+
+func TestCheckLoop(t *testing.T) {
+	appConfig := &TomlConfig{LoopReplyWindow: 60, LoopStrikes: 2}
+	list := NewIgnoreList()
+	bot := ignoreEvent("otherbot!bot@host", "#milla")
+
+	// the bot answering someone else is not a strike for otherbot.
+	list.noteReply("#milla", "human")
+
+	if list.checkLoop(bot, appConfig) || list.loops["otherbot"].strikes != 0 {
+		t.Fatal("counted a strike for answering another nick")
+	}
+
+	list.noteReply("#milla", "OtherBot")
+
+	if list.checkLoop(bot, appConfig) {
+		t.Fatal("a loop after one strike")
+	}
+
+	list.noteReply("#milla", "otherbot")
+
+	if !list.checkLoop(bot, appConfig) {
+		t.Fatal("no loop after two strikes")
+	}
+
+	if list.loops["otherbot"].strikes != 0 {
+		t.Error("strikes were not reset after the loop was caught")
+	}
+}
+
+func TestIgnoreListPrune(t *testing.T) {
+	list := NewIgnoreList()
+	list.noteReply("#milla", "nick")
+	list.loops["nick"] = &loopState{strikes: 1, last: time.Now()}
+
+	list.prune(time.Now(), time.Minute)
+
+	if len(list.loops) != 1 || len(list.lastOutgoing) != 1 {
+		t.Fatal("pruned state that is still inside the window")
+	}
+
+	list.prune(time.Now().Add(2*time.Minute), time.Minute)
+
+	if len(list.loops) != 0 || len(list.lastOutgoing) != 0 {
+		t.Errorf("kept %d nicks and %d targets after the window", len(list.loops), len(list.lastOutgoing))
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+const (
+	capMessageTags = "message-tags"
+	capMultiline   = "draft/multiline"
+	capBatch       = "batch"
+
+	// the typing spec says clients should resend "active" at most every 3
+	// seconds and others consider it stale after 6.
+	typingInterval = 3 * time.Second
+)
+
+type multilineLimits struct {
+	MaxBytes int
+	MaxLines int
+}
+
+var (
+	multilineLimitsMu sync.RWMutex
+	multilineLimitsBy = make(map[*girc.Client]multilineLimits)
+)
+
+// ircv3SupportedCaps are the capabilities milla asks for on top of the ones
+// girc already requests on its own.
+func ircv3SupportedCaps() map[string][]string {
+	return map[string][]string{
+		capMultiline: nil,
+	}
+}
+
+// trackMultilineLimits remembers the max-bytes and max-lines values the
+// server advertises for draft/multiline since girc does not expose them, it
+// forgets them when ctx is cancelled.
+func trackMultilineLimits(ctx context.Context, irc *girc.Client) {
+	go func() {
+		<-ctx.Done()
+
+		multilineLimitsMu.Lock()
+		delete(multilineLimitsBy, irc)
+		multilineLimitsMu.Unlock()
+	}()
+
+	irc.Handlers.AddBg(girc.CAP, func(client *girc.Client, event girc.Event) {
+		if len(event.Params) < 3 || (event.Params[1] != girc.CAP_LS && event.Params[1] != girc.CAP_NEW) {
+			return
+		}
+
+		for _, capability := range strings.Split(event.Last(), " ") {
+			name, value, found := strings.Cut(capability, "=")
+			if !found || name != capMultiline {
+				continue
+			}
+
+			var limits multilineLimits
+
+			for _, option := range strings.Split(value, ",") {
+				key, optionValue, _ := strings.Cut(option, "=")
+
+				number, err := strconv.Atoi(optionValue)
+				if err != nil {
+					continue
+				}
+
+				switch key {
+				case "max-bytes":
+					limits.MaxBytes = number
+				case "max-lines":
+					limits.MaxLines = number
+				}
+			}
+
+			multilineLimitsMu.Lock()
+			multilineLimitsBy[client] = limits
+			multilineLimitsMu.Unlock()
+		}
+	})
+}
+
+func getMultilineLimits(client *girc.Client) multilineLimits {
+	multilineLimitsMu.RLock()
+	defer multilineLimitsMu.RUnlock()
+
+	return multilineLimitsBy[client]
+}
+
+func hasMessageTags(client *girc.Client) bool {
+	return client.IsConnected() && client.HasCapability(capMessageTags)
+}
+
+// replyTags links an answer to the message it answers with +draft/reply.
+// It returns nil if the server did not give us a msgid to point at.
+func replyTags(client *girc.Client, event girc.Event) girc.Tags {
+	if !hasMessageTags(client) {
+		return nil
+	}
+
+	msgid, ok := event.Tags.Get("msgid")
+	if !ok || msgid == "" {
+		return nil
+	}
+
+	return girc.Tags{"+draft/reply": msgid}
+}
+
+// sendTyping skips the target's bucket in the send queue, typing
+// notifications are dropped rather than delay the answer they announce.
+func sendTyping(client *girc.Client, target, state string) {
+	event := &girc.Event{
+		Command: girc.CAP_TAGMSG,
+		Params:  []string{target},
+		Tags:    girc.Tags{"+typing": state},
+	}
+
+	queue := getSendQueue(client)
+	if queue == nil {
+		sendEvents(client, []*girc.Event{event})
+
+		return
+	}
+
+	queue.SendNow(target, event)
+}
+
+// StartTyping sends +typing=active to where the event came from until the
+// returned function is called, which sends +typing=done. It is a no-op if
+// the server does not do message-tags.
+func StartTyping(client *girc.Client, event girc.Event) func() {
+	if event.Source == nil || !hasMessageTags(client) {
+		return func() {}
+	}
+
+	target := replyTarget(event)
+	done := make(chan struct{})
+
+	var once sync.Once
+
+	go func() {
+		ticker := time.NewTicker(typingInterval)
+		defer ticker.Stop()
+
+		sendTyping(client, target, "active")
+
+		for {
+			select {
+			case <-done:
+				sendTyping(client, target, "done")
+
+				return
+			case <-ticker.C:
+				sendTyping(client, target, "active")
+			}
+		}
+	}()
+
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+func newBatchReference() string {
+	buffer := make([]byte, 8) //nolint: mnd,gomnd
+
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	return hex.EncodeToString(buffer)
+}
+
+// multilineBatches groups lines into draft/multiline batches that stay
+// under the limits the server advertised.
+func multilineBatches(lines []string, limits multilineLimits) [][]string {
+	var batches [][]string
+
+	var current []string
+
+	currentBytes := 0
+
+	for _, line := range lines {
+		lineBytes := len(line) + 1
+
+		if len(current) > 0 &&
+			((limits.MaxLines > 0 && len(current) >= limits.MaxLines) ||
+				(limits.MaxBytes > 0 && currentBytes+lineBytes > limits.MaxBytes)) {
+			batches = append(batches, current)
+			current = nil
+			currentBytes = 0
+		}
+
+		current = append(current, line)
+		currentBytes += lineBytes
+	}
+
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+
+	return batches
+}
+
+// sendMultiline sends lines as one or more draft/multiline batches. It
+// returns false when the server can't take them so the caller can fall back
+// to sending the lines one by one.
+func sendMultiline(client *girc.Client, event girc.Event, lines []string) bool {
+	if len(lines) < 2 || !client.IsConnected() ||
+		!client.HasCapability(capMultiline) || !client.HasCapability(capBatch) {
+		return false
+	}
+
+	target := replyTarget(event)
+
+	for _, batch := range multilineBatches(lines, getMultilineLimits(client)) {
+		reference := newBatchReference()
+
+		events := []*girc.Event{{
+			Command: "BATCH",
+			Params:  []string{"+" + reference, capMultiline, target},
+			Tags:    replyTags(client, event),
+		}}
+
+		for _, line := range batch {
+			events = append(events, &girc.Event{
+				Command: girc.PRIVMSG,
+				Params:  []string{target, line},
+				Tags:    girc.Tags{"batch": reference},
+			})
+		}
+
+		events = append(events, &girc.Event{
+			Command: "BATCH",
+			Params:  []string{"-" + reference},
+		})
+
+		queueReply(client, event, target, events...)
+	}
+
+	return true
+}
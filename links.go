@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/lrstanley/girc"
+)
+
+const maxLinksResults = 10
+
+var errNoLinks = errors.New("no links found")
+
+// trackingParams are query parameters that only say where a click came
+// from, two links that differ in them are the same link.
+var trackingParams = []string{"fbclid", "gclid", "dclid", "mc_cid", "mc_eid", "igshid", "si", "ref_src"}
+
+// normalizeURL turns a link into the form reposts are compared by: no
+// scheme difference, no www, no default port, no fragment, no tracking
+// parameters, sorted query and no trailing slash. It also returns the host.
+func normalizeURL(link string) (string, string, error) {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return "", "", err
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+
+	if port := parsed.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+
+	query := parsed.Query()
+
+	for key := range query {
+		if strings.HasPrefix(key, "utm_") || slices.Contains(trackingParams, key) {
+			query.Del(key)
+		}
+	}
+
+	normalized := host + strings.TrimSuffix(parsed.EscapedPath(), "/")
+
+	// url.Values.Encode sorts by key.
+	if encoded := query.Encode(); encoded != "" {
+		normalized += "?" + encoded
+	}
+
+	return normalized, parsed.Hostname(), nil
+}
+
+func createLinksTable(appConfig *TomlConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx, `create table if not exists links (
+			id serial primary key,
+			network text not null,
+			channel text not null,
+			url text not null,
+			normalized text not null,
+			host text not null,
+			nick text not null,
+			posted_at timestamptz not null default now()
+		)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = appConfig.pool.Exec(ctx,
+		"create index if not exists links_normalized on links (network, lower(channel), normalized)")
+
+	return err
+}
+
+type LinkRecord struct {
+	Channel  string
+	URL      string
+	Nick     string
+	PostedAt time.Time
+}
+
+// firstPosted returns who first posted a link in a channel, if anyone did.
+func firstPosted(appConfig *TomlConfig, channel, normalized string) (*LinkRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	var record LinkRecord
+
+	err := appConfig.pool.QueryRow(ctx,
+		`select channel, url, nick, posted_at from links
+			where network = $1 and lower(channel) = lower($2) and normalized = $3
+			order by posted_at limit 1`,
+		appConfig.IRCDName, channel, normalized).Scan(&record.Channel, &record.URL, &record.Nick, &record.PostedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+func recordLink(appConfig *TomlConfig, channel, link, normalized, host, nick string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx,
+		"insert into links (network, channel, url, normalized, host, nick) values ($1, $2, $3, $4, $5, $6)",
+		appConfig.IRCDName, channel, link, normalized, strings.TrimPrefix(strings.ToLower(host), "www."), nick)
+
+	return err
+}
+
+func isScrapeChannel(appConfig *TomlConfig, channel string) bool {
+	return slices.ContainsFunc(appConfig.ScrapeChannels, func(scrapeChannel []string) bool {
+		return len(scrapeChannel) > 0 && strings.EqualFold(scrapeChannel[0], channel)
+	})
+}
+
+// LinkHistoryHandler records the links posted in the scrape channels and,
+// if repostNotice is on, points out the ones that were posted before.
+func LinkHistoryHandler(irc *girc.Client, appConfig *TomlConfig) {
+	irc.Handlers.AddBg(girc.PRIVMSG, func(client *girc.Client, event girc.Event) {
+		appConfig := appConfig.current()
+
+		if appConfig.pool == nil || event.Source == nil || strings.EqualFold(event.Source.Name, client.GetNick()) {
+			return
+		}
+
+		channel := event.Params[0]
+		if !isScrapeChannel(appConfig, channel) {
+			return
+		}
+
+		for _, link := range extractURLs(event.Last()) {
+			normalized, host, err := normalizeURL(link)
+			if err != nil {
+				continue
+			}
+
+			if appConfig.RepostNotice && !isIgnored(client, event, appConfig) {
+				first, err := firstPosted(appConfig, channel, normalized)
+				if err != nil {
+					LogError(err)
+				} else if first != nil {
+					QueueMessage(client, PriorityBulk, channel, fmt.Sprintf("%s: already posted by %s %s",
+						event.Source.Name, first.Nick, formatAgo(time.Since(first.PostedAt))))
+				}
+			}
+
+			if err := recordLink(appConfig, channel, link, normalized, host, event.Source.Name); err != nil {
+				LogError(err)
+			}
+		}
+	})
+}
+
+// searchLinks looks through the link history. Each argument is a duration
+// such as 3d for how far back to look, a domain if it has a dot in it, or a
+// nick otherwise.
+func searchLinks(appConfig *TomlConfig, args []string) ([]LinkRecord, error) {
+	conditions := []string{"network = $1"}
+	params := []any{appConfig.IRCDName}
+
+	for _, arg := range args {
+		if arg == "" {
+			continue
+		}
+
+		params = append(params, nil)
+		placeholder := fmt.Sprintf("$%d", len(params))
+
+		if duration, err := parseDuration(arg); err == nil {
+			params[len(params)-1] = time.Now().Add(-duration)
+			conditions = append(conditions, "posted_at >= "+placeholder)
+		} else if strings.Contains(arg, ".") {
+			params[len(params)-1] = strings.TrimPrefix(strings.ToLower(arg), "www.")
+			conditions = append(conditions, fmt.Sprintf("(host = %s or host like '%%.' || %s)", placeholder, placeholder))
+		} else {
+			params[len(params)-1] = arg
+			conditions = append(conditions, "lower(nick) = lower("+placeholder+")")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	query := fmt.Sprintf("select channel, url, nick, posted_at from links where %s order by posted_at desc limit %d",
+		strings.Join(conditions, " and "), maxLinksResults)
+
+	rows, err := appConfig.pool.Query(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []LinkRecord
+
+	for rows.Next() {
+		var record LinkRecord
+
+		if err := rows.Scan(&record.Channel, &record.URL, &record.Nick, &record.PostedAt); err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+func handleLinksCommand(args []string, client *girc.Client, event girc.Event, appConfig *TomlConfig) {
+	if appConfig.pool == nil {
+		QueueReply(client, event, errNoDatabase.Error())
+
+		return
+	}
+
+	records, err := searchLinks(appConfig, args[1:])
+	if err != nil {
+		LogError(err)
+		QueueReply(client, event, err.Error())
+
+		return
+	}
+
+	if len(records) == 0 {
+		QueueReply(client, event, errNoLinks.Error())
+
+		return
+	}
+
+	for _, record := range records {
+		QueueReply(client, event, fmt.Sprintf("%s %s in %s: %s",
+			formatAgo(time.Since(record.PostedAt)), record.Nick, record.Channel, record.URL))
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lrstanley/girc"
+)
+
+const (
+	redacted           = "[REDACTED]"
+	minRedactedSecret  = 4
+	requestIDByteCount = 4
+)
+
+var errLogFormat = errors.New("log format has to be text or json")
+
+var (
+	logLevel   = new(slog.LevelVar)
+	logContent atomic.Bool
+
+	secretsMu   sync.RWMutex
+	secrets     []string
+	fileSecrets []string
+
+	userinfoPattern = regexp.MustCompile(`(://[^:/@\s]*:)[^@\s]+@`)
+	bearerPattern   = regexp.MustCompile(`(?i)\b(bearer\s+)[^\s"]+`)
+)
+
+// sensitiveKeys are what field and attribute names holding secrets contain,
+// compared in lower case with _ and - taken out.
+var sensitiveKeys = []string{"password", "passwd", "saslpass", "serverpass", "apikey", "token", "secret", "authorization"}
+
+func isSensitiveKey(key string) bool {
+	key = strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(key))
+
+	return slices.ContainsFunc(sensitiveKeys, func(sensitive string) bool {
+		return strings.Contains(key, sensitive)
+	})
+}
+
+// collectSecrets walks the config and gathers the values of every string
+// field whose name says it's a secret, so they can be taken out of log lines
+// wherever they show up.
+func collectSecrets(value reflect.Value, name string, found *[]string) {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !value.IsNil() {
+			collectSecrets(value.Elem(), name, found)
+		}
+	case reflect.Struct:
+		for i := range value.NumField() {
+			if field := value.Type().Field(i); field.IsExported() {
+				collectSecrets(value.Field(i), field.Name, found)
+			}
+		}
+	case reflect.Map:
+		iter := value.MapRange()
+		for iter.Next() {
+			key := name
+			if iter.Key().Kind() == reflect.String && iter.Value().Kind() == reflect.String {
+				key = iter.Key().String()
+			}
+
+			collectSecrets(iter.Value(), key, found)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := range value.Len() {
+			collectSecrets(value.Index(i), name, found)
+		}
+	case reflect.String:
+		if isSensitiveKey(name) && len(value.String()) >= minRedactedSecret {
+			*found = append(*found, value.String())
+		}
+	default:
+	}
+}
+
+func setSecrets(config AppConfig) {
+	var found []string
+
+	collectSecrets(reflect.ValueOf(config), "", &found)
+
+	secretsMu.Lock()
+	fileSecrets = found
+	secretsMu.Unlock()
+
+	refreshSecrets()
+}
+
+// refreshSecrets puts the secrets from the config file and the ones the
+// running networks use together. Networks can get new secrets at runtime
+// with /set or the admin api, so this runs on every config update.
+func refreshSecrets() {
+	secretsMu.RLock()
+	found := slices.Clone(fileSecrets)
+	secretsMu.RUnlock()
+
+	for _, network := range getNetworks() {
+		config := reflect.ValueOf(network.Config.current()).Elem()
+
+		for i := range config.NumField() {
+			if field := config.Type().Field(i); field.IsExported() && tomlName(field) != "" {
+				collectSecrets(config.Field(i), field.Name, &found)
+			}
+		}
+	}
+
+	slices.Sort(found)
+	found = slices.Compact(found)
+
+	// longest first, so a secret that contains another is replaced whole.
+	slices.SortStableFunc(found, func(a, b string) int { return len(b) - len(a) })
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	secrets = found
+}
+
+// redactString takes the known secrets, URL passwords and bearer tokens out
+// of a string.
+func redactString(text string) string {
+	secretsMu.RLock()
+	for _, secret := range secrets {
+		text = strings.ReplaceAll(text, secret, redacted)
+	}
+	secretsMu.RUnlock()
+
+	text = userinfoPattern.ReplaceAllString(text, "${1}"+redacted+"@")
+
+	return bearerPattern.ReplaceAllString(text, "${1}"+redacted)
+}
+
+// maskConfigValue is what is shown of a config field. Fields holding a
+// secret are hidden whole, anything else has the known secrets taken out.
+// Values without a secret in them keep their type.
+func maskConfigValue(name string, value any) any {
+	if isSensitiveKey(name) {
+		return redacted
+	}
+
+	if text, ok := value.(string); ok {
+		return redactString(text)
+	}
+
+	if text := fmt.Sprintf("%v", value); redactString(text) != text {
+		return redactString(text)
+	}
+
+	return value
+}
+
+func redactAttr(attr slog.Attr) slog.Attr {
+	attr.Value = attr.Value.Resolve()
+
+	if isSensitiveKey(attr.Key) {
+		return slog.String(attr.Key, redacted)
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, redactString(attr.Value.String()))
+	case slog.KindGroup:
+		group := attr.Value.Group()
+		redactedGroup := make([]slog.Attr, 0, len(group))
+
+		for _, member := range group {
+			redactedGroup = append(redactedGroup, redactAttr(member))
+		}
+
+		return slog.Attr{Key: attr.Key, Value: slog.GroupValue(redactedGroup...)}
+	case slog.KindAny:
+		switch value := attr.Value.Any().(type) {
+		case error:
+			return slog.String(attr.Key, redactString(value.Error()))
+		case fmt.Stringer:
+			return slog.String(attr.Key, redactString(value.String()))
+		}
+	default:
+	}
+
+	return attr
+}
+
+// redactingHandler redacts secrets from every record before passing it on.
+type redactingHandler struct {
+	next slog.Handler
+}
+
+func (handler redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return handler.next.Enabled(ctx, level)
+}
+
+func (handler redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	clean := slog.NewRecord(record.Time, record.Level, redactString(record.Message), record.PC)
+
+	record.Attrs(func(attr slog.Attr) bool {
+		clean.AddAttrs(redactAttr(attr))
+
+		return true
+	})
+
+	return handler.next.Handle(ctx, clean)
+}
+
+func (handler redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clean := make([]slog.Attr, 0, len(attrs))
+
+	for _, attr := range attrs {
+		clean = append(clean, redactAttr(attr))
+	}
+
+	return redactingHandler{next: handler.next.WithAttrs(clean)}
+}
+
+func (handler redactingHandler) WithGroup(name string) slog.Handler {
+	return redactingHandler{next: handler.next.WithGroup(name)}
+}
+
+func newLogHandler(writer io.Writer, format string) (slog.Handler, error) {
+	options := &slog.HandlerOptions{Level: logLevel}
+
+	switch format {
+	case "", "text":
+		return redactingHandler{next: slog.NewTextHandler(writer, options)}, nil
+	case "json":
+		return redactingHandler{next: slog.NewJSONHandler(writer, options)}, nil
+	}
+
+	return nil, fmt.Errorf("%w, not %q", errLogFormat, format)
+}
+
+// setupLogging makes slog, and with it the log package, write through the
+// redacting handler in the configured format and level. It runs at startup
+// and on every reload.
+func setupLogging(config AppConfig) {
+	setSecrets(config)
+
+	if err := logLevel.UnmarshalText([]byte(cmp.Or(config.Logging.Level, "info"))); err != nil {
+		slog.Warn("unknown log level, using info", "level", config.Logging.Level)
+		logLevel.Set(slog.LevelInfo)
+	}
+
+	logContent.Store(config.Logging.Content)
+
+	handler, err := newLogHandler(os.Stderr, config.Logging.Format)
+	if err != nil {
+		slog.Warn(err.Error())
+
+		handler, _ = newLogHandler(os.Stderr, "text")
+	}
+
+	slog.SetDefault(slog.New(handler))
+}
+
+func newRequestID() string {
+	id := make([]byte, requestIDByteCount)
+	_, _ = rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// eventLogger is a logger for handling one message, every line it writes
+// carries the network, channel, nick and a request id.
+func eventLogger(appConfig *TomlConfig, event girc.Event) *slog.Logger {
+	attrs := []any{"network", appConfig.IRCDName, "request_id", newRequestID()}
+
+	if len(event.Params) > 0 {
+		attrs = append(attrs, "channel", event.Params[0])
+	}
+
+	if event.Source != nil {
+		attrs = append(attrs, "nick", event.Source.Name)
+	}
+
+	return slog.With(attrs...)
+}
+
+// logMessageContent logs what people said, prompts, answers and the like.
+// It is only written when content logging is on.
+func logMessageContent(logger *slog.Logger, msg string, args ...any) {
+	if !logContent.Load() {
+		return
+	}
+
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	logger.Info(msg, args...)
+}
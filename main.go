@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"index/suffixarray"
 	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/http"
@@ -24,7 +25,6 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/cenkalti/backoff/v5"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -41,6 +41,7 @@ var (
 	errCantSet           = errors.New("can't set field")
 	errWrongDataForField = errors.New("wrong data type for field")
 	errUnsupportedType   = errors.New("unsupported type")
+	errPermissionDenied  = errors.New("permission denied")
 )
 
 func getTableFromChanName(channel, ircdName string) string {
@@ -112,9 +113,30 @@ func getHelpString() string {
 	helpString += "cmd - run a custom command defined in the customcommands file\n"
 	helpString += "getall - returns all config options with their value\n"
 	helpString += "memstats - returns the memory status currently being used\n"
+	helpString += "ignore - add, remove or list ignored nicks, hostmasks and accounts\n"
+	helpString += "kick [#channel] <nick> [reason] - kicks a user\n"
+	helpString += "ban [#channel] <nick|mask> [duration] - bans a nick's *!*@host or a mask, optionally for a while, e.g. 2h\n"
+	helpString += "unban [#channel] <nick|mask> - lifts a ban\n"
+	helpString += "quiet [#channel] <nick|mask> [duration] - quiets a nick's *!*@host or a mask\n"
+	helpString += "unquiet [#channel] <nick|mask> - lifts a quiet\n"
+	helpString += "op [#channel] [nick] - ops a nick, you by default\n"
+	helpString += "voice [#channel] [nick] - voices a nick, you by default\n"
+	helpString += "topic [#channel] <topic> - sets the topic\n"
+	helpString += "mode [#channel] <modes> [params] - sets channel modes\n"
+	helpString += "reload - reloads the config file\n"
+	helpString += "diff - shows what differs from the config file\n"
+	helpString += "revert <option|#channel|plugin> - drops a runtime change and goes back to the config file\n"
+	helpString += "channels - lists the channels the bot should be in and whether it is\n"
+	helpString += "schedules - lists the scheduled jobs and when they run next\n"
+	helpString += "summarize <url> - summarizes a web page\n"
+	helpString += "links [nick|domain|since] - searches the links posted in the scrape channels\n"
+	helpString += "seen <nick> - tells you when a nick was last seen and what they did\n"
+	helpString += "tell <nick> <message> - gives a nick a message when they next speak or join\n"
+	helpString += "queue - returns the number of messages waiting in the send queue\n"
 	helpString += "load - loads a lua script\n"
 	helpString += "unload - unloads a lua script\n"
-	helpString += "remind - reminds you in a given amount of seconds\n"
+	helpString += "remind [private] <when> [message] - reminds you, e.g. in 10m, 2h30m, tomorrow 09:00 or 2025-12-24 18:00\n"
+	helpString += "remind list|cancel <id>|tz [timezone] - lists or cancels your reminders, shows or sets your timezone\n"
 	helpString += "roll - rolls a dice. the number is between 1 and 6. One arg sets the upper limit. Two args sets the lower and upper limit in that order\n"
 
 	return helpString
@@ -179,10 +201,8 @@ func handleCustomCommand(
 	event girc.Event,
 	appConfig *TomlConfig,
 ) {
-	log.Println(args)
-
 	if len(args) < 2 { //nolint: mnd,gomnd
-		client.Cmd.Reply(event, errNotEnoughArgs.Error())
+		QueueReply(client, event, errNotEnoughArgs.Error())
 
 		return
 	}
@@ -190,22 +210,25 @@ func handleCustomCommand(
 	customCommand := appConfig.CustomCommands[args[1]]
 
 	if customCommand.SQL == "" {
-		client.Cmd.Reply(event, "empty sql commands in the custom command")
+		QueueReply(client, event, "empty sql commands in the custom command")
 
 		return
 	}
 
 	if appConfig.pool == nil {
-		client.Cmd.Reply(event, "no database connection")
+		QueueReply(client, event, "no database connection")
 
 		return
 	}
 
-	log.Println(customCommand.SQL)
+	slog.Debug("custom command", "network", appConfig.IRCDName, "name", args[1], "sql", customCommand.SQL)
+
+	stopTyping := StartTyping(client, event)
+	defer stopTyping()
 
 	rows, err := appConfig.pool.Query(context.Background(), customCommand.SQL)
 	if err != nil {
-		client.Cmd.Reply(event, "error: "+err.Error())
+		QueueReply(client, event, "error: "+err.Error())
 
 		return
 	}
@@ -222,7 +245,7 @@ func handleCustomCommand(
 		logs = logs[:customCommand.Limit]
 	}
 
-	log.Println(logs)
+	logMessageContent(nil, "custom command rows", "network", appConfig.IRCDName, "name", args[1], "rows", logs)
 
 	if err != nil {
 		LogError(err)
@@ -318,67 +341,81 @@ func handleCustomCommand(
 	}
 }
 
-func isFromAdmin(admins []string, event girc.Event) bool {
-	messageFromAdmin := false
+func runCommand(
+	client *girc.Client,
+	event girc.Event,
+	appConfig *TomlConfig,
+) {
+	cmd := expandAlias(appConfig, commandText(client, event, appConfig))
+	args := strings.Split(cmd, " ")
 
-	for _, admin := range admins {
-		if event.Source.Name == admin {
-			messageFromAdmin = true
+	// moderation commands are checked against the channel they act on,
+	// which for a private message is only known from the arguments.
+	if isModerationCommand(args[0]) {
+		channel, _ := moderationChannel(event, args)
+		if channel == "" {
+			QueueReply(client, event, errNoChannel.Error())
 
-			break
+			return
 		}
+
+		if !checkPermissionIn(client, event, appConfig, channel, args) {
+			return
+		}
+	} else if !checkPermission(client, event, appConfig, args) {
+		return
 	}
 
-	return messageFromAdmin
+	dispatchCommand(client, event, appConfig, cmd)
 }
 
-func runCommand(
+// dispatchCommand runs a command line without checking who sent it, callers
+// have to do that.
+func dispatchCommand(
 	client *girc.Client,
 	event girc.Event,
 	appConfig *TomlConfig,
+	cmd string,
 ) {
-	cmd := strings.TrimPrefix(event.Last(), appConfig.IrcNick+": ")
-	cmd = strings.TrimSpace(cmd)
-	cmd = strings.TrimPrefix(cmd, "/")
 	args := strings.Split(cmd, " ")
 
-	if appConfig.AdminOnly && !isFromAdmin(appConfig.Admins, event) {
-		return
-	}
-
 	switch args[0] {
 	case "help":
 		SendToIRC(client, event, getHelpString(), "noop")
 	case "set":
 		if len(args) < 3 { //nolint: mnd,gomnd
-			client.Cmd.Reply(event, errNotEnoughArgs.Error())
+			QueueReply(client, event, errNotEnoughArgs.Error())
 
 			break
 		}
 
-		err := setFieldByName(reflect.ValueOf(appConfig).Elem(), args[1], args[2])
+		err := appConfig.update(func(next *TomlConfig) error {
+			return setFieldByName(reflect.ValueOf(next).Elem(), args[1], args[2])
+		})
 		if err != nil {
-			client.Cmd.Reply(event, err.Error())
+			QueueReply(client, event, err.Error())
+
+			break
 		}
+
+		keepOverride(client, event, appConfig, Override{Kind: OverrideSet, Name: args[1], Value: args[2]})
 	case "get":
 		if len(args) < 2 { //nolint: mnd,gomnd
-			client.Cmd.Reply(event, errNotEnoughArgs.Error())
+			QueueReply(client, event, errNotEnoughArgs.Error())
 
 			break
 		}
 
-		log.Println(args[1])
-
 		v := reflect.ValueOf(*appConfig)
 		field := v.FieldByName(args[1])
 
 		if !field.IsValid() {
-			client.Cmd.Reply(event, errUnknConfig.Error())
+			QueueReply(client, event, errUnknConfig.Error())
 
 			break
 		}
 
-		client.Cmd.Reply(event, fmt.Sprintf("%v", field.Interface()))
+		QueueReply(client, event, fmt.Sprintf("%v", maskConfigValue(args[1], field.Interface())))
 	case "getall":
 		value := reflect.ValueOf(*appConfig)
 		t := value.Type()
@@ -392,119 +429,160 @@ func runCommand(
 				continue
 			}
 
-			client.Cmd.Reply(event, fmt.Sprintf("%s: %v", field.Name, fieldValueString))
+			QueueReply(client, event, fmt.Sprintf("%s: %v", field.Name, maskConfigValue(field.Name, fieldValueString)))
 		}
 	case "memstats":
 		var memStats runtime.MemStats
 
 		runtime.ReadMemStats(&memStats)
 
-		client.Cmd.Reply(event, fmt.Sprintf("Alloc: %d MiB", byteToMByte(memStats.Alloc)))
-		client.Cmd.Reply(event, fmt.Sprintf("TotalAlloc: %d MiB", byteToMByte(memStats.TotalAlloc)))
-		client.Cmd.Reply(event, fmt.Sprintf("Sys: %d MiB", byteToMByte(memStats.Sys)))
-	case "join":
-		if !isFromAdmin(appConfig.Admins, event) {
+		QueueReply(client, event, fmt.Sprintf("Alloc: %d MiB", byteToMByte(memStats.Alloc)))
+		QueueReply(client, event, fmt.Sprintf("TotalAlloc: %d MiB", byteToMByte(memStats.TotalAlloc)))
+		QueueReply(client, event, fmt.Sprintf("Sys: %d MiB", byteToMByte(memStats.Sys)))
+	case "ignore":
+		handleIgnoreCommand(args, client, event, appConfig)
+	case "kick", "ban", "unban", "quiet", "unquiet", "op", "voice", "topic", "mode":
+		handleModerationCommand(args, client, event, appConfig)
+	case "reload":
+		changes, err := ReloadConfig()
+		if err != nil {
+			QueueReply(client, event, err.Error())
+
 			break
 		}
 
-		if len(args) < 2 { //nolint: mnd,gomnd
-			client.Cmd.Reply(event, errNotEnoughArgs.Error())
-
-			break
+		for _, change := range changes {
+			QueueReply(client, event, change)
 		}
-		if len(args) == 3 {
-			IrcJoin(client, []string{args[1], args[2]})
-		} else {
-			client.Cmd.Join(args[1])
+	case "channels":
+		for _, line := range channelsStatus(client) {
+			QueueReply(client, event, line)
 		}
-	case "leave":
-		if !isFromAdmin(appConfig.Admins, event) {
+	case "summarize":
+		handleSummarizeCommand(args, client, event, appConfig)
+	case "links":
+		handleLinksCommand(args, client, event, appConfig)
+	case "seen":
+		handleSeenCommand(args, client, event, appConfig)
+	case "tell":
+		handleTellCommand(args, client, event, appConfig)
+	case "schedules":
+		for _, line := range schedulesStatus(appConfig) {
+			QueueReply(client, event, line)
+		}
+	case "queue":
+		queue := getSendQueue(client)
+		if queue == nil {
+			QueueReply(client, event, "send queue is disabled")
+
 			break
 		}
 
+		depths := queue.Depths()
+
+		for priority, depth := range depths {
+			QueueReply(client, event, fmt.Sprintf("%s: %d", priorityNames[priority], depth))
+		}
+	case "join":
 		if len(args) < 2 { //nolint: mnd,gomnd
-			client.Cmd.Reply(event, errNotEnoughArgs.Error())
+			QueueReply(client, event, errNotEnoughArgs.Error())
 
 			break
 		}
+		IrcJoin(client, args[1:])
 
-		client.Cmd.Part(args[1])
-	case "cmd":
-		if !isFromAdmin(appConfig.Admins, event) {
-			break
+		key := ""
+		if len(args) > 2 { //nolint: mnd,gomnd
+			key = args[2]
 		}
 
-		handleCustomCommand(args, client, event, appConfig)
-	case "load":
-		if !isFromAdmin(appConfig.Admins, event) {
+		keepOverride(client, event, appConfig, Override{Kind: OverrideJoin, Name: args[1], Value: key})
+	case "leave":
+		if len(args) < 2 { //nolint: mnd,gomnd
+			QueueReply(client, event, errNotEnoughArgs.Error())
+
 			break
 		}
 
+		IrcPart(client, args[1])
+
+		keepOverride(client, event, appConfig, Override{Kind: OverrideLeave, Name: args[1]})
+	case "cmd":
+		handleCustomCommand(args, client, event, appConfig)
+	case "load":
 		if len(args) < 2 { //nolint: mnd,gomnd
-			client.Cmd.Reply(event, errNotEnoughArgs.Error())
+			QueueReply(client, event, errNotEnoughArgs.Error())
 
 			break
 		}
 
 		RunScript(args[1], client, appConfig)
-	case "unload":
-		if !isFromAdmin(appConfig.Admins, event) {
-			break
-		}
 
+		keepOverride(client, event, appConfig, Override{Kind: OverrideLoad, Name: args[1]})
+	case "unload":
 		if len(args) < 2 { //nolint: mnd,gomnd
-			client.Cmd.Reply(event, errNotEnoughArgs.Error())
+			QueueReply(client, event, errNotEnoughArgs.Error())
 
 			break
 		}
 
-		for key, value := range appConfig.LuaCommands {
-			if value.Path == args[1] {
-				appConfig.deleteLuaCommand(key)
+		unloadPlugin(appConfig, args[1])
 
-				break
-			}
+		keepOverride(client, event, appConfig, Override{Kind: OverrideUnload, Name: args[1]})
+	case "diff":
+		lines, err := diffConfig(appConfig)
+		if err != nil {
+			QueueReply(client, event, err.Error())
+
+			break
 		}
 
-		appConfig.deleteLstate(args[1])
-	case "list":
-		if !isFromAdmin(appConfig.Admins, event) {
+		if len(lines) == 0 {
+			QueueReply(client, event, "the running config matches "+configFile)
+
 			break
 		}
 
-		for key, value := range appConfig.LuaCommands {
-			client.Cmd.Reply(event, fmt.Sprintf("%s: %s", key, value.Path))
+		// the diff can show config values, so it is only sent in private.
+		for _, line := range lines {
+			QueueMessage(client, PriorityInteractive, event.Source.Name, line)
 		}
-	case "remind":
+	case "revert":
 		if len(args) < 2 { //nolint: mnd,gomnd
-			client.Cmd.Message(event.Source.Name, errNotEnoughArgs.Error())
+			QueueReply(client, event, errNotEnoughArgs.Error())
 
 			break
 		}
 
-		seconds, err := strconv.Atoi(args[1])
+		changes, err := revertOverride(client, appConfig, args[1])
 		if err != nil {
-			client.Cmd.Reply(event, errNotEnoughArgs.Error())
-			client.Cmd.Message(event.Source.Name, errNotEnoughArgs.Error())
+			QueueReply(client, event, err.Error())
 
 			break
 		}
 
-		client.Cmd.Message(event.Source.Name, "Ok, I'll remind you in "+args[1]+" seconds.")
-		time.Sleep(time.Duration(seconds) * time.Second)
+		QueueReply(client, event, "reverted "+args[1])
 
-		client.Cmd.Message(event.Source.Name, "Ping!")
+		for _, change := range changes {
+			QueueReply(client, event, change)
+		}
+	case "list":
+		for key, value := range appConfig.LuaCommands {
+			QueueReply(client, event, fmt.Sprintf("%s: %s", key, value.Path))
+		}
+	case "remind":
+		handleRemindCommand(args, client, event, appConfig)
 	case "forget":
-		client.Cmd.Reply(event, "I no longer even know whether you're supposed to wear or drink a camel.'")
+		QueueReply(client, event, "I no longer even know whether you're supposed to wear or drink a camel.'")
 	case "whois":
 		if len(args) < 2 { //nolint: mnd,gomnd
-			client.Cmd.Reply(event, errNotEnoughArgs.Error())
+			QueueReply(client, event, errNotEnoughArgs.Error())
 
 			break
 		}
 
 		ianaResponse := IANAWhoisGet(args[1], appConfig)
-		client.Cmd.Reply(event, ianaResponse)
+		QueueReply(client, event, ianaResponse)
 	case "roll":
 		lowerLimit := 1
 		upperLimit := 6
@@ -513,7 +591,7 @@ func runCommand(
 		} else if len(args) == 2 { //nolint: mnd,gomnd
 			argOne, err := strconv.Atoi(args[1])
 			if err != nil {
-				client.Cmd.Reply(event, errNotEnoughArgs.Error())
+				QueueReply(client, event, errNotEnoughArgs.Error())
 
 				break
 			}
@@ -522,7 +600,7 @@ func runCommand(
 		} else if len(args) == 3 { //nolint: mnd,gomnd
 			argOne, err := strconv.Atoi(args[1])
 			if err != nil {
-				client.Cmd.Reply(event, errNotEnoughArgs.Error())
+				QueueReply(client, event, errNotEnoughArgs.Error())
 
 				break
 			}
@@ -531,28 +609,24 @@ func runCommand(
 
 			argTwo, err := strconv.Atoi(args[2])
 			if err != nil {
-				client.Cmd.Reply(event, errNotEnoughArgs.Error())
+				QueueReply(client, event, errNotEnoughArgs.Error())
 
 				break
 			}
 
 			upperLimit = argTwo
 		} else {
-			client.Cmd.Reply(event, errors.New("too many args").Error())
+			QueueReply(client, event, errors.New("too many args").Error())
 
 			break
 		}
 
 		randomNumber := lowerLimit + rand.Intn(upperLimit-lowerLimit+1)
 
-		client.Cmd.ReplyTo(event, fmt.Sprint(randomNumber))
+		QueueReplyTo(client, event, fmt.Sprint(randomNumber))
 	case "ua":
-		if !isFromAdmin(appConfig.Admins, event) {
-			break
-		}
-
 		if len(args) < 2 { //nolint: mnd,gomnd
-			client.Cmd.Reply(event, errNotEnoughArgs.Error())
+			QueueReply(client, event, errNotEnoughArgs.Error())
 
 			break
 		}
@@ -563,8 +637,11 @@ func runCommand(
 			query = strings.TrimPrefix(cmd, args[0])
 		}
 
-		log.Println("query:", query)
+		logMessageContent(nil, "user agent query", "network", appConfig.IRCDName, "action", args[1], "query", query)
+
+		stopTyping := StartTyping(client, event)
 		response := UserAgentsGet(args[1], query, appConfig)
+		stopTyping()
 
 		// client.Cmd.Reply(event, response)
 		SendToIRC(client, event, response, appConfig.ChromaFormatter)
@@ -572,29 +649,16 @@ func runCommand(
 	default:
 		_, ok := appConfig.LuaCommands[args[0]]
 		if ok {
-			luaArgs := strings.TrimPrefix(event.Last(), appConfig.IrcNick+": ")
-			luaArgs = strings.TrimSpace(luaArgs)
-			luaArgs = strings.TrimPrefix(luaArgs, "/")
-			luaArgs = strings.TrimPrefix(luaArgs, args[0])
+			luaArgs := strings.TrimPrefix(cmd, args[0])
 			luaArgs = strings.TrimSpace(luaArgs)
 
 			result := RunLuaFunc(args[0], luaArgs, client, appConfig)
-			client.Cmd.Reply(event, result)
-
-			break
-		}
-
-		_, ok = appConfig.Aliases[args[0]]
-		if ok {
-			dummyEvent := event
-			dummyEvent.Params[len(dummyEvent.Params)-1] = appConfig.Aliases[args[0]].Alias
-
-			runCommand(client, dummyEvent, appConfig)
+			QueueReply(client, event, result)
 
 			break
 		}
 
-		client.Cmd.Reply(event, errUnknCmd.Error())
+		QueueReply(client, event, errUnknCmd.Error())
 	}
 }
 
@@ -608,7 +672,8 @@ func connectToDB(appConfig *TomlConfig, ctx *context.Context, irc *girc.Client)
 		appConfig.DatabaseAddress,
 		appConfig.DatabaseName)
 
-	log.Println("dbURL:", dbURL)
+	slog.Info("connecting to the database", "network", appConfig.IRCDName,
+		"address", appConfig.DatabaseAddress, "database", appConfig.DatabaseName, "user", appConfig.DatabaseUser)
 
 	poolConfig, err := pgxpool.ParseConfig(dbURL)
 	if err != nil {
@@ -654,13 +719,45 @@ func connectToDB(appConfig *TomlConfig, ctx *context.Context, irc *girc.Client)
 		}
 	}
 
-	appConfig.pool = pool
+	_ = appConfig.update(func(next *TomlConfig) error {
+		next.pool = pool
+
+		return nil
+	})
+
+	appConfig = appConfig.current()
+
+	loadIgnores(appConfig)
+
+	loadTimedBans(appConfig)
+
+	loadReminders(appConfig)
+
+	loadScheduleRuns(appConfig)
+
+	loadTells(appConfig)
+
+	if err := createLinksTable(appConfig); err != nil {
+		LogError(err)
+	}
+
+	if err := createAdminAuditTable(appConfig); err != nil {
+		LogError(err)
+	}
+
+	if err := createPermissionAuditTable(appConfig); err != nil {
+		LogError(err)
+	}
+
+	restoreOverrides(irc, appConfig)
 }
 
 func scrapeChannel(irc *girc.Client, appConfig *TomlConfig) {
 	log.Print("spawning scraper")
 
 	irc.Handlers.AddBg(girc.PRIVMSG, func(_ *girc.Client, event girc.Event) {
+		appConfig := appConfig.current()
+
 		if appConfig.pool == nil {
 			log.Println("no db connection. cant write scrapes to db.")
 
@@ -676,13 +773,19 @@ func scrapeChannel(irc *girc.Client, appConfig *TomlConfig) {
 			event.Source.Name,
 		)
 
-		log.Println(query)
+		logMessageContent(nil, "scrape", "network", appConfig.IRCDName, "sql", query)
 
 		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
 		defer cancel()
 
+		start := time.Now()
+
 		_, err := appConfig.pool.Exec(ctx, query)
+
+		dbInsertDuration.ObserveSince(start, appConfig.IRCDName)
+
 		if err != nil {
+			dbInsertFailures.Inc(appConfig.IRCDName)
 			LogError(err)
 		}
 	})
@@ -708,16 +811,18 @@ func populateWatchListWords(appConfig *TomlConfig) {
 	}
 }
 
-func WatchListHandler(irc *girc.Client, appConfig TomlConfig) {
+func WatchListHandler(irc *girc.Client, appConfig *TomlConfig) {
 	irc.Handlers.AddBg(girc.ALL_EVENTS, func(_ *girc.Client, event girc.Event) {
-		var isRightEventType bool
+		appConfig := appConfig.current()
 
-		sarray := suffixarray.New([]byte(event.Last()))
+		var isRightEventType bool
 
-		if len(event.Params) == 0 {
+		if len(event.Params) == 0 || len(appConfig.WatchLists) == 0 {
 			return
 		}
 
+		sarray := suffixarray.New([]byte(event.Last()))
+
 		for watchname, watchlist := range appConfig.WatchLists {
 			for _, channel := range watchlist.WatchList {
 				isRightEventType = false
@@ -748,11 +853,32 @@ func WatchListHandler(irc *girc.Client, appConfig TomlConfig) {
 									event.Last()[indexes[0]+1:indexes[0]+1+nextWhitespaceIndex] +
 									"\x1b[0m" + event.Last()[indexes[0]+1+nextWhitespaceIndex:]
 
-							irc.Cmd.Message(
+							QueueMessage(
+								irc,
+								PriorityAlert,
 								watchlist.AlertChannel[0],
 								fmt.Sprintf("%s: %s", watchname, rewrittenMessage))
 
-							log.Printf("matched from watchlist -- %s: %s", watchname, event.Last())
+							slog.Info("watchlist matched", "network", appConfig.IRCDName,
+								"channel", event.Params[0], "watchlist", watchname)
+							logMessageContent(nil, "watchlist match", "watchlist", watchname, "message", event.Last())
+
+							watchlistHits.Inc(appConfig.IRCDName, watchname)
+
+							nick := ""
+							if event.Source != nil {
+								nick = event.Source.Name
+							}
+
+							emitEvent(BotEvent{
+								Type:      EventWatchlist,
+								Network:   appConfig.IRCDName,
+								Channel:   event.Params[0],
+								Nick:      nick,
+								Message:   event.Last(),
+								Watchlist: watchname,
+								Word:      word,
+							})
 
 							break
 						}
@@ -764,6 +890,8 @@ func WatchListHandler(irc *girc.Client, appConfig TomlConfig) {
 }
 
 func runIRC(appConfig TomlConfig) {
+	setupOverrides(&appConfig)
+
 	var OllamaMemory []MemoryElement
 
 	var GeminiMemory []*genai.Content
@@ -784,12 +912,17 @@ func runIRC(appConfig TomlConfig) {
 		AllowFlood:         appConfig.AllowFlood,
 		DisableSTSFallback: appConfig.DisableSTSFallback,
 		GlobalFormat:       true,
+		SupportedCaps:      ircv3SupportedCaps(),
 		TLSConfig: &tls.Config{
 			InsecureSkipVerify: appConfig.SkipTLSVerify,
 			ServerName:         appConfig.IrcServer,
 		},
 	})
 
+	// everything the network starts stops with runCtx.
+	runCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+
 	if appConfig.WebIRCGateway != "" {
 		irc.Config.WebIRC.Address = appConfig.WebIRCAddress
 		irc.Config.WebIRC.Gateway = appConfig.WebIRCGateway
@@ -797,10 +930,50 @@ func runIRC(appConfig TomlConfig) {
 		irc.Config.WebIRC.Password = appConfig.WebIRCPassword
 	}
 
+	trackMultilineLimits(runCtx, irc)
+
+	registerCTCPHandlers(irc)
+
+	appConfig.queryLimiter = newRateLimiter(appConfig.PrivateRateLimit, appConfig.PrivateRateBurst)
+
+	trackAccounts(runCtx, irc)
+
+	manageChannels(runCtx, irc, &appConfig)
+
+	setupModeration(runCtx, irc, &appConfig)
+
+	setupReminders(runCtx, irc, &appConfig)
+
+	setupSchedules(runCtx, irc, &appConfig)
+
+	trackSeen(irc, &appConfig)
+
+	URLTitleHandler(irc, &appConfig)
+
+	LinkHistoryHandler(irc, &appConfig)
+
+	setupRelays(irc, &appConfig)
+
+	setupEvents(irc, &appConfig)
+
+	setupMetrics(irc, &appConfig)
+
+	warnAboutNickAdmins(&appConfig)
+
+	setupIgnores(runCtx, irc, &appConfig)
+
 	if appConfig.Debug {
 		irc.Config.Debug = os.Stdout
 	}
 
+	// with flood control on, milla's own send queue does the rate limiting
+	// so girc should not delay the queue worker on top of that.
+	if !appConfig.AllowFlood {
+		irc.Config.AllowFlood = true
+
+		go runSendQueue(runCtx, irc, &appConfig)
+	}
+
 	if appConfig.Out {
 		irc.Config.Out = os.Stdout
 	}
@@ -815,26 +988,16 @@ func runIRC(appConfig TomlConfig) {
 		irc.Config.Name = appConfig.Name
 	}
 
-	if appConfig.EnableSasl && appConfig.IrcSaslPass != "" && appConfig.IrcSaslUser != "" {
-		irc.Config.SASL = &girc.SASLPlain{
-			User: appConfig.IrcSaslUser,
-			Pass: appConfig.IrcSaslPass,
-		}
-	}
-
-	if appConfig.EnableSasl && appConfig.ClientCertPath != "" {
-		cert, err := tls.LoadX509KeyPair(appConfig.ClientCertPath, appConfig.ClientCertPath)
-		if err != nil {
-			log.Println("invalid client certificate.")
+	if err := setupAuth(irc, &appConfig); err != nil {
+		slog.Error("authentication setup", "network", appConfig.IRCDName, "error", err)
 
-			return
-		}
-
-		irc.Config.TLSConfig.Certificates = []tls.Certificate{cert}
+		return
 	}
 
 	irc.Handlers.AddBg(girc.CONNECTED, func(_ *girc.Client, _ girc.Event) {
-		for _, channel := range appConfig.IrcChannels {
+		appConfig := appConfig.current()
+
+		for _, channel := range configChannels(appConfig) {
 			IrcJoin(irc, channel)
 		}
 	})
@@ -875,6 +1038,29 @@ func runIRC(appConfig TomlConfig) {
 		ORHandler(irc, &appConfig, &ORMemory)
 	}
 
+	populateWatchListWords(&appConfig)
+
+	// from here on the config is only changed through update.
+	appConfig.publish()
+
+	network := &Network{Name: appConfig.IRCDName, Client: irc, Config: &appConfig, ctx: runCtx, stop: stop}
+	registerNetwork(network)
+
+	// overrides from overridesFile can have set secrets.
+	refreshSecrets()
+
+	defer unregisterNetwork(network)
+
+	// the handlers and goroutines stop with runCtx, what is left is the
+	// plugins and the database pool.
+	defer func() {
+		unloadPlugins(&appConfig)
+
+		if pool := appConfig.current().pool; pool != nil {
+			pool.Close()
+		}
+	}()
+
 	go LoadAllPlugins(&appConfig, irc)
 
 	go LoadAllEventPlugins(&appConfig, irc)
@@ -887,41 +1073,15 @@ func runIRC(appConfig TomlConfig) {
 	}
 
 	if len(appConfig.ScrapeChannels) > 0 {
-		irc.Handlers.AddBg(girc.CONNECTED, func(_ *girc.Client, _ girc.Event) {
-			for _, channel := range appConfig.ScrapeChannels {
-				IrcJoin(irc, channel)
-			}
-		})
-
 		go scrapeChannel(irc, &appConfig)
 	}
 
-	if len(appConfig.WatchLists) > 0 {
-		irc.Handlers.AddBg(girc.CONNECTED, func(_ *girc.Client, _ girc.Event) {
-			for _, watchlist := range appConfig.WatchLists {
-				log.Print("joining ", watchlist.AlertChannel)
-				IrcJoin(irc, watchlist.AlertChannel)
-
-				for _, channel := range watchlist.WatchList {
-					IrcJoin(irc, channel)
-				}
-			}
-		})
-
-		populateWatchListWords(&appConfig)
-
-		go WatchListHandler(irc, appConfig)
-	}
+	// the watchlist handler is always there so watchlists can be added by
+	// reloading the config.
+	go WatchListHandler(irc, &appConfig)
 
 	if len(appConfig.Rss) > 0 {
-		irc.Handlers.AddBg(girc.CONNECTED, func(client *girc.Client, _ girc.Event) {
-			for _, rss := range appConfig.Rss {
-				log.Print("RSS: joining ", rss.Channel)
-				IrcJoin(irc, rss.Channel)
-			}
-		})
-
-		go runRSS(&appConfig, irc)
+		go runRSS(runCtx, &appConfig, irc)
 	}
 
 	var dialer proxy.Dialer
@@ -939,6 +1099,10 @@ func runIRC(appConfig TomlConfig) {
 	}
 
 	connectToIRC := func() (string, error) {
+		if runCtx.Err() != nil {
+			return "", backoff.Permanent(runCtx.Err())
+		}
+
 		return "", irc.DialerConnect(dialer)
 	}
 
@@ -946,6 +1110,10 @@ func runIRC(appConfig TomlConfig) {
 	defer cancel()
 
 	for {
+		if runCtx.Err() != nil {
+			return
+		}
+
 		expBackoff := backoff.WithBackOff(&backoff.ExponentialBackOff{
 			InitialInterval:     time.Millisecond * time.Duration(appConfig.IrcBackOffInitialInterval),
 			RandomizationFactor: appConfig.IrcBackOffRandomizationFactor,
@@ -968,56 +1136,70 @@ func goroutines() interface{} {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:]))
+	}
+
 	expvar.Publish("Goroutines", expvar.Func(goroutines))
 
 	quitChannel := make(chan os.Signal, 1)
 	signal.Notify(quitChannel, syscall.SIGINT, syscall.SIGTERM)
 
+	reloadChannel := make(chan os.Signal, 1)
+	signal.Notify(reloadChannel, syscall.SIGHUP)
+
 	configPath := flag.String("config", "./config.toml", "path to the config file")
 	prof := flag.Bool("prof", false, "enable prof server")
 
 	flag.Parse()
 
-	data, err := os.ReadFile(*configPath)
-	if err != nil {
-		LogErrorFatal(err)
-	}
-
-	var config AppConfig
+	configFile = *configPath
 
-	_, err = toml.Decode(string(data), &config)
+	config, err := loadConfig(configFile)
 	if err != nil {
 		LogErrorFatal(err)
 	}
 
-	for key, value := range config.Ircd {
-		AddSaneDefaults(&value)
-		value.IRCDName = key
-		config.Ircd[key] = value
-	}
+	setupLogging(config)
 
-	for k, v := range config.Ircd {
-		log.Println(k, v)
+	for name, network := range config.Ircd {
+		slog.Info("network", "name", name, "server", network.IrcServer, "port", network.IrcPort, "nick", network.IrcNick)
 	}
 
+	setRelays(config.Relays)
+	setSinks(config.Sinks)
+
 	for _, v := range config.Ircd {
-		if v.IrcServer != "" {
-			go runIRC(v)
-		} else {
-			log.Println("Could not find server for irc connection in the config file. skipping. check your config for spelling errors maybe.")
-		}
+		startNetwork(v)
 	}
 
 	for k, v := range config.Ghost {
 		go RunGhost(v, k)
 	}
 
+	setWebhooks(config.Webhooks)
+	setAdminAPI(config.Admin)
+	setMetricsListen(config.Metrics.Listen)
+
 	if *prof {
+		http.Handle("/metrics", metricsHandler())
+
 		go func() {
 			err := http.ListenAndServe(":6060", nil)
 			log.Println(err)
 		}()
 	}
 
-	<-quitChannel
+	for {
+		select {
+		case <-quitChannel:
+			return
+		case <-reloadChannel:
+			slog.Info("got SIGHUP, reloading the config")
+
+			if _, err := ReloadConfig(); err != nil {
+				LogError(err)
+			}
+		}
+	}
 }
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+// The metrics are written in the Prometheus text format by hand, which is
+// all /metrics needs and saves pulling in the client library.
+
+// latencyBuckets are the histogram buckets for durations, in seconds.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120} //nolint: mnd,gomnd
+
+type collector interface {
+	write(writer io.Writer)
+}
+
+type metricDesc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (desc metricDesc) header(writer io.Writer, kind string) {
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", desc.name, desc.help, desc.name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelPairs formats label values as {a="1",b="2"}, with extra appended as
+// is for the le label of histogram buckets.
+func (desc metricDesc) labelPairs(values []string, extra string) string {
+	pairs := make([]string, 0, len(values)+1)
+
+	for i, value := range values {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, desc.labels[i], labelEscaper.Replace(value)))
+	}
+
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// valueVec holds counters or gauges, one per set of label values.
+type valueVec struct {
+	metricDesc
+	kind   string
+	mu     sync.Mutex
+	values map[string]float64
+	labels map[string][]string
+}
+
+func newValueVec(kind, name, help string, labels ...string) *valueVec {
+	vec := &valueVec{
+		metricDesc: metricDesc{name: name, help: help, labels: labels},
+		kind:       kind,
+		values:     make(map[string]float64),
+		labels:     make(map[string][]string),
+	}
+
+	registerMetric(vec)
+
+	return vec
+}
+
+func newCounter(name, help string, labels ...string) *valueVec {
+	return newValueVec("counter", name, help, labels...)
+}
+
+func newGauge(name, help string, labels ...string) *valueVec {
+	return newValueVec("gauge", name, help, labels...)
+}
+
+func (vec *valueVec) Add(delta float64, values ...string) {
+	key := seriesKey(values)
+
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+
+	vec.values[key] += delta
+	vec.labels[key] = values
+}
+
+func (vec *valueVec) Inc(values ...string) {
+	vec.Add(1, values...)
+}
+
+func (vec *valueVec) Set(value float64, values ...string) {
+	key := seriesKey(values)
+
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+
+	vec.values[key] = value
+	vec.labels[key] = values
+}
+
+func (vec *valueVec) write(writer io.Writer) {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+
+	vec.header(writer, vec.kind)
+
+	keys := make([]string, 0, len(vec.values))
+	for key := range vec.values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(writer, "%s%s %s\n", vec.name, vec.labelPairs(vec.labels[key], ""), formatFloat(vec.values[key]))
+	}
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	metricDesc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	vec := &histogramVec{
+		metricDesc: metricDesc{name: name, help: help, labels: labels},
+		buckets:    buckets,
+		series:     make(map[string]*histogramSeries),
+	}
+
+	registerMetric(vec)
+
+	return vec
+}
+
+func (vec *histogramVec) Observe(value float64, values ...string) {
+	key := seriesKey(values)
+
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+
+	series, ok := vec.series[key]
+	if !ok {
+		series = &histogramSeries{labels: values, counts: make([]uint64, len(vec.buckets))}
+		vec.series[key] = series
+	}
+
+	for i, bucket := range vec.buckets {
+		if value <= bucket {
+			series.counts[i]++
+		}
+	}
+
+	series.sum += value
+	series.count++
+}
+
+func (vec *histogramVec) ObserveSince(start time.Time, values ...string) {
+	vec.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (vec *histogramVec) write(writer io.Writer) {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+
+	vec.header(writer, "histogram")
+
+	keys := make([]string, 0, len(vec.series))
+	for key := range vec.series {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := vec.series[key]
+
+		for i, bucket := range vec.buckets {
+			fmt.Fprintf(writer, "%s_bucket%s %d\n",
+				vec.name, vec.labelPairs(series.labels, `le="`+formatFloat(bucket)+`"`), series.counts[i])
+		}
+
+		fmt.Fprintf(writer, "%s_bucket%s %d\n", vec.name, vec.labelPairs(series.labels, `le="+Inf"`), series.count)
+		fmt.Fprintf(writer, "%s_sum%s %s\n", vec.name, vec.labelPairs(series.labels, ""), formatFloat(series.sum))
+		fmt.Fprintf(writer, "%s_count%s %d\n", vec.name, vec.labelPairs(series.labels, ""), series.count)
+	}
+}
+
+// gaugeFunc is a gauge read when /metrics is scraped.
+type gaugeFunc struct {
+	metricDesc
+	value func() float64
+}
+
+func (gauge gaugeFunc) write(writer io.Writer) {
+	gauge.header(writer, "gauge")
+	fmt.Fprintf(writer, "%s %s\n", gauge.name, formatFloat(gauge.value()))
+}
+
+var (
+	metricsMu  sync.Mutex
+	collectors []collector
+)
+
+func registerMetric(metric collector) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	collectors = append(collectors, metric)
+}
+
+var (
+	ircConnected = newGauge("milla_irc_connected",
+		"Whether the bot is connected to the network.", "network")
+	ircConnects = newCounter("milla_irc_connects_total",
+		"Connections made to the network, more than one means it reconnected.", "network")
+	ircDisconnects = newCounter("milla_irc_disconnects_total",
+		"Connections to the network that were lost or closed.", "network")
+	messagesReceived = newCounter("milla_irc_messages_received_total",
+		"PRIVMSGs and NOTICEs received.", "network")
+	messagesSent = newCounter("milla_irc_messages_sent_total",
+		"PRIVMSGs and NOTICEs sent.", "network")
+
+	llmRequests = newCounter("milla_llm_requests_total",
+		"Requests made to LLM providers.", "provider", "model")
+	llmErrors = newCounter("milla_llm_errors_total",
+		"Requests to LLM providers that failed.", "provider", "model")
+	llmDuration = newHistogram("milla_llm_request_duration_seconds",
+		"How long requests to LLM providers took.", latencyBuckets, "provider", "model")
+	llmTokens = newCounter("milla_llm_tokens_total",
+		"Tokens used, as reported by the provider.", "provider", "model", "type")
+
+	dbInsertDuration = newHistogram("milla_db_insert_duration_seconds",
+		"How long inserting a scraped message took.", latencyBuckets, "network")
+	dbInsertFailures = newCounter("milla_db_insert_failures_total",
+		"Scraped messages that could not be inserted.", "network")
+
+	rssFetches = newCounter("milla_rss_fetches_total",
+		"RSS feed fetches, by feed and result.", "group", "feed", "result")
+
+	watchlistHits = newCounter("milla_watchlist_hits_total",
+		"Messages that matched a watchlist.", "network", "watchlist")
+
+	luaRuns = newCounter("milla_lua_runs_total",
+		"Lua plugins and commands run.", "kind")
+	luaFailures = newCounter("milla_lua_failures_total",
+		"Lua plugins and commands that failed.", "kind")
+
+	ghostConnections = newGauge("milla_ghost_connections",
+		"Clients connected to the ghost relay.", "ghost")
+	ghostConnectionsTotal = newCounter("milla_ghost_connections_total",
+		"Clients that connected to the ghost relay.", "ghost")
+
+	_ = newGoroutinesGauge()
+)
+
+func newGoroutinesGauge() collector {
+	gauge := gaugeFunc{
+		metricDesc: metricDesc{name: "milla_goroutines", help: "The number of goroutines."},
+		value:      func() float64 { return float64(runtime.NumGoroutine()) },
+	}
+
+	registerMetric(gauge)
+
+	return gauge
+}
+
+// observeLLMRequest records a request to an LLM provider, it is deferred at
+// the start of the request functions.
+func observeLLMRequest(provider, model string, start time.Time, err error) {
+	llmRequests.Inc(provider, model)
+	llmDuration.ObserveSince(start, provider, model)
+
+	if err != nil {
+		llmErrors.Inc(provider, model)
+	}
+}
+
+func countLLMTokens(provider, model string, prompt, completion int) {
+	llmTokens.Add(float64(prompt), provider, model, "prompt")
+	llmTokens.Add(float64(completion), provider, model, "completion")
+}
+
+// networkName finds the name of the network a client belongs to.
+func networkName(client *girc.Client) string {
+	for _, network := range getNetworks() {
+		if network.Client == client {
+			return network.Name
+		}
+	}
+
+	return ""
+}
+
+func countSent(client *girc.Client, event *girc.Event) {
+	if event.Command == girc.PRIVMSG || event.Command == girc.NOTICE {
+		messagesSent.Inc(networkName(client))
+	}
+}
+
+// setupMetrics tracks a network's connection state and incoming messages.
+func setupMetrics(irc *girc.Client, appConfig *TomlConfig) {
+	name := appConfig.IRCDName
+
+	ircConnected.Set(0, name)
+
+	irc.Handlers.AddBg(girc.CONNECTED, func(_ *girc.Client, _ girc.Event) {
+		ircConnected.Set(1, name)
+		ircConnects.Inc(name)
+	})
+
+	irc.Handlers.AddBg(girc.DISCONNECTED, func(_ *girc.Client, _ girc.Event) {
+		ircConnected.Set(0, name)
+		ircDisconnects.Inc(name)
+	})
+
+	irc.Handlers.AddBg(girc.PRIVMSG, func(_ *girc.Client, _ girc.Event) {
+		messagesReceived.Inc(name)
+	})
+
+	irc.Handlers.AddBg(girc.NOTICE, func(_ *girc.Client, _ girc.Event) {
+		messagesReceived.Inc(name)
+	})
+}
+
+func writeMetrics(writer io.Writer) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	for _, metric := range collectors {
+		metric.write(writer)
+	}
+}
+
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(writer)
+	})
+}
+
+var (
+	metricsServerMu sync.Mutex
+	runningMetrics  *httpListener
+)
+
+// setMetricsListen starts serving /metrics on listen, moving it if it was
+// already listening somewhere else.
+func setMetricsListen(listen string) {
+	metricsServerMu.Lock()
+	defer metricsServerMu.Unlock()
+
+	if runningMetrics != nil && runningMetrics.listen == listen {
+		return
+	}
+
+	if runningMetrics != nil {
+		runningMetrics.shutdown()
+
+		runningMetrics = nil
+	}
+
+	if listen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metricsHandler())
+
+	listener, err := serveHTTP("metrics", listen, mux)
+	if err != nil {
+		slog.Error("metrics", "error", err)
+
+		return
+	}
+
+	runningMetrics = listener
+}
+
+func metricsListenDiffers(listen string) bool {
+	metricsServerMu.Lock()
+	defer metricsServerMu.Unlock()
+
+	if runningMetrics == nil {
+		return listen != ""
+	}
+
+	return runningMetrics.listen != listen
+}
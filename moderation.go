@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+const timedBanCheckInterval = 30 * time.Second
+
+var (
+	errNoChannel       = errors.New("which channel? give it as the first argument")
+	errInvalidDuration = errors.New("invalid duration, use something like 30m, 2h or 1d")
+)
+
+// moderationCommands act on a channel, which can be given as their first
+// argument.
+var moderationCommands = []string{"kick", "ban", "unban", "quiet", "unquiet", "op", "voice", "topic", "mode"}
+
+func isModerationCommand(command string) bool {
+	return slices.Contains(moderationCommands, command)
+}
+
+// moderationChannel returns the channel a moderation command acts on, the
+// first argument if it looks like one and otherwise the channel the command
+// was sent in, along with the arguments after it. The channel is empty for
+// a private message that doesn't name one.
+func moderationChannel(event girc.Event, args []string) (string, []string) {
+	rest := args[1:]
+
+	if len(rest) > 0 && girc.IsValidChannel(rest[0]) {
+		return rest[0], rest[1:]
+	}
+
+	if !isPrivateMessage(event) && len(event.Params) > 0 {
+		return event.Params[0], rest
+	}
+
+	return "", rest
+}
+
+type TimedBan struct {
+	Channel string
+	Mode    string
+	Mask    string
+	Expires time.Time
+}
+
+// TimedBans are bans and quiets that are lifted once they expire. They are
+// stored in the timed_bans table so they survive restarts.
+type TimedBans struct {
+	mu   sync.Mutex
+	bans []TimedBan
+}
+
+func NewTimedBans() *TimedBans {
+	return &TimedBans{}
+}
+
+func (timedBans *TimedBans) Add(ban TimedBan) {
+	timedBans.mu.Lock()
+	defer timedBans.mu.Unlock()
+
+	for index, existing := range timedBans.bans {
+		if strings.EqualFold(existing.Channel, ban.Channel) && existing.Mode == ban.Mode &&
+			strings.EqualFold(existing.Mask, ban.Mask) {
+			timedBans.bans[index] = ban
+
+			return
+		}
+	}
+
+	timedBans.bans = append(timedBans.bans, ban)
+}
+
+func (timedBans *TimedBans) Remove(channel, mode, mask string) {
+	timedBans.mu.Lock()
+	defer timedBans.mu.Unlock()
+
+	kept := timedBans.bans[:0]
+
+	for _, ban := range timedBans.bans {
+		if strings.EqualFold(ban.Channel, channel) && ban.Mode == mode && strings.EqualFold(ban.Mask, mask) {
+			continue
+		}
+
+		kept = append(kept, ban)
+	}
+
+	timedBans.bans = kept
+}
+
+func (timedBans *TimedBans) Expired(now time.Time) []TimedBan {
+	timedBans.mu.Lock()
+	defer timedBans.mu.Unlock()
+
+	var expired []TimedBan
+
+	for _, ban := range timedBans.bans {
+		if now.After(ban.Expires) {
+			expired = append(expired, ban)
+		}
+	}
+
+	return expired
+}
+
+// parseDuration is time.ParseDuration that also understands days, e.g. 1d
+// or 1d12h. Only durations in the future make sense, so anything that isn't
+// positive is an error.
+func parseDuration(text string) (time.Duration, error) {
+	duration, err := parseDays(text)
+	if err != nil || duration <= 0 {
+		return 0, errInvalidDuration
+	}
+
+	return duration, nil
+}
+
+func parseDays(text string) (time.Duration, error) {
+	var days time.Duration
+
+	if before, after, found := strings.Cut(text, "d"); found {
+		count, err := strconv.Atoi(before)
+		if err != nil {
+			return 0, errInvalidDuration
+		}
+
+		days = time.Duration(count) * 24 * time.Hour //nolint: mnd,gomnd
+		text = after
+	}
+
+	if text == "" {
+		return days, nil
+	}
+
+	duration, err := time.ParseDuration(text)
+	if err != nil {
+		return 0, errInvalidDuration
+	}
+
+	return days + duration, nil
+}
+
+// banMask turns a nick into a *!*@host mask using what girc knows about the
+// user. Anything that already looks like a mask is returned as is. For a
+// nick the bot doesn't share a channel with it falls back to nick!*@*,
+// which the user gets around by changing nick, and tells whoever asked.
+func banMask(client *girc.Client, event girc.Event, target string) string {
+	if strings.ContainsAny(target, "!@") {
+		return target
+	}
+
+	if user := client.LookupUser(target); user != nil && user.Host != "" {
+		return "*!*@" + user.Host
+	}
+
+	mask := target + "!*@*"
+
+	QueueReply(client, event, fmt.Sprintf("don't know the host of %s, using %s which only matches the nick", target, mask))
+
+	return mask
+}
+
+func createTimedBansTable(appConfig *TomlConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx, `create table if not exists timed_bans (
+			id serial primary key,
+			network text not null,
+			channel text not null,
+			mode text not null,
+			mask text not null,
+			expires timestamptz not null,
+			unique (network, channel, mode, mask)
+		)`)
+
+	return err
+}
+
+func loadTimedBans(appConfig *TomlConfig) {
+	if appConfig.pool == nil || appConfig.timedBans == nil {
+		return
+	}
+
+	err := createTimedBansTable(appConfig)
+	if err != nil {
+		LogError(err)
+
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	rows, err := appConfig.pool.Query(ctx,
+		"select channel, mode, mask, expires from timed_bans where network = $1", appConfig.IRCDName)
+	if err != nil {
+		LogError(err)
+
+		return
+	}
+	defer rows.Close()
+
+	count := 0
+
+	for rows.Next() {
+		var ban TimedBan
+
+		err := rows.Scan(&ban.Channel, &ban.Mode, &ban.Mask, &ban.Expires)
+		if err != nil {
+			LogError(err)
+
+			continue
+		}
+
+		appConfig.timedBans.Add(ban)
+		count++
+	}
+
+	slog.Info("loaded timed bans", "network", appConfig.IRCDName, "count", count)
+}
+
+func saveTimedBan(appConfig *TomlConfig, ban TimedBan) error {
+	if appConfig.pool == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx,
+		`insert into timed_bans (network, channel, mode, mask, expires) values ($1, $2, $3, $4, $5)
+			on conflict (network, channel, mode, mask) do update set expires = excluded.expires`,
+		appConfig.IRCDName, ban.Channel, ban.Mode, ban.Mask, ban.Expires)
+
+	return err
+}
+
+func deleteTimedBan(appConfig *TomlConfig, channel, mode, mask string) error {
+	if appConfig.pool == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx,
+		"delete from timed_bans where network = $1 and lower(channel) = lower($2) and mode = $3 and lower(mask) = lower($4)",
+		appConfig.IRCDName, channel, mode, mask)
+
+	return err
+}
+
+// expireTimedBans lifts the bans that ran out. Bans on channels the bot is
+// only out of for now, e.g. after a kick, are kept until it is back. Bans on
+// channels it left for good are dropped, there is nobody to lift them.
+func expireTimedBans(client *girc.Client, appConfig *TomlConfig) {
+	if !client.IsConnected() {
+		return
+	}
+
+	state := getChannelState(client)
+
+	for _, ban := range appConfig.timedBans.Expired(time.Now()) {
+		if !client.IsInChannel(ban.Channel) {
+			if state == nil {
+				continue
+			}
+
+			if _, wanted := state.Wanted(ban.Channel); wanted {
+				continue
+			}
+
+			slog.Info("not in channel any more, dropping timed ban", "network", appConfig.IRCDName,
+				"channel", ban.Channel, "mode", ban.Mode, "mask", ban.Mask)
+		} else {
+			slog.Info("lifting timed ban", "network", appConfig.IRCDName, "channel", ban.Channel, "mode", ban.Mode, "mask", ban.Mask)
+
+			client.Cmd.Mode(ban.Channel, "-"+ban.Mode, ban.Mask)
+		}
+
+		appConfig.timedBans.Remove(ban.Channel, ban.Mode, ban.Mask)
+
+		if err := deleteTimedBan(appConfig, ban.Channel, ban.Mode, ban.Mask); err != nil {
+			LogError(err)
+		}
+	}
+}
+
+func setupModeration(ctx context.Context, irc *girc.Client, appConfig *TomlConfig) {
+	appConfig.timedBans = NewTimedBans()
+
+	go func() {
+		ticker := time.NewTicker(timedBanCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				expireTimedBans(irc, appConfig.current())
+			}
+		}
+	}()
+}
+
+// quietMode returns the mode and mask to quiet someone with. Networks
+// differ, some use +q and others an extban such as +b ~q:.
+func quietMode(appConfig *TomlConfig, mask string) (string, string) {
+	return appConfig.QuietMode, appConfig.QuietMaskPrefix + mask
+}
+
+func setMaskMode(client *girc.Client, event girc.Event, appConfig *TomlConfig, channel, mode, mask string, rest []string) {
+	if len(rest) == 0 {
+		client.Cmd.Mode(channel, "+"+mode, mask)
+
+		return
+	}
+
+	duration, err := parseDuration(rest[0])
+	if err != nil {
+		QueueReply(client, event, err.Error())
+
+		return
+	}
+
+	client.Cmd.Mode(channel, "+"+mode, mask)
+
+	ban := TimedBan{Channel: channel, Mode: mode, Mask: mask, Expires: time.Now().Add(duration)}
+	appConfig.timedBans.Add(ban)
+
+	if err := saveTimedBan(appConfig, ban); err != nil {
+		LogError(err)
+	}
+
+	QueueReply(client, event, fmt.Sprintf("+%s %s on %s until %s", mode, mask, channel, ban.Expires.Format(time.RFC1123)))
+}
+
+func unsetMaskMode(client *girc.Client, appConfig *TomlConfig, channel, mode, mask string) {
+	client.Cmd.Mode(channel, "-"+mode, mask)
+	appConfig.timedBans.Remove(channel, mode, mask)
+
+	if err := deleteTimedBan(appConfig, channel, mode, mask); err != nil {
+		LogError(err)
+	}
+}
+
+// handleModerationCommand runs the channel operator commands on the channel
+// moderationChannel picks. runCommand has already checked the permission
+// for that channel.
+func handleModerationCommand(args []string, client *girc.Client, event girc.Event, appConfig *TomlConfig) {
+	command := args[0]
+
+	channel, rest := moderationChannel(event, args)
+	if channel == "" {
+		QueueReply(client, event, errNoChannel.Error())
+
+		return
+	}
+
+	switch command {
+	case "op", "voice":
+		nick := event.Source.Name
+		if len(rest) > 0 {
+			nick = rest[0]
+		}
+
+		mode := "+o"
+		if command == "voice" {
+			mode = "+v"
+		}
+
+		client.Cmd.Mode(channel, mode, nick)
+
+		return
+	case "topic":
+		client.Cmd.Topic(channel, strings.Join(rest, " "))
+
+		return
+	case "mode":
+		if len(rest) == 0 {
+			QueueReply(client, event, errNotEnoughArgs.Error())
+
+			return
+		}
+
+		client.Cmd.Mode(channel, rest[0], rest[1:]...)
+
+		return
+	}
+
+	if len(rest) == 0 {
+		QueueReply(client, event, errNotEnoughArgs.Error())
+
+		return
+	}
+
+	switch command {
+	case "kick":
+		reason := strings.Join(rest[1:], " ")
+		if reason == "" {
+			reason = "requested by " + event.Source.Name
+		}
+
+		client.Cmd.Kick(channel, rest[0], reason)
+	case "ban":
+		setMaskMode(client, event, appConfig, channel, "b", banMask(client, event, rest[0]), rest[1:])
+	case "unban":
+		unsetMaskMode(client, appConfig, channel, "b", banMask(client, event, rest[0]))
+	case "quiet":
+		mode, mask := quietMode(appConfig, banMask(client, event, rest[0]))
+		setMaskMode(client, event, appConfig, channel, mode, mask, rest[1:])
+	case "unquiet":
+		mode, mask := quietMode(appConfig, banMask(client, event, rest[0]))
+		unsetMaskMode(client, appConfig, channel, mode, mask)
+	}
+}
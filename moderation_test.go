@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		text string
+		want time.Duration
+		err  error
+	}{
+		{"30m", 30 * time.Minute, nil},
+		{"2h", 2 * time.Hour, nil},
+		{"1d", 24 * time.Hour, nil},
+		{"1d12h", 36 * time.Hour, nil},
+		{"2d30m", 48*time.Hour + 30*time.Minute, nil},
+		{"0s", 0, errInvalidDuration},
+		{"-1h", 0, errInvalidDuration},
+		{"0d", 0, errInvalidDuration},
+		{"xd", 0, errInvalidDuration},
+		{"1w", 0, errInvalidDuration},
+		{"", 0, errInvalidDuration},
+	}
+
+	for _, test := range tests {
+		got, err := parseDuration(test.text)
+		if got != test.want || !errors.Is(err, test.err) {
+			t.Errorf("%q: got %v, %v, want %v, %v", test.text, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestTimedBans(t *testing.T) {
+	now := time.Now()
+	bans := NewTimedBans()
+
+	bans.Add(TimedBan{Channel: "#milla", Mode: "b", Mask: "*!*@host", Expires: now.Add(time.Hour)})
+	bans.Add(TimedBan{Channel: "#Milla", Mode: "b", Mask: "*!*@HOST", Expires: now.Add(-time.Minute)})
+	bans.Add(TimedBan{Channel: "#milla", Mode: "q", Mask: "*!*@host", Expires: now.Add(time.Hour)})
+
+	expired := bans.Expired(now)
+	if len(expired) != 1 || expired[0].Mode != "b" {
+		t.Fatalf("got %+v, want the ban that was shortened", expired)
+	}
+
+	bans.Remove("#MILLA", "b", "*!*@host")
+
+	if expired := bans.Expired(now.Add(2 * time.Hour)); len(expired) != 1 || expired[0].Mode != "q" {
+		t.Errorf("got %+v, want only the quiet left", expired)
+	}
+}
+
+func TestModerationChannel(t *testing.T) {
+	tests := []struct {
+		target  string
+		args    []string
+		channel string
+		rest    []string
+	}{
+		{"#milla", []string{"ban", "nick"}, "#milla", []string{"nick"}},
+		{"#milla", []string{"ban", "#other", "nick", "1h"}, "#other", []string{"nick", "1h"}},
+		{"milla", []string{"ban", "#other", "nick"}, "#other", []string{"nick"}},
+		{"milla", []string{"ban", "nick"}, "", []string{"nick"}},
+	}
+
+	for _, test := range tests {
+		event := girc.Event{Source: &girc.Source{Name: "op"}, Command: girc.PRIVMSG, Params: []string{test.target, "/ban"}}
+
+		channel, rest := moderationChannel(event, test.args)
+		if channel != test.channel || len(rest) != len(test.rest) || (len(rest) > 0 && rest[0] != test.rest[0]) {
+			t.Errorf("%q in %s: got %q %q, want %q %q", test.args, test.target, channel, rest, test.channel, test.rest)
+		}
+	}
+}
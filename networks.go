@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lrstanley/girc"
+)
+
+// Network is a running IRC connection. Config is the TomlConfig its handlers
+// were set up with, Config.current() is the version they run with right now.
+type Network struct {
+	Name   string
+	Client *girc.Client
+	Config *TomlConfig
+	ctx    context.Context //nolint: containedctx
+	stop   context.CancelFunc
+}
+
+var (
+	networksMu sync.RWMutex
+	networks   = make(map[string]*Network)
+)
+
+func registerNetwork(network *Network) {
+	networksMu.Lock()
+	defer networksMu.Unlock()
+
+	networks[network.Name] = network
+}
+
+// unregisterNetwork only removes the network if it has not been replaced by
+// a newer one with the same name in the meantime.
+func unregisterNetwork(network *Network) {
+	networksMu.Lock()
+	defer networksMu.Unlock()
+
+	if networks[network.Name] == network {
+		delete(networks, network.Name)
+	}
+}
+
+func getNetwork(name string) *Network {
+	networksMu.RLock()
+	defer networksMu.RUnlock()
+
+	return networks[name]
+}
+
+// getNetworks returns the running networks sorted by name.
+func getNetworks() []*Network {
+	networksMu.RLock()
+	defer networksMu.RUnlock()
+
+	running := make([]*Network, 0, len(networks))
+	for _, network := range networks {
+		running = append(running, network)
+	}
+
+	sort.Slice(running, func(i, j int) bool { return running[i].Name < running[j].Name })
+
+	return running
+}
+
+// Stop disconnects the network for good, runIRC won't reconnect it.
+// Cancelling the network's context stops everything it started and drops
+// its state, the plugins and the database pool go when runIRC returns.
+func (network *Network) Stop(reason string) {
+	slog.Info("stopping network", "network", network.Name, "reason", reason)
+
+	network.stop()
+	unregisterNetwork(network)
+
+	if network.Client.IsConnected() {
+		network.Client.Quit(reason)
+	} else {
+		network.Client.Close()
+	}
+}
+
+// configState is shared by every version of a network's config. Handlers
+// only read the version they loaded, a change copies the current version,
+// changes the copy and swaps it in, so no version is written to while
+// handlers can see it.
+type configState struct {
+	mu      sync.Mutex
+	version atomic.Pointer[TomlConfig]
+
+	// the RSS dispatchers outlive config versions.
+	rssGroups map[string]context.CancelFunc
+	rssReady  bool
+}
+
+// publish makes config the first version of a network's config. Everything
+// after this has to go through update.
+func (config *TomlConfig) publish() {
+	// the plugin maps are changed in place and shared by all versions.
+	if config.LuaStates == nil {
+		config.LuaStates = make(map[string]LuaLstates)
+	}
+
+	if config.LuaCommands == nil {
+		config.LuaCommands = make(map[string]LuaCommand)
+	}
+
+	if config.TriggeredScripts == nil {
+		config.TriggeredScripts = make(map[string]TriggeredScripts)
+	}
+
+	config.state = &configState{}
+	config.state.version.Store(config)
+}
+
+// current returns the latest version of the config. A config that was never
+// published, like the ones milla check builds, is its own latest version.
+func (config *TomlConfig) current() *TomlConfig {
+	if config.state == nil {
+		return config
+	}
+
+	return config.state.version.Load()
+}
+
+// update runs change on a copy of the latest version and swaps the copy in
+// if change did not fail. Handlers that already loaded the old version keep
+// using it until they are done. The change can set a secret, so the log
+// redaction picks up the new version too.
+func (config *TomlConfig) update(change func(next *TomlConfig) error) error {
+	if config.state == nil {
+		return change(config)
+	}
+
+	config.state.mu.Lock()
+
+	next := *config.state.version.Load()
+
+	if err := change(&next); err != nil {
+		config.state.mu.Unlock()
+
+		return err
+	}
+
+	config.state.version.Store(&next)
+	config.state.mu.Unlock()
+
+	refreshSecrets()
+
+	return nil
+}
+
+func startNetwork(appConfig TomlConfig) {
+	if appConfig.IrcServer == "" {
+		slog.Warn("could not find server for irc connection in the config file, skipping. run milla check to find spelling errors",
+			"network", appConfig.IRCDName)
+
+		return
+	}
+
+	go runIRC(appConfig)
+}
@@ -8,7 +8,6 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 
 	"github.com/alecthomas/chroma/v2/quick"
@@ -20,10 +19,10 @@ func DoOllamaRequest(
 	appConfig *TomlConfig,
 	ollamaMemory *[]MemoryElement,
 	prompt, systemPrompt string,
-) (string, error) {
-	var jsonPayload []byte
+) (_ string, err error) {
+	defer func(start time.Time) { observeLLMRequest("ollama", appConfig.Model, start, err) }(time.Now())
 
-	var err error
+	var jsonPayload []byte
 
 	memoryElement := MemoryElement{
 		Role:    "user",
@@ -71,7 +70,7 @@ func DoOllamaRequest(
 		return "", err
 	}
 
-	log.Printf("json payload: %s", string(jsonPayload))
+	logMessageContent(nil, "ollama request", "payload", string(jsonPayload))
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
 	defer cancel()
@@ -124,7 +123,9 @@ func DoOllamaRequest(
 		return "", err
 	}
 
-	log.Println("ollama chat response: ", ollamaChatResponse)
+	logMessageContent(nil, "ollama response", "content", ollamaChatResponse.Messages.Content)
+
+	countLLMTokens("ollama", appConfig.Model, ollamaChatResponse.PromptEvalCount, ollamaChatResponse.EvalCount)
 
 	return ollamaChatResponse.Messages.Content, nil
 }
@@ -138,7 +139,7 @@ func OllamaRequestProcessor(
 ) string {
 	response, err := DoOllamaRequest(appConfig, ollamaMemory, prompt, systemPrompt)
 	if err != nil {
-		client.Cmd.ReplyTo(event, "error: "+err.Error())
+		QueueReplyTo(client, event, "error: "+err.Error())
 
 		return ""
 	}
@@ -150,8 +151,6 @@ func OllamaRequestProcessor(
 
 	*ollamaMemory = append(*ollamaMemory, assistantElement)
 
-	log.Println(response)
-
 	var writer bytes.Buffer
 
 	err = quick.Highlight(&writer,
@@ -160,7 +159,7 @@ func OllamaRequestProcessor(
 		appConfig.ChromaFormatter,
 		appConfig.ChromaStyle)
 	if err != nil {
-		client.Cmd.ReplyTo(event, "error: "+err.Error())
+		QueueReplyTo(client, event, "error: "+err.Error())
 
 		return ""
 	}
@@ -174,34 +173,32 @@ func OllamaHandler(
 	ollamaMemory *[]MemoryElement,
 ) {
 	irc.Handlers.AddBg(girc.PRIVMSG, func(client *girc.Client, event girc.Event) {
-		if !strings.HasPrefix(event.Last(), appConfig.IrcNick+": ") {
+		appConfig := appConfig.current()
+
+		match, ok := extractPrompt(client, event, appConfig)
+		if !ok {
 			return
 		}
 
-		if appConfig.AdminOnly {
-			byAdmin := false
+		prompt := match.Text
 
-			for _, admin := range appConfig.Admins {
-				if event.Source.Name == admin {
-					byAdmin = true
-				}
-			}
+		logger := eventLogger(appConfig, event)
+		logMessageContent(logger, "prompt", "text", prompt)
 
-			if !byAdmin {
-				return
-			}
-		}
-
-		prompt := strings.TrimPrefix(event.Last(), appConfig.IrcNick+": ")
-		log.Println(prompt)
-
-		if string(prompt[0]) == "/" {
+		if match.IsCommand {
+			logger.Info("running a command")
 			runCommand(client, event, appConfig)
 
 			return
 		}
 
+		logger.Info("asking the llm", "provider", "ollama", "model", appConfig.Model)
+
+		start := time.Now()
+		stopTyping := StartTyping(client, event)
 		result := OllamaRequestProcessor(appConfig, client, event, ollamaMemory, prompt, appConfig.SystemPrompt)
+		stopTyping()
+		logger.Info("answered", "duration", time.Since(start), "ok", result != "")
 		if result != "" {
 			SendToIRC(client, event, result, appConfig.ChromaFormatter)
 		}
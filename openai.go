@@ -7,7 +7,6 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 
 	"github.com/alecthomas/chroma/v2/quick"
@@ -20,7 +19,9 @@ func DoChatGPTRequest(
 	appConfig *TomlConfig,
 	gptMemory *[]openai.ChatCompletionMessage,
 	prompt, systemPrompt string,
-) (string, error) {
+) (_ string, err error) {
+	defer func(start time.Time) { observeLLMRequest("openai", appConfig.Model, start, err) }(time.Now())
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
 	defer cancel()
 
@@ -76,6 +77,8 @@ func DoChatGPTRequest(
 		return "", err
 	}
 
+	countLLMTokens("openai", appConfig.Model, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+
 	return resp.Choices[0].Message.Content, nil
 }
 
@@ -88,7 +91,7 @@ func ChatGPTRequestProcessor(
 ) string {
 	resp, err := DoChatGPTRequest(appConfig, gptMemory, prompt, systemPrompt)
 	if err != nil {
-		client.Cmd.ReplyTo(event, "error: "+err.Error())
+		QueueReplyTo(client, event, "error: "+err.Error())
 
 		return ""
 	}
@@ -118,7 +121,7 @@ func ChatGPTRequestProcessor(
 		appConfig.ChromaFormatter,
 		appConfig.ChromaStyle)
 	if err != nil {
-		client.Cmd.ReplyTo(event, "error: "+err.Error())
+		QueueReplyTo(client, event, "error: "+err.Error())
 
 		return ""
 	}
@@ -132,34 +135,32 @@ func ChatGPTHandler(
 	gptMemory *[]openai.ChatCompletionMessage,
 ) {
 	irc.Handlers.AddBg(girc.PRIVMSG, func(client *girc.Client, event girc.Event) {
-		if !strings.HasPrefix(event.Last(), appConfig.IrcNick+": ") {
+		appConfig := appConfig.current()
+
+		match, ok := extractPrompt(client, event, appConfig)
+		if !ok {
 			return
 		}
 
-		if appConfig.AdminOnly {
-			byAdmin := false
+		prompt := match.Text
 
-			for _, admin := range appConfig.Admins {
-				if event.Source.Name == admin {
-					byAdmin = true
-				}
-			}
+		logger := eventLogger(appConfig, event)
+		logMessageContent(logger, "prompt", "text", prompt)
 
-			if !byAdmin {
-				return
-			}
-		}
-
-		prompt := strings.TrimPrefix(event.Last(), appConfig.IrcNick+": ")
-		log.Println(prompt)
-
-		if string(prompt[0]) == "/" {
+		if match.IsCommand {
+			logger.Info("running a command")
 			runCommand(client, event, appConfig)
 
 			return
 		}
 
+		logger.Info("asking the llm", "provider", "openai", "model", appConfig.Model)
+
+		start := time.Now()
+		stopTyping := StartTyping(client, event)
 		result := ChatGPTRequestProcessor(appConfig, client, event, gptMemory, prompt, appConfig.SystemPrompt)
+		stopTyping()
+		logger.Info("answered", "duration", time.Since(start), "ok", result != "")
 		if result != "" {
 			SendToIRC(client, event, result, appConfig.ChromaFormatter)
 		}
@@ -8,7 +8,6 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 
 	"github.com/alecthomas/chroma/v2/quick"
@@ -20,10 +19,10 @@ func DoORRequest(
 	appConfig *TomlConfig,
 	memory *[]MemoryElement,
 	prompt string,
-) (string, error) {
-	var jsonPayload []byte
+) (_ string, err error) {
+	defer func(start time.Time) { observeLLMRequest("openrouter", appConfig.Model, start, err) }(time.Now())
 
-	var err error
+	var jsonPayload []byte
 
 	memoryElement := MemoryElement{
 		Role:    "user",
@@ -55,7 +54,7 @@ func DoORRequest(
 		return "", err
 	}
 
-	log.Printf("json payload: %s", string(jsonPayload))
+	logMessageContent(nil, "openrouter request", "payload", string(jsonPayload))
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
 	defer cancel()
@@ -103,8 +102,6 @@ func DoORRequest(
 
 	defer response.Body.Close()
 
-	log.Println("response body:", response.Body)
-
 	var orresponse ORResponse
 
 	err = json.NewDecoder(response.Body).Decode(&orresponse)
@@ -112,6 +109,8 @@ func DoORRequest(
 		return "", err
 	}
 
+	countLLMTokens("openrouter", appConfig.Model, orresponse.Usage.PromptTokens, orresponse.Usage.CompletionTokens)
+
 	var result string
 
 	for _, choice := range orresponse.Choices {
@@ -130,7 +129,7 @@ func ORRequestProcessor(
 ) string {
 	response, err := DoORRequest(appConfig, memory, prompt)
 	if err != nil {
-		client.Cmd.ReplyTo(event, "error: "+err.Error())
+		QueueReplyTo(client, event, "error: "+err.Error())
 
 		return ""
 	}
@@ -142,8 +141,6 @@ func ORRequestProcessor(
 
 	*memory = append(*memory, assistantElement)
 
-	log.Println(response)
-
 	var writer bytes.Buffer
 
 	err = quick.Highlight(&writer,
@@ -152,7 +149,7 @@ func ORRequestProcessor(
 		appConfig.ChromaFormatter,
 		appConfig.ChromaStyle)
 	if err != nil {
-		client.Cmd.ReplyTo(event, "error: "+err.Error())
+		QueueReplyTo(client, event, "error: "+err.Error())
 
 		return ""
 	}
@@ -165,34 +162,32 @@ func ORHandler(
 	appConfig *TomlConfig,
 	memory *[]MemoryElement) {
 	irc.Handlers.AddBg(girc.PRIVMSG, func(client *girc.Client, event girc.Event) {
-		if !strings.HasPrefix(event.Last(), appConfig.IrcNick+": ") {
+		appConfig := appConfig.current()
+
+		match, ok := extractPrompt(client, event, appConfig)
+		if !ok {
 			return
 		}
 
-		if appConfig.AdminOnly {
-			byAdmin := false
-
-			for _, admin := range appConfig.Admins {
-				if event.Source.Name == admin {
-					byAdmin = true
-				}
-			}
+		prompt := match.Text
 
-			if !byAdmin {
-				return
-			}
-		}
+		logger := eventLogger(appConfig, event)
+		logMessageContent(logger, "prompt", "text", prompt)
 
-		prompt := strings.TrimPrefix(event.Last(), appConfig.IrcNick+": ")
-		log.Println(prompt)
-
-		if string(prompt[0]) == "/" {
+		if match.IsCommand {
+			logger.Info("running a command")
 			runCommand(client, event, appConfig)
 
 			return
 		}
 
+		logger.Info("asking the llm", "provider", "openrouter", "model", appConfig.Model)
+
+		start := time.Now()
+		stopTyping := StartTyping(client, event)
 		result := ORRequestProcessor(appConfig, client, event, memory, prompt)
+		stopTyping()
+		logger.Info("answered", "duration", time.Since(start), "ok", result != "")
 		if result != "" {
 			SendToIRC(client, event, result, appConfig.ChromaFormatter)
 		}
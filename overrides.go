@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/lrstanley/girc"
+)
+
+const (
+	OverrideSet    = "set"
+	OverrideJoin   = "join"
+	OverrideLeave  = "leave"
+	OverrideLoad   = "load"
+	OverrideUnload = "unload"
+)
+
+var errNoOverride = errors.New("nothing to revert")
+
+// Override is a change an admin made at runtime with /set, /join, /leave,
+// /load or /unload. Overrides are applied on top of the config file.
+type Override struct {
+	Kind  string `toml:"kind"`
+	Name  string `toml:"name"`
+	Value string `toml:"value"`
+}
+
+type overridesFile struct {
+	Ircd map[string][]Override `toml:"ircd"`
+}
+
+type Overrides struct {
+	mu      sync.Mutex
+	entries []Override
+}
+
+var overridesFileMu sync.Mutex
+
+func NewOverrides(entries []Override) *Overrides {
+	return &Overrides{entries: entries}
+}
+
+func (overrides *Overrides) Put(override Override) {
+	overrides.mu.Lock()
+	defer overrides.mu.Unlock()
+
+	for index, existing := range overrides.entries {
+		if existing.Kind == override.Kind && strings.EqualFold(existing.Name, override.Name) {
+			overrides.entries[index] = override
+
+			return
+		}
+	}
+
+	overrides.entries = append(overrides.entries, override)
+}
+
+// Delete removes the overrides of the given kinds for a name and returns
+// the ones it removed. Without kinds every override for the name goes.
+func (overrides *Overrides) Delete(name string, kinds ...string) []Override {
+	overrides.mu.Lock()
+	defer overrides.mu.Unlock()
+
+	var removed []Override
+
+	kept := overrides.entries[:0]
+
+	for _, existing := range overrides.entries {
+		if strings.EqualFold(existing.Name, name) && (len(kinds) == 0 || slices.Contains(kinds, existing.Kind)) {
+			removed = append(removed, existing)
+
+			continue
+		}
+
+		kept = append(kept, existing)
+	}
+
+	overrides.entries = kept
+
+	return removed
+}
+
+func (overrides *Overrides) List() []Override {
+	overrides.mu.Lock()
+	defer overrides.mu.Unlock()
+
+	return slices.Clone(overrides.entries)
+}
+
+// fileConfig is the network's config as it is in the config file.
+func fileConfig(appConfig *TomlConfig) (TomlConfig, error) {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return TomlConfig{}, err
+	}
+
+	return config.Ircd[appConfig.IRCDName], nil
+}
+
+func readOverridesFile(path string) (overridesFile, error) {
+	var file overridesFile
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return file, nil
+	}
+
+	if err != nil {
+		return file, err
+	}
+
+	_, err = toml.Decode(string(data), &file)
+
+	return file, err
+}
+
+func createOverridesTable(appConfig *TomlConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx, `create table if not exists overrides (
+			id serial primary key,
+			network text not null,
+			kind text not null,
+			name text not null,
+			value text not null,
+			unique (network, kind, name)
+		)`)
+
+	return err
+}
+
+// loadOverrides reads the stored overrides, from overridesFile if it is set
+// and from the database otherwise.
+func loadOverrides(appConfig *TomlConfig) ([]Override, error) {
+	if appConfig.OverridesFile != "" {
+		overridesFileMu.Lock()
+		defer overridesFileMu.Unlock()
+
+		file, err := readOverridesFile(appConfig.OverridesFile)
+
+		return file.Ircd[appConfig.IRCDName], err
+	}
+
+	if appConfig.pool == nil {
+		return nil, nil
+	}
+
+	if err := createOverridesTable(appConfig); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	rows, err := appConfig.pool.Query(ctx,
+		"select kind, name, value from overrides where network = $1 order by id", appConfig.IRCDName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var overrides []Override
+
+	for rows.Next() {
+		var override Override
+
+		if err := rows.Scan(&override.Kind, &override.Name, &override.Value); err != nil {
+			return nil, err
+		}
+
+		overrides = append(overrides, override)
+	}
+
+	return overrides, rows.Err()
+}
+
+// saveOverrides writes all of a network's overrides, replacing what was
+// stored before.
+func saveOverrides(appConfig *TomlConfig) error {
+	overrides := appConfig.overrides.List()
+
+	if appConfig.OverridesFile != "" {
+		overridesFileMu.Lock()
+		defer overridesFileMu.Unlock()
+
+		file, err := readOverridesFile(appConfig.OverridesFile)
+		if err != nil {
+			return err
+		}
+
+		if file.Ircd == nil {
+			file.Ircd = make(map[string][]Override)
+		}
+
+		file.Ircd[appConfig.IRCDName] = overrides
+
+		var buffer bytes.Buffer
+
+		if err := toml.NewEncoder(&buffer).Encode(file); err != nil {
+			return err
+		}
+
+		return os.WriteFile(appConfig.OverridesFile, buffer.Bytes(), 0o600) //nolint: mnd,gomnd
+	}
+
+	if appConfig.pool == nil {
+		slog.Warn("no database and no overridesFile, runtime changes won't survive a restart", "network", appConfig.IRCDName)
+
+		return nil
+	}
+
+	if err := createOverridesTable(appConfig); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	transaction, err := appConfig.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback(ctx) //nolint: errcheck
+
+	_, err = transaction.Exec(ctx, "delete from overrides where network = $1", appConfig.IRCDName)
+	if err != nil {
+		return err
+	}
+
+	for _, override := range overrides {
+		_, err = transaction.Exec(ctx,
+			"insert into overrides (network, kind, name, value) values ($1, $2, $3, $4)",
+			appConfig.IRCDName, override.Kind, override.Name, override.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return transaction.Commit(ctx)
+}
+
+func channelIndex(channels [][]string, name string) int {
+	return slices.IndexFunc(channels, func(channel []string) bool {
+		return len(channel) > 0 && strings.EqualFold(channel[0], name)
+	})
+}
+
+// applyOverride changes the config the way an override says. It doesn't
+// touch the IRC connection, syncRunning does that.
+func applyOverride(appConfig *TomlConfig, override Override) error {
+	switch override.Kind {
+	case OverrideSet:
+		return setFieldByName(reflect.ValueOf(appConfig).Elem(), override.Name, override.Value)
+	case OverrideJoin:
+		if channelIndex(appConfig.IrcChannels, override.Name) < 0 {
+			appConfig.IrcChannels = append(slices.Clone(appConfig.IrcChannels), []string{override.Name, override.Value})
+		}
+	case OverrideLeave:
+		appConfig.IrcChannels = slices.DeleteFunc(slices.Clone(appConfig.IrcChannels), func(channel []string) bool {
+			return len(channel) > 0 && strings.EqualFold(channel[0], override.Name)
+		})
+		appConfig.ScrapeChannels = slices.DeleteFunc(slices.Clone(appConfig.ScrapeChannels), func(channel []string) bool {
+			return len(channel) > 0 && strings.EqualFold(channel[0], override.Name)
+		})
+	case OverrideLoad:
+		if !slices.Contains(appConfig.Plugins, override.Name) {
+			appConfig.Plugins = append(slices.Clone(appConfig.Plugins), override.Name)
+		}
+	case OverrideUnload:
+		appConfig.Plugins = slices.DeleteFunc(slices.Clone(appConfig.Plugins), func(plugin string) bool {
+			return plugin == override.Name
+		})
+	}
+
+	return nil
+}
+
+func applyOverrides(appConfig *TomlConfig) {
+	if appConfig.overrides == nil {
+		return
+	}
+
+	for _, override := range appConfig.overrides.List() {
+		if err := applyOverride(appConfig, override); err != nil {
+			slog.Warn("could not apply override", "network", appConfig.IRCDName,
+				"kind", override.Kind, "name", override.Name, "error", err)
+		}
+	}
+}
+
+func unloadPlugin(appConfig *TomlConfig, scriptPath string) {
+	for key, value := range appConfig.LuaCommands {
+		if value.Path == scriptPath {
+			appConfig.deleteLuaCommand(key)
+		}
+	}
+
+	appConfig.deleteLstate(scriptPath)
+}
+
+// syncRunning joins and parts channels and loads and unloads plugins so the
+// network matches its config again.
+func syncRunning(client *girc.Client, appConfig *TomlConfig, oldChannels map[string][]string, oldPlugins []string) []string {
+	var changes []string
+
+	appConfig = appConfig.current()
+
+	newChannels := configChannels(appConfig)
+
+	for key, channel := range oldChannels {
+		if _, ok := newChannels[key]; !ok {
+			IrcPart(client, channel[0])
+
+			changes = append(changes, "parted "+channel[0])
+		}
+	}
+
+	for key, channel := range newChannels {
+		if _, ok := oldChannels[key]; !ok {
+			if client.IsConnected() {
+				IrcJoin(client, channel)
+			}
+
+			changes = append(changes, "joined "+channel[0])
+		}
+	}
+
+	for _, plugin := range oldPlugins {
+		if !slices.Contains(appConfig.Plugins, plugin) {
+			unloadPlugin(appConfig, plugin)
+
+			changes = append(changes, "unloaded "+plugin)
+		}
+	}
+
+	for _, plugin := range appConfig.Plugins {
+		if !slices.Contains(oldPlugins, plugin) {
+			go RunScript(plugin, client, appConfig)
+
+			changes = append(changes, "loaded "+plugin)
+		}
+	}
+
+	return changes
+}
+
+// setupOverrides loads the overrides kept in overridesFile before the
+// network connects. Overrides kept in the database are loaded by
+// restoreOverrides once it is connected.
+func setupOverrides(appConfig *TomlConfig) {
+	appConfig.overrides = NewOverrides(nil)
+
+	if appConfig.OverridesFile == "" {
+		return
+	}
+
+	overrides, err := loadOverrides(appConfig)
+	if err != nil {
+		LogError(err)
+
+		return
+	}
+
+	appConfig.overrides = NewOverrides(overrides)
+
+	applyOverrides(appConfig)
+
+	slog.Info("applied overrides", "network", appConfig.IRCDName, "count", len(overrides), "file", appConfig.OverridesFile)
+}
+
+func restoreOverrides(client *girc.Client, appConfig *TomlConfig) {
+	if appConfig.OverridesFile != "" || appConfig.overrides == nil {
+		return
+	}
+
+	overrides, err := loadOverrides(appConfig)
+	if err != nil {
+		LogError(err)
+
+		return
+	}
+
+	running := appConfig.current()
+	oldChannels := configChannels(running)
+	oldPlugins := slices.Clone(running.Plugins)
+
+	for _, override := range overrides {
+		appConfig.overrides.Put(override)
+	}
+
+	_ = appConfig.update(func(next *TomlConfig) error {
+		applyOverrides(next)
+
+		return nil
+	})
+
+	syncRunning(client, appConfig, oldChannels, oldPlugins)
+
+	slog.Info("applied overrides from the database", "network", appConfig.IRCDName, "count", len(overrides))
+}
+
+// recordOverride keeps a runtime change. Joining a channel drops an earlier
+// leave for it and the other way around, and nothing is kept if the change
+// only puts back what the config file says.
+func recordOverride(appConfig *TomlConfig, override Override) error {
+	if appConfig.overrides == nil {
+		return nil
+	}
+
+	file, err := fileConfig(appConfig)
+	if err != nil {
+		return err
+	}
+
+	switch override.Kind {
+	case OverrideJoin:
+		appConfig.overrides.Delete(override.Name, OverrideLeave)
+
+		if _, ok := configChannels(&file)[strings.ToLower(override.Name)]; !ok {
+			appConfig.overrides.Put(override)
+		}
+	case OverrideLeave:
+		appConfig.overrides.Delete(override.Name, OverrideJoin)
+
+		if _, ok := configChannels(&file)[strings.ToLower(override.Name)]; ok {
+			appConfig.overrides.Put(override)
+		}
+	case OverrideLoad:
+		appConfig.overrides.Delete(override.Name, OverrideUnload)
+
+		if !slices.Contains(file.Plugins, override.Name) {
+			appConfig.overrides.Put(override)
+		}
+	case OverrideUnload:
+		appConfig.overrides.Delete(override.Name, OverrideLoad)
+
+		if slices.Contains(file.Plugins, override.Name) {
+			appConfig.overrides.Put(override)
+		}
+	default:
+		appConfig.overrides.Put(override)
+	}
+
+	err = appConfig.update(func(next *TomlConfig) error {
+		return applyOverride(next, override)
+	})
+	if err != nil {
+		return err
+	}
+
+	return saveOverrides(appConfig)
+}
+
+// revertOverride drops the overrides for a config option, channel or plugin
+// and puts back what the config file says.
+func revertOverride(client *girc.Client, appConfig *TomlConfig, name string) ([]string, error) {
+	file, err := fileConfig(appConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := appConfig.overrides.Delete(name)
+	if len(removed) == 0 {
+		return nil, errNoOverride
+	}
+
+	running := appConfig.current()
+	oldChannels := configChannels(running)
+	oldPlugins := slices.Clone(running.Plugins)
+
+	_ = appConfig.update(func(next *TomlConfig) error {
+		for _, override := range removed {
+			switch override.Kind {
+			case OverrideSet:
+				field := reflect.ValueOf(next).Elem().FieldByName(override.Name)
+				if field.IsValid() && field.CanSet() {
+					field.Set(reflect.ValueOf(file).FieldByName(override.Name))
+				}
+			case OverrideJoin, OverrideLeave:
+				next.IrcChannels = slices.DeleteFunc(slices.Clone(next.IrcChannels), func(channel []string) bool {
+					return len(channel) > 0 && strings.EqualFold(channel[0], override.Name)
+				})
+
+				if index := channelIndex(file.IrcChannels, override.Name); index >= 0 {
+					next.IrcChannels = append(next.IrcChannels, file.IrcChannels[index])
+				}
+
+				if index := channelIndex(file.ScrapeChannels, override.Name); index >= 0 &&
+					channelIndex(next.ScrapeChannels, override.Name) < 0 {
+					next.ScrapeChannels = append(slices.Clone(next.ScrapeChannels), file.ScrapeChannels[index])
+				}
+			case OverrideLoad, OverrideUnload:
+				next.Plugins = slices.DeleteFunc(slices.Clone(next.Plugins), func(plugin string) bool {
+					return plugin == override.Name
+				})
+
+				if slices.Contains(file.Plugins, override.Name) {
+					next.Plugins = append(next.Plugins, override.Name)
+				}
+			}
+		}
+
+		return nil
+	})
+
+	changes := syncRunning(client, appConfig, oldChannels, oldPlugins)
+
+	return changes, saveOverrides(appConfig)
+}
+
+// diffConfig lists the options whose running value differs from the config
+// file, marking the ones that are kept as overrides. Secrets are masked.
+func diffConfig(appConfig *TomlConfig) ([]string, error) {
+	file, err := fileConfig(appConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	running := reflect.ValueOf(appConfig).Elem()
+	fromFile := reflect.ValueOf(file)
+
+	saved := make(map[string]bool)
+	for _, override := range appConfig.overrides.List() {
+		if override.Kind == OverrideSet {
+			saved[override.Name] = true
+		}
+	}
+
+	var lines []string
+
+	for i := range running.NumField() {
+		field := running.Type().Field(i)
+		if !field.IsExported() || tomlName(field) == "" {
+			continue
+		}
+
+		if reflect.DeepEqual(running.Field(i).Interface(), fromFile.Field(i).Interface()) {
+			continue
+		}
+
+		line := fmt.Sprintf("%s: %v (file: %v)", field.Name,
+			maskConfigValue(field.Name, running.Field(i).Interface()), maskConfigValue(field.Name, fromFile.Field(i).Interface()))
+
+		if !saved[field.Name] {
+			switch field.Name {
+			case "IrcChannels", "ScrapeChannels", "Plugins":
+			default:
+				line += " not saved"
+			}
+		}
+
+		lines = append(lines, line)
+	}
+
+	for _, override := range appConfig.overrides.List() {
+		if override.Kind != OverrideSet {
+			lines = append(lines, fmt.Sprintf("saved: %s %s", override.Kind, override.Name))
+		}
+	}
+
+	return lines, nil
+}
+
+// keepOverride records a runtime change so it survives reloads and restarts.
+func keepOverride(client *girc.Client, event girc.Event, appConfig *TomlConfig, override Override) {
+	if err := recordOverride(appConfig, override); err != nil {
+		LogError(err)
+		QueueReply(client, event, "could not save the change: "+err.Error())
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"net/url"
 	"os"
 	"reflect"
-	"strings"
 
 	"github.com/ailncode/gluaxmlpath"
 	"github.com/cjoudrey/gluahttp"
@@ -193,7 +192,7 @@ func sendMessageClosure(luaState *lua.LState, client *girc.Client) func(*lua.LSt
 		message := luaState.CheckString(1)
 		target := luaState.CheckString(2) //nolint: mnd,gomnd
 
-		client.Cmd.Message(target, message)
+		QueueMessage(client, PriorityBulk, target, message)
 
 		return 0
 	}
@@ -203,7 +202,7 @@ func replyToMessageClosure(luaStete *lua.LState, client *girc.Client, event girc
 	return func(luaState *lua.LState) int {
 		message := luaState.CheckString(1)
 
-		client.Cmd.Message(event.Source.Name, message)
+		QueueMessage(client, PriorityInteractive, event.Source.Name, message)
 
 		return 0
 	}
@@ -211,6 +210,8 @@ func replyToMessageClosure(luaStete *lua.LState, client *girc.Client, event girc
 
 func registerLuaCommand(luaState *lua.LState, appConfig *TomlConfig) func(*lua.LState) int {
 	return func(luaState *lua.LState) int {
+		appConfig := appConfig.current()
+
 		path := luaState.CheckString(1)
 		commandName := luaState.CheckString(2) //nolint: mnd,gomnd
 		funcName := luaState.CheckString(3)    //nolint: mnd,gomnd
@@ -232,6 +233,8 @@ func registerLuaCommand(luaState *lua.LState, appConfig *TomlConfig) func(*lua.L
 
 func registerTriggeredScript(luaState *lua.LState, appConfig *TomlConfig) func(*lua.LState) int {
 	return func(luaState *lua.LState) int {
+		appConfig := appConfig.current()
+
 		path := luaState.CheckString(1)
 		funcName := luaState.CheckString(3)       //nolint: mnd,gomnd
 		eventTypesTable := luaState.CheckTable(2) //nolint: mnd,gomnd
@@ -286,6 +289,8 @@ func ircPartChannelClosure(luaState *lua.LState, client *girc.Client) func(*lua.
 
 func orRequestClosure(luaState *lua.LState, appConfig *TomlConfig) func(*lua.LState) int {
 	return func(luaState *lua.LState) int {
+		appConfig := appConfig.current()
+
 		prompt := luaState.CheckString(1)
 
 		result, err := DoORRequest(appConfig, &[]MemoryElement{}, prompt)
@@ -301,6 +306,8 @@ func orRequestClosure(luaState *lua.LState, appConfig *TomlConfig) func(*lua.LSt
 
 func ollamaRequestClosure(luaState *lua.LState, appConfig *TomlConfig) func(*lua.LState) int {
 	return func(luaState *lua.LState) int {
+		appConfig := appConfig.current()
+
 		prompt := luaState.CheckString(1)
 		systemPrompt := luaState.CheckString(2) //nolint: mnd,gomnd
 
@@ -317,6 +324,8 @@ func ollamaRequestClosure(luaState *lua.LState, appConfig *TomlConfig) func(*lua
 
 func geminiRequestClosure(luaState *lua.LState, appConfig *TomlConfig) func(*lua.LState) int {
 	return func(luaState *lua.LState) int {
+		appConfig := appConfig.current()
+
 		prompt := luaState.CheckString(1)
 		systemPrompt := luaState.CheckString(2) //nolint: mnd,gomnd
 
@@ -333,6 +342,8 @@ func geminiRequestClosure(luaState *lua.LState, appConfig *TomlConfig) func(*lua
 
 func chatGPTRequestClosure(luaState *lua.LState, appConfig *TomlConfig) func(*lua.LState) int {
 	return func(luaState *lua.LState) int {
+		appConfig := appConfig.current()
+
 		prompt := luaState.CheckString(1)
 		systemPrompt := luaState.CheckString(2) //nolint: mnd,gomnd
 
@@ -349,6 +360,8 @@ func chatGPTRequestClosure(luaState *lua.LState, appConfig *TomlConfig) func(*lu
 
 func dbQueryClosure(luaState *lua.LState, appConfig *TomlConfig) func(*lua.LState) int {
 	return func(luaState *lua.LState) int {
+		appConfig := appConfig.current()
+
 		if appConfig.pool == nil {
 			log.Println("Database connection is not available")
 
@@ -498,13 +511,18 @@ func RunScript(scriptPath string, client *girc.Client, appConfig *TomlConfig) {
 
 	log.Print("Running script: ", scriptPath)
 
+	luaRuns.Inc("script")
+
 	err := luaState.DoFile(scriptPath)
 	if err != nil {
+		luaFailures.Inc("script")
 		LogError(err)
 	}
 }
 
 func LoadAllPlugins(appConfig *TomlConfig, client *girc.Client) {
+	appConfig = appConfig.current()
+
 	for _, scriptPath := range appConfig.Plugins {
 		log.Print("Loading plugin: ", scriptPath)
 
@@ -512,7 +530,16 @@ func LoadAllPlugins(appConfig *TomlConfig, client *girc.Client) {
 	}
 }
 
+// unloadPlugins stops every plugin of a network that is shutting down.
+func unloadPlugins(appConfig *TomlConfig) {
+	for scriptPath := range appConfig.LuaStates {
+		appConfig.deleteLstate(scriptPath)
+	}
+}
+
 func LoadAllEventPlugins(appConfig *TomlConfig, client *girc.Client) {
+	appConfig = appConfig.current()
+
 	for _, triggeredScript := range appConfig.TriggeredScripts {
 		log.Print("Loading event plugin: ", triggeredScript.Path)
 
@@ -574,7 +601,10 @@ func RunLuaFunc(
 
 	log.Print("Running lua command script: ", scriptPath)
 
+	luaRuns.Inc("command")
+
 	if err := luaState.DoFile(scriptPath); err != nil {
+		luaFailures.Inc("command")
 		LogError(err)
 
 		return ""
@@ -586,10 +616,10 @@ func RunLuaFunc(
 		Protect: true,
 	}
 
-	log.Print(cmd)
-	log.Print(args)
+	logMessageContent(nil, "lua command", "network", appConfig.IRCDName, "command", cmd, "args", args)
 
 	if err := luaState.CallByParam(funcLValue, lua.LString(args)); err != nil {
+		luaFailures.Inc("command")
 		log.Print("failed running lua command ...")
 		LogError(err)
 
@@ -685,15 +715,21 @@ func registerTriggeredScripts(irc *girc.Client, appConfig TomlConfig) {
 			switch triggerType {
 			case girc.PRIVMSG:
 				irc.Handlers.AddBg(girc.PRIVMSG, func(_ *girc.Client, event girc.Event) {
-					if !strings.HasPrefix(event.Last(), appConfig.IrcNick+": ") {
+					appConfig := appConfig.current()
+
+					if _, ok := parseTrigger(irc, event, appConfig); !ok {
+						return
+					}
+
+					if appConfig.AdminOnly && !checkAdmin(irc, event, appConfig, "adminOnly") {
 						return
 					}
 
-					if appConfig.AdminOnly && !isFromAdmin(appConfig.Admins, event) {
+					if isIgnored(irc, event, appConfig) {
 						return
 					}
 
-					RunTriggeredLuaFunc(triggeredScript.FuncName, triggeredScript.Path, irc, event, &appConfig)
+					RunTriggeredLuaFunc(triggeredScript.FuncName, triggeredScript.Path, irc, event, appConfig)
 				})
 			default:
 			}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+const (
+	MillaVersion = "milla"
+	MillaSource  = "https://github.com/terminaldweller/milla"
+)
+
+// rateLimiter keeps one token bucket per key, e.g. per nick. Buckets that
+// have filled up again are forgotten every so often, a new one would be the
+// same.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     int
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newRateLimiter(perMinute float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:      perMinute / 60, //nolint: mnd,gomnd
+		burst:     burst,
+		buckets:   make(map[string]*tokenBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+func (limiter *rateLimiter) prune(now time.Time) {
+	for key, bucket := range limiter.buckets {
+		bucket.refill(now)
+
+		if bucket.tokens >= bucket.burst {
+			delete(limiter.buckets, key)
+		}
+	}
+
+	limiter.lastPrune = now
+}
+
+func (limiter *rateLimiter) Allow(key string) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(limiter.lastPrune) > sendQueuePruneInterval {
+		limiter.prune(now)
+	}
+
+	key = strings.ToLower(key)
+
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = newTokenBucket(limiter.rate, limiter.burst)
+		limiter.buckets[key] = bucket
+	}
+
+	if !bucket.ready(now) {
+		return false
+	}
+
+	bucket.take(1)
+
+	return true
+}
+
+func isPrivateMessage(event girc.Event) bool {
+	return len(event.Params) > 0 && !girc.IsValidChannel(event.Params[0])
+}
+
+// extractPrompt decides whether a PRIVMSG should be answered. parseTrigger
+// works out whether it's addressed to the bot, this applies the admin and
+// private query rules on top of that.
+func extractPrompt(client *girc.Client, event girc.Event, appConfig *TomlConfig) (TriggerMatch, bool) {
+	if girc.DecodeCTCP(&event) != nil {
+		return TriggerMatch{}, false
+	}
+
+	if isIgnored(client, event, appConfig) {
+		return TriggerMatch{}, false
+	}
+
+	if isPrivateMessage(event) && appConfig.DisablePrivateMessages {
+		return TriggerMatch{}, false
+	}
+
+	match, ok := parseTrigger(client, event, appConfig)
+	if !ok {
+		return TriggerMatch{}, false
+	}
+
+	// the admin checks are audited, so they only run for messages that are
+	// meant for the bot. Commands are left to checkPermission, which answers
+	// denials.
+	if appConfig.AdminOnly && !match.IsCommand && !checkAdmin(client, event, appConfig, "adminOnly") {
+		return TriggerMatch{}, false
+	}
+
+	if isPrivateMessage(event) && appConfig.PrivateAdminOnly && !checkAdmin(client, event, appConfig, "privateAdminOnly") {
+		return TriggerMatch{}, false
+	}
+
+	if checkBotLoop(client, event, appConfig) {
+		return TriggerMatch{}, false
+	}
+
+	if isPrivateMessage(event) && appConfig.queryLimiter != nil && !appConfig.queryLimiter.Allow(event.Source.Name) {
+		slog.Info("rate limited private message", "network", appConfig.IRCDName, "nick", event.Source.Name)
+
+		return TriggerMatch{}, false
+	}
+
+	return match, true
+}
+
+func registerCTCPHandlers(irc *girc.Client) {
+	irc.Config.Version = MillaVersion + " (" + MillaSource + ")"
+
+	irc.CTCP.SetBg(girc.CTCP_SOURCE, func(client *girc.Client, ctcp girc.CTCPEvent) {
+		if ctcp.Reply {
+			return
+		}
+
+		client.Cmd.SendCTCPReply(ctcp.Source.ID(), girc.CTCP_SOURCE, MillaSource)
+	})
+
+	irc.CTCP.SetBg(girc.CTCP_CLIENTINFO, func(client *girc.Client, ctcp girc.CTCPEvent) {
+		if ctcp.Reply {
+			return
+		}
+
+		client.Cmd.SendCTCPReply(
+			ctcp.Source.ID(),
+			girc.CTCP_CLIENTINFO,
+			strings.Join([]string{
+				girc.CTCP_CLIENTINFO,
+				girc.CTCP_PING,
+				girc.CTCP_SOURCE,
+				girc.CTCP_TIME,
+				girc.CTCP_VERSION,
+			}, " "))
+	})
+}
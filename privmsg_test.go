@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(1, 2)
+
+	for range 2 {
+		if !limiter.Allow("Nick") {
+			t.Fatal("refused a message within the burst")
+		}
+	}
+
+	if limiter.Allow("nick") {
+		t.Error("allowed a message past the burst, keys should ignore case")
+	}
+
+	if !limiter.Allow("other") {
+		t.Error("refused a sender that hasn't sent anything")
+	}
+}
+
+func TestRateLimiterPrunesIdleBuckets(t *testing.T) {
+	limiter := newRateLimiter(60, 2)
+
+	limiter.Allow("idle")
+	limiter.Allow("busy")
+	limiter.Allow("busy")
+
+	// idle is back to a full bucket a second later, busy is not.
+	limiter.prune(time.Now().Add(time.Second))
+
+	if _, ok := limiter.buckets["idle"]; ok {
+		t.Error("kept a bucket that filled up again")
+	}
+
+	if _, ok := limiter.buckets["busy"]; !ok {
+		t.Error("dropped a bucket that is still limiting")
+	}
+}
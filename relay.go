@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/lrstanley/girc"
+)
+
+var errRelayEnd = errors.New("relay ends look like network:#channel")
+
+// relayNickColors are the mIRC colours nicks are drawn in, leaving out
+// white, black and the greys that are hard to read on one background or
+// the other.
+var relayNickColors = []int{2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13} //nolint: mnd,gomnd
+
+type RelayEnd struct {
+	Network string
+	Channel string
+}
+
+var (
+	relaysMu     sync.RWMutex
+	relays       = make(map[string]Relay)
+	relaysConfig map[string]Relay
+)
+
+// setRelays replaces the relays, it is called at startup and on reload.
+func setRelays(updated map[string]Relay) {
+	relaysMu.Lock()
+	defer relaysMu.Unlock()
+
+	relaysConfig = updated
+	relays = make(map[string]Relay, len(updated))
+
+	for name, relay := range updated {
+		if _, err := relay.parseEnds(); err != nil {
+			slog.Error("relay", "relay", name, "error", err)
+
+			continue
+		}
+
+		relays[name] = relay
+	}
+}
+
+// relaysDiffer tells whether the relays in the config changed.
+func relaysDiffer(updated map[string]Relay) bool {
+	relaysMu.RLock()
+	defer relaysMu.RUnlock()
+
+	if len(updated) == 0 && len(relaysConfig) == 0 {
+		return false
+	}
+
+	return !reflect.DeepEqual(updated, relaysConfig)
+}
+
+func getRelays() map[string]Relay {
+	relaysMu.RLock()
+	defer relaysMu.RUnlock()
+
+	return relays
+}
+
+func (relay Relay) parseEnds() ([]RelayEnd, error) {
+	ends := make([]RelayEnd, 0, len(relay.Ends))
+
+	for _, end := range relay.Ends {
+		network, channel, found := strings.Cut(end, ":")
+		if !found || network == "" || !girc.IsValidChannel(channel) {
+			return nil, fmt.Errorf("%w: %q", errRelayEnd, end)
+		}
+
+		ends = append(ends, RelayEnd{Network: network, Channel: channel})
+	}
+
+	if len(ends) < 2 { //nolint: mnd,gomnd
+		return nil, fmt.Errorf("%w, and a relay needs at least two", errRelayEnd)
+	}
+
+	return ends, nil
+}
+
+// relayChannels are the channels a network has to be in for the relays.
+func relayChannels(networkName string) [][]string {
+	var channels [][]string
+
+	for _, relay := range getRelays() {
+		ends, _ := relay.parseEnds()
+
+		for _, end := range ends {
+			if end.Network == networkName {
+				channels = append(channels, []string{end.Channel})
+			}
+		}
+	}
+
+	return channels
+}
+
+// targets returns where a message from the given end goes. A one-way relay
+// only sends from its first end to the others.
+func (relay Relay) targets(from RelayEnd) []RelayEnd {
+	ends, err := relay.parseEnds()
+	if err != nil {
+		return nil
+	}
+
+	index := slices.IndexFunc(ends, func(end RelayEnd) bool {
+		return end.Network == from.Network && strings.EqualFold(end.Channel, from.Channel)
+	})
+
+	if index < 0 || (relay.OneWay && index != 0) {
+		return nil
+	}
+
+	return slices.Delete(ends, index, index+1)
+}
+
+func (relay Relay) ignores(event girc.Event) bool {
+	for _, pattern := range relay.Ignore {
+		if strings.EqualFold(pattern, event.Source.Name) || matchGlob(pattern, event.Source.String()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func colorNick(nick string) string {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(strings.ToLower(nick)))
+
+	color := relayNickColors[hash.Sum32()%uint32(len(relayNickColors))]
+
+	return fmt.Sprintf("\x03%02d%s\x03", color, nick)
+}
+
+func relayNick(relay Relay, nick, network string) string {
+	if relay.NoColors {
+		return nick + "@" + network
+	}
+
+	return colorNick(nick) + "@" + network
+}
+
+// relayEvent turns an event into the line sent to the other ends, or ""
+// if the event isn't relayed.
+func relayEvent(relay Relay, event girc.Event, network string) string {
+	nick := relayNick(relay, event.Source.Name, network)
+
+	switch event.Command {
+	case girc.PRIVMSG:
+		if ok, ctcp := event.IsCTCP(); ok {
+			if ctcp.Command != girc.CTCP_ACTION {
+				return ""
+			}
+
+			return fmt.Sprintf("* %s %s", nick, ctcp.Text)
+		}
+
+		return fmt.Sprintf("<%s> %s", nick, event.Last())
+	case girc.JOIN:
+		if !relay.JoinPart {
+			return ""
+		}
+
+		return fmt.Sprintf("--> %s joined %s", nick, event.Params[0])
+	case girc.PART:
+		if !relay.JoinPart {
+			return ""
+		}
+
+		reason := ""
+		if len(event.Params) > 1 {
+			reason = " (" + event.Last() + ")"
+		}
+
+		return fmt.Sprintf("<-- %s left %s%s", nick, event.Params[0], reason)
+	}
+
+	return ""
+}
+
+// relayHandler mirrors what is said in a relayed channel to the other ends
+// of the relay. The bot's own messages are never relayed, that is what
+// keeps relayed lines from going around in circles.
+func relayHandler(networkName string) func(*girc.Client, girc.Event) {
+	return func(client *girc.Client, event girc.Event) {
+		if event.Source == nil || len(event.Params) == 0 || strings.EqualFold(event.Source.Name, client.GetNick()) {
+			return
+		}
+
+		from := RelayEnd{Network: networkName, Channel: event.Params[0]}
+
+		for name, relay := range getRelays() {
+			targets := relay.targets(from)
+			if len(targets) == 0 || relay.ignores(event) {
+				continue
+			}
+
+			line := relayEvent(relay, event, networkName)
+			if line == "" {
+				continue
+			}
+
+			for _, target := range targets {
+				network := getNetwork(target.Network)
+				if network == nil || !network.Client.IsConnected() || !network.Client.IsInChannel(target.Channel) {
+					slog.Warn("relay target unreachable", "relay", name, "network", target.Network, "channel", target.Channel)
+
+					continue
+				}
+
+				QueueMessage(network.Client, PriorityBulk, target.Channel, line)
+			}
+		}
+	}
+}
+
+// syncRelayChannels joins the channels a network needs for relays that were
+// added and parts the ones nothing in the config needs anymore.
+func syncRelayChannels(network *Network, old [][]string) []string {
+	var changes []string
+
+	wanted := configChannels(network.Config.current())
+
+	for _, channel := range old {
+		if _, ok := wanted[strings.ToLower(channel[0])]; !ok {
+			IrcPart(network.Client, channel[0])
+
+			changes = append(changes, network.Name+": parted "+channel[0])
+		}
+	}
+
+	for _, channel := range relayChannels(network.Name) {
+		if !slices.ContainsFunc(old, func(oldChannel []string) bool { return strings.EqualFold(oldChannel[0], channel[0]) }) {
+			IrcJoin(network.Client, channel)
+
+			changes = append(changes, network.Name+": joined "+channel[0])
+		}
+	}
+
+	return changes
+}
+
+func setupRelays(irc *girc.Client, appConfig *TomlConfig) {
+	handler := relayHandler(appConfig.IRCDName)
+
+	irc.Handlers.AddBg(girc.PRIVMSG, handler)
+	irc.Handlers.AddBg(girc.JOIN, handler)
+	irc.Handlers.AddBg(girc.PART, handler)
+}
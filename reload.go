@@ -0,0 +1,404 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/lrstanley/girc"
+)
+
+var (
+	configFile string
+	reloadMu   sync.Mutex
+)
+
+// reconnectOptions only take effect on a new connection. If one of them
+// changes the network is restarted, everything else is applied in place.
+var reconnectOptions = map[string]bool{
+	"ircServer":          true,
+	"ircPort":            true,
+	"useTLS":             true,
+	"skipTLSVerify":      true,
+	"ircProxy":           true,
+	"bind":               true,
+	"serverPass":         true,
+	"name":               true,
+	"enableSasl":         true,
+	"ircSaslUser":        true,
+	"ircSaslPass":        true,
+	"saslMechanism":      true,
+	"clientCertPath":     true,
+	"clientKeyPath":      true,
+	"webIRCPassword":     true,
+	"webIRCGateway":      true,
+	"webIRCHostname":     true,
+	"webIRCAddress":      true,
+	"provider":           true,
+	"allowFlood":         true,
+	"disableSTSFallback": true,
+	"databaseAddress":    true,
+	"databaseUser":       true,
+	"databasePassword":   true,
+	"databaseName":       true,
+	"pingDelay":          true,
+	"pingTimeout":        true,
+	"debug":              true,
+	"out":                true,
+}
+
+// decodeConfig reads the config file without resolving secrets or filling
+// in defaults. The metadata says which keys were not used.
+func decodeConfig(path string) (AppConfig, toml.MetaData, error) {
+	var config AppConfig
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, toml.MetaData{}, err
+	}
+
+	meta, err := toml.Decode(string(data), &config)
+
+	return config, meta, err
+}
+
+func addNetworkDefaults(config *AppConfig) {
+	for key, value := range config.Ircd {
+		AddSaneDefaults(&value)
+		value.IRCDName = key
+		config.Ircd[key] = value
+	}
+}
+
+func loadConfig(path string) (AppConfig, error) {
+	config, meta, err := decodeConfig(path)
+	if err != nil {
+		return config, err
+	}
+
+	for _, key := range meta.Undecoded() {
+		slog.Warn("unknown config key, run milla check for more", "key", key.String())
+	}
+
+	if err := resolveSecrets(reflect.ValueOf(&config).Elem(), ""); err != nil {
+		return config, err
+	}
+
+	addNetworkDefaults(&config)
+
+	return config, nil
+}
+
+func tomlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+
+	return name
+}
+
+// changedReconnectOptions lists the reconnect options that differ.
+func changedReconnectOptions(running, updated *TomlConfig) []string {
+	var changed []string
+
+	runningValue := reflect.ValueOf(running).Elem()
+	updatedValue := reflect.ValueOf(updated).Elem()
+
+	for i := range runningValue.NumField() {
+		name := tomlName(runningValue.Type().Field(i))
+		if !reconnectOptions[name] {
+			continue
+		}
+
+		if !reflect.DeepEqual(runningValue.Field(i).Interface(), updatedValue.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+
+	return changed
+}
+
+// copyConfigOptions copies every option that comes from the config file.
+// Fields without a toml tag are runtime state and are left alone.
+func copyConfigOptions(running *TomlConfig, updated TomlConfig) {
+	runningValue := reflect.ValueOf(running).Elem()
+	updatedValue := reflect.ValueOf(updated)
+
+	for i := range runningValue.NumField() {
+		field := runningValue.Type().Field(i)
+		if !field.IsExported() || tomlName(field) == "" {
+			continue
+		}
+
+		runningValue.Field(i).Set(updatedValue.Field(i))
+	}
+}
+
+// configChannels returns every channel the config asks the bot to be in,
+// keyed by the lowercased name. Channels the bot was told to leave at
+// runtime are left out, wherever in the config they come from.
+func configChannels(appConfig *TomlConfig) map[string][]string {
+	channels := make(map[string][]string)
+
+	add := func(channel []string) {
+		if len(channel) > 0 && channel[0] != "" {
+			channels[strings.ToLower(channel[0])] = channel
+		}
+	}
+
+	for _, channel := range appConfig.IrcChannels {
+		add(channel)
+	}
+
+	for _, channel := range appConfig.ScrapeChannels {
+		add(channel)
+	}
+
+	for _, watchlist := range appConfig.WatchLists {
+		add(watchlist.AlertChannel)
+
+		for _, channel := range watchlist.WatchList {
+			add(channel)
+		}
+	}
+
+	for _, rss := range appConfig.Rss {
+		add(rss.Channel)
+	}
+
+	for _, schedule := range appConfig.Schedules {
+		add(schedule.Channel)
+	}
+
+	for _, channel := range relayChannels(appConfig.IRCDName) {
+		add(channel)
+	}
+
+	if appConfig.overrides != nil {
+		for _, override := range appConfig.overrides.List() {
+			if override.Kind == OverrideLeave {
+				delete(channels, strings.ToLower(override.Name))
+			}
+		}
+	}
+
+	return channels
+}
+
+func reloadPlugins(appConfig *TomlConfig, client *girc.Client, oldPlugins []string) {
+	for _, scriptPath := range oldPlugins {
+		unloadPlugin(appConfig, scriptPath)
+	}
+
+	LoadAllPlugins(appConfig, client)
+}
+
+// applyConfig swaps a new version of the config in for a running network
+// and brings the network in line with it.
+func applyConfig(network *Network, updated TomlConfig) []string {
+	client := network.Client
+	running := network.Config.current()
+
+	var changes []string
+
+	oldChannels := configChannels(running)
+	oldPlugins := slices.Clone(running.Plugins)
+	oldNick := running.IrcNick
+	hadRss := len(running.Rss) > 0
+
+	_ = network.Config.update(func(next *TomlConfig) error {
+		copyConfigOptions(next, updated)
+
+		next.queryLimiter = newRateLimiter(next.PrivateRateLimit, next.PrivateRateBurst)
+
+		populateWatchListWords(next)
+
+		return nil
+	})
+
+	appConfig := network.Config.current()
+
+	if appConfig.ignoreList != nil {
+		appConfig.ignoreList.RemoveFromConfig()
+		seedIgnores(appConfig)
+	}
+
+	newChannels := configChannels(appConfig)
+
+	for key, channel := range oldChannels {
+		if _, ok := newChannels[key]; !ok {
+			IrcPart(client, channel[0])
+
+			changes = append(changes, "parted "+channel[0])
+		}
+	}
+
+	for key, channel := range newChannels {
+		if _, ok := oldChannels[key]; !ok {
+			IrcJoin(client, channel)
+
+			changes = append(changes, "joined "+channel[0])
+		}
+	}
+
+	if !strings.EqualFold(oldNick, appConfig.IrcNick) {
+		client.Cmd.Nick(appConfig.IrcNick)
+
+		changes = append(changes, "nick changed to "+appConfig.IrcNick)
+	}
+
+	// reloading throws away the state of every lua plugin, only do it when
+	// the list of plugins changed.
+	if !slices.Equal(oldPlugins, appConfig.Plugins) {
+		reloadPlugins(network.Config, client, oldPlugins)
+
+		changes = append(changes, "reloaded plugins")
+	}
+
+	if !hadRss && len(appConfig.Rss) > 0 {
+		go runRSS(network.ctx, network.Config, client)
+	} else {
+		restartRSS(network.ctx, network.Config, client)
+	}
+
+	sort.Strings(changes)
+
+	return append(changes, "reloaded")
+}
+
+// ReloadConfig reads the config file again and applies it. Networks that
+// were removed are stopped, new ones started, and networks whose connection
+// options changed are reconnected. Everything else keeps its connection.
+func ReloadConfig() ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not reload %s: %w", configFile, err)
+	}
+
+	setupLogging(config)
+
+	var changes []string
+
+	relaysChanged := relaysDiffer(config.Relays)
+
+	oldRelayChannels := make(map[string][][]string)
+	for _, network := range getNetworks() {
+		oldRelayChannels[network.Name] = relayChannels(network.Name)
+	}
+
+	if relaysChanged {
+		setRelays(config.Relays)
+
+		changes = append(changes, "relays updated")
+	}
+
+	handled := make(map[string]bool)
+
+	for _, network := range getNetworks() {
+		handled[network.Name] = true
+
+		updated, ok := config.Ircd[network.Name]
+		if ok {
+			// runtime overrides stay on top of the config file.
+			updated.overrides = network.Config.current().overrides
+			applyOverrides(&updated)
+		}
+
+		if !ok || updated.IrcServer == "" {
+			network.Stop("removed from the config")
+
+			changes = append(changes, network.Name+": stopped")
+
+			continue
+		}
+
+		if changed := changedReconnectOptions(network.Config.current(), &updated); len(changed) > 0 {
+			network.Stop("reconnecting to apply config changes")
+			startNetwork(updated)
+
+			changes = append(changes, fmt.Sprintf("%s: reconnecting, changed %s", network.Name, strings.Join(changed, ", ")))
+
+			continue
+		}
+
+		for _, change := range applyConfig(network, updated) {
+			changes = append(changes, network.Name+": "+change)
+		}
+	}
+
+	if sinksDiffer(config.Sinks) {
+		setSinks(config.Sinks)
+
+		changes = append(changes, "sinks updated")
+	}
+
+	if metricsListenDiffers(config.Metrics.Listen) {
+		setMetricsListen(config.Metrics.Listen)
+
+		changes = append(changes, "metrics listener updated")
+	}
+
+	if adminAPIDiffers(config.Admin) {
+		setAdminAPI(config.Admin)
+
+		changes = append(changes, "admin api updated")
+	}
+
+	if webhooksDiffer(config.Webhooks) {
+		setWebhooks(config.Webhooks)
+
+		changes = append(changes, "webhooks updated")
+	}
+
+	if relaysChanged {
+		for _, network := range getNetworks() {
+			changes = append(changes, syncRelayChannels(network, oldRelayChannels[network.Name])...)
+		}
+	}
+
+	for name, updated := range config.Ircd {
+		if handled[name] {
+			continue
+		}
+
+		startNetwork(updated)
+
+		changes = append(changes, name+": started")
+	}
+
+	for name, ghost := range config.Ghost {
+		running, ok := getGhostConfig(name)
+		if ok && reflect.DeepEqual(running, ghost) {
+			continue
+		}
+
+		if ok {
+			StopGhost(name)
+		}
+
+		go RunGhost(ghost, name)
+
+		changes = append(changes, "ghost "+name+": started")
+	}
+
+	for _, name := range runningGhosts() {
+		if _, ok := config.Ghost[name]; !ok {
+			StopGhost(name)
+
+			changes = append(changes, "ghost "+name+": stopped")
+		}
+	}
+
+	for _, change := range changes {
+		slog.Info("reload", "change", change)
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+const (
+	reminderCheckInterval = 5 * time.Second
+	reminderTimeLayout    = "2006-01-02 15:04 MST"
+)
+
+var (
+	errInvalidReminderTime = errors.New("when? use something like 10m, 2h30m, tomorrow 09:00, 18:30 or 2025-12-24 18:00")
+	errReminderInPast      = errors.New("that is in the past")
+	errNoReminder          = errors.New("no such reminder")
+	errUnknownTimezone     = errors.New("unknown timezone, use a name like Europe/Berlin or America/New_York")
+)
+
+type Reminder struct {
+	ID      int64
+	Nick    string
+	Target  string
+	Message string
+	Due     time.Time
+	// stored is set once the reminder is in the database.
+	stored bool
+}
+
+// Reminders are kept in memory and in the reminders table, so the ones that
+// are still pending survive restarts.
+type Reminders struct {
+	mu        sync.Mutex
+	reminders []Reminder
+	timezones map[string]string
+	lastID    int64
+}
+
+func NewReminders() *Reminders {
+	return &Reminders{timezones: make(map[string]string)}
+}
+
+func (reminders *Reminders) Add(reminder Reminder) Reminder {
+	reminders.mu.Lock()
+	defer reminders.mu.Unlock()
+
+	if reminder.ID == 0 {
+		reminder.ID = reminders.lastID + 1
+	}
+
+	reminders.lastID = max(reminders.lastID, reminder.ID)
+	reminders.reminders = append(reminders.reminders, reminder)
+
+	return reminder
+}
+
+func (reminders *Reminders) Remove(id int64) (Reminder, bool) {
+	reminders.mu.Lock()
+	defer reminders.mu.Unlock()
+
+	index := slices.IndexFunc(reminders.reminders, func(reminder Reminder) bool { return reminder.ID == id })
+	if index < 0 {
+		return Reminder{}, false
+	}
+
+	reminder := reminders.reminders[index]
+	reminders.reminders = slices.Delete(reminders.reminders, index, index+1)
+
+	return reminder, true
+}
+
+// Replace swaps the reminders for the ones loaded from the database and
+// returns the ones that were only kept in memory.
+func (reminders *Reminders) Replace(loaded []Reminder) []Reminder {
+	reminders.mu.Lock()
+	defer reminders.mu.Unlock()
+
+	var memoryOnly []Reminder
+
+	for _, reminder := range reminders.reminders {
+		if !reminder.stored {
+			memoryOnly = append(memoryOnly, reminder)
+		}
+	}
+
+	reminders.reminders = loaded
+
+	for _, reminder := range loaded {
+		reminders.lastID = max(reminders.lastID, reminder.ID)
+	}
+
+	return memoryOnly
+}
+
+func (reminders *Reminders) Get(id int64) (Reminder, bool) {
+	reminders.mu.Lock()
+	defer reminders.mu.Unlock()
+
+	for _, reminder := range reminders.reminders {
+		if reminder.ID == id {
+			return reminder, true
+		}
+	}
+
+	return Reminder{}, false
+}
+
+// For returns a nick's reminders, the next one first.
+func (reminders *Reminders) For(nick string) []Reminder {
+	reminders.mu.Lock()
+	defer reminders.mu.Unlock()
+
+	var found []Reminder
+
+	for _, reminder := range reminders.reminders {
+		if strings.EqualFold(reminder.Nick, nick) {
+			found = append(found, reminder)
+		}
+	}
+
+	slices.SortFunc(found, func(a, b Reminder) int { return a.Due.Compare(b.Due) })
+
+	return found
+}
+
+func (reminders *Reminders) Due(now time.Time) []Reminder {
+	reminders.mu.Lock()
+	defer reminders.mu.Unlock()
+
+	var due []Reminder
+
+	for _, reminder := range reminders.reminders {
+		if !now.Before(reminder.Due) {
+			due = append(due, reminder)
+		}
+	}
+
+	return due
+}
+
+func (reminders *Reminders) SetTimezone(nick, timezone string) {
+	reminders.mu.Lock()
+	defer reminders.mu.Unlock()
+
+	reminders.timezones[strings.ToLower(nick)] = timezone
+}
+
+// Location is the nick's timezone, or the network's default if the nick
+// didn't set one.
+func (reminders *Reminders) Location(appConfig *TomlConfig, nick string) *time.Location {
+	reminders.mu.Lock()
+	timezone, ok := reminders.timezones[strings.ToLower(nick)]
+	reminders.mu.Unlock()
+
+	if !ok {
+		timezone = appConfig.DefaultTimezone
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.UTC
+	}
+
+	return location
+}
+
+// parseClock parses 9, 09:00 or 9:30.
+func parseClock(text string) (int, int, bool) {
+	hourText, minuteText, found := strings.Cut(text, ":")
+	if !found {
+		minuteText = "0"
+	}
+
+	hour, err := strconv.Atoi(hourText)
+	if err != nil || hour < 0 || hour > 23 {
+		return 0, 0, false
+	}
+
+	minute, err := strconv.Atoi(minuteText)
+	if err != nil || minute < 0 || minute > 59 {
+		return 0, 0, false
+	}
+
+	return hour, minute, true
+}
+
+// parseReminderTime reads the time at the start of args and returns it with
+// the words that are left. It understands durations (10m, 2h30m, 1d, or
+// plain seconds), today or tomorrow with a time, a time of day, which means
+// the next time the clock shows it, and absolute dates like 2025-12-24 18:00.
+func parseReminderTime(args []string, now time.Time, location *time.Location) (time.Time, []string, error) {
+	if len(args) == 0 {
+		return time.Time{}, nil, errInvalidReminderTime
+	}
+
+	now = now.In(location)
+	word := strings.ToLower(args[0])
+
+	if seconds, err := strconv.Atoi(word); err == nil {
+		return now.Add(time.Duration(seconds) * time.Second), args[1:], nil
+	}
+
+	if duration, err := parseDuration(word); err == nil {
+		return now.Add(duration), args[1:], nil
+	}
+
+	if word == "today" || word == "tomorrow" {
+		hour, minute := 9, 0 //nolint: mnd,gomnd
+		rest := args[1:]
+
+		if len(rest) > 0 {
+			if h, m, ok := parseClock(rest[0]); ok {
+				hour, minute = h, m
+				rest = rest[1:]
+			}
+		}
+
+		day := now
+		if word == "tomorrow" {
+			day = now.AddDate(0, 0, 1)
+		}
+
+		due := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, location)
+
+		return due, rest, nil
+	}
+
+	if hour, minute, ok := parseClock(word); ok && strings.Contains(word, ":") {
+		due := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, location)
+		if !due.After(now) {
+			due = due.AddDate(0, 0, 1)
+		}
+
+		return due, args[1:], nil
+	}
+
+	if len(args) > 1 {
+		if due, err := time.ParseInLocation("2006-01-02 15:04", args[0]+" "+args[1], location); err == nil {
+			return due, args[2:], nil
+		}
+	}
+
+	for _, layout := range []string{"2006-01-02T15:04", time.RFC3339} {
+		if due, err := time.ParseInLocation(layout, args[0], location); err == nil {
+			return due, args[1:], nil
+		}
+	}
+
+	if due, err := time.ParseInLocation("2006-01-02", args[0], location); err == nil {
+		return due.Add(9 * time.Hour), args[1:], nil //nolint: mnd,gomnd
+	}
+
+	return time.Time{}, nil, errInvalidReminderTime
+}
+
+func createRemindersTables(appConfig *TomlConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx, `create table if not exists reminders (
+			id serial primary key,
+			network text not null,
+			nick text not null,
+			target text not null,
+			message text not null,
+			due timestamptz not null
+		)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = appConfig.pool.Exec(ctx, `create table if not exists reminder_timezones (
+			network text not null,
+			nick text not null,
+			timezone text not null,
+			primary key (network, nick)
+		)`)
+
+	return err
+}
+
+func loadReminders(appConfig *TomlConfig) {
+	if appConfig.pool == nil || appConfig.reminders == nil {
+		return
+	}
+
+	if err := createRemindersTables(appConfig); err != nil {
+		LogError(err)
+
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	rows, err := appConfig.pool.Query(ctx,
+		"select id, nick, target, message, due from reminders where network = $1", appConfig.IRCDName)
+	if err != nil {
+		LogError(err)
+
+		return
+	}
+	defer rows.Close()
+
+	var loaded []Reminder
+
+	for rows.Next() {
+		reminder := Reminder{stored: true}
+
+		if err := rows.Scan(&reminder.ID, &reminder.Nick, &reminder.Target, &reminder.Message, &reminder.Due); err != nil {
+			LogError(err)
+
+			continue
+		}
+
+		loaded = append(loaded, reminder)
+	}
+
+	// the reminders in memory are only swapped out once the whole table
+	// was read, a failed query keeps them.
+	if err := rows.Err(); err != nil {
+		LogError(err)
+
+		return
+	}
+
+	memoryOnly := appConfig.reminders.Replace(loaded)
+
+	slog.Info("loaded reminders", "network", appConfig.IRCDName, "count", len(loaded))
+
+	// reminders made before the database was up get an id from it now.
+	for _, reminder := range memoryOnly {
+		reminder.ID = 0
+
+		if _, err := saveReminder(appConfig, reminder); err != nil {
+			LogError(err)
+		}
+	}
+
+	rows, err = appConfig.pool.Query(ctx,
+		"select nick, timezone from reminder_timezones where network = $1", appConfig.IRCDName)
+	if err != nil {
+		LogError(err)
+
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var nick, timezone string
+
+		if err := rows.Scan(&nick, &timezone); err != nil {
+			LogError(err)
+
+			continue
+		}
+
+		appConfig.reminders.SetTimezone(nick, timezone)
+	}
+}
+
+// saveReminder stores a reminder and returns it with the id the database
+// gave it. Without a database the reminder only lives until a restart.
+func saveReminder(appConfig *TomlConfig, reminder Reminder) (Reminder, error) {
+	if appConfig.pool == nil {
+		return appConfig.reminders.Add(reminder), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	err := appConfig.pool.QueryRow(ctx,
+		"insert into reminders (network, nick, target, message, due) values ($1, $2, $3, $4, $5) returning id",
+		appConfig.IRCDName, reminder.Nick, reminder.Target, reminder.Message, reminder.Due).Scan(&reminder.ID)
+	if err != nil {
+		return reminder, err
+	}
+
+	reminder.stored = true
+
+	return appConfig.reminders.Add(reminder), nil
+}
+
+func deleteReminder(appConfig *TomlConfig, id int64) error {
+	appConfig.reminders.Remove(id)
+
+	if appConfig.pool == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx, "delete from reminders where network = $1 and id = $2", appConfig.IRCDName, id)
+
+	return err
+}
+
+func saveTimezone(appConfig *TomlConfig, nick, timezone string) error {
+	appConfig.reminders.SetTimezone(nick, timezone)
+
+	if appConfig.pool == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx,
+		`insert into reminder_timezones (network, nick, timezone) values ($1, lower($2), $3)
+			on conflict (network, nick) do update set timezone = excluded.timezone`,
+		appConfig.IRCDName, nick, timezone)
+
+	return err
+}
+
+// deliverReminders sends the reminders that are due. Reminders for a
+// channel the bot isn't in go to the nick instead.
+func deliverReminders(client *girc.Client, appConfig *TomlConfig) {
+	if !client.IsConnected() {
+		return
+	}
+
+	for _, reminder := range appConfig.reminders.Due(time.Now()) {
+		target := reminder.Target
+		message := "Ping!"
+
+		if reminder.Message != "" {
+			message = reminder.Message
+		}
+
+		if girc.IsValidChannel(target) {
+			if client.IsInChannel(target) {
+				message = reminder.Nick + ": " + message
+			} else {
+				target = reminder.Nick
+			}
+		}
+
+		QueueMessage(client, PriorityInteractive, target, message)
+
+		if err := deleteReminder(appConfig, reminder.ID); err != nil {
+			LogError(err)
+		}
+	}
+}
+
+func setupReminders(ctx context.Context, irc *girc.Client, appConfig *TomlConfig) {
+	appConfig.reminders = NewReminders()
+
+	go func() {
+		ticker := time.NewTicker(reminderCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				deliverReminders(irc, appConfig.current())
+			}
+		}
+	}()
+}
+
+// handleRemindCommand runs /remind. Reminders made in a channel are
+// delivered there unless they start with "private".
+func handleRemindCommand(args []string, client *girc.Client, event girc.Event, appConfig *TomlConfig) {
+	nick := event.Source.Name
+	location := appConfig.reminders.Location(appConfig, nick)
+
+	if len(args) < 2 { //nolint: mnd,gomnd
+		QueueReply(client, event, errNotEnoughArgs.Error())
+
+		return
+	}
+
+	switch args[1] {
+	case "list":
+		reminders := appConfig.reminders.For(nick)
+		if len(reminders) == 0 {
+			QueueReply(client, event, "you have no reminders")
+
+			return
+		}
+
+		// the list has the private reminders in it too, so it never goes to
+		// a channel.
+		if !isPrivateMessage(event) {
+			QueueReply(client, event, "sent you your reminders in private")
+		}
+
+		for _, reminder := range reminders {
+			QueueMessage(client, PriorityInteractive, nick, fmt.Sprintf("%d: %s in %s: %s",
+				reminder.ID, reminder.Due.In(location).Format(reminderTimeLayout), reminder.Target, reminder.Message))
+		}
+
+		return
+	case "cancel":
+		if len(args) < 3 { //nolint: mnd,gomnd
+			QueueReply(client, event, errNotEnoughArgs.Error())
+
+			return
+		}
+
+		id, err := strconv.ParseInt(strings.TrimPrefix(args[2], "#"), 10, 64)
+		if err != nil {
+			QueueReply(client, event, errNoReminder.Error())
+
+			return
+		}
+
+		reminder, ok := appConfig.reminders.Get(id)
+		if !ok || (!strings.EqualFold(reminder.Nick, nick) && !checkAdmin(client, event, appConfig, "delete reminder")) {
+			QueueReply(client, event, errNoReminder.Error())
+
+			return
+		}
+
+		if err := deleteReminder(appConfig, id); err != nil {
+			LogError(err)
+		}
+
+		QueueReply(client, event, fmt.Sprintf("cancelled reminder %d", id))
+
+		return
+	case "tz", "timezone":
+		if len(args) < 3 { //nolint: mnd,gomnd
+			QueueReply(client, event, "your timezone is "+location.String())
+
+			return
+		}
+
+		if _, err := time.LoadLocation(args[2]); err != nil {
+			QueueReply(client, event, errUnknownTimezone.Error())
+
+			return
+		}
+
+		if err := saveTimezone(appConfig, nick, args[2]); err != nil {
+			LogError(err)
+		}
+
+		QueueReply(client, event, "your timezone is now "+args[2])
+
+		return
+	}
+
+	rest := args[1:]
+	target := event.Params[0]
+
+	if isPrivateMessage(event) {
+		target = nick
+	}
+
+	if rest[0] == "private" {
+		target = nick
+		rest = rest[1:]
+	}
+
+	due, rest, err := parseReminderTime(rest, time.Now(), location)
+	if err != nil {
+		QueueReply(client, event, err.Error())
+
+		return
+	}
+
+	if !due.After(time.Now()) {
+		QueueReply(client, event, errReminderInPast.Error())
+
+		return
+	}
+
+	reminder, err := saveReminder(appConfig, Reminder{
+		Nick:    nick,
+		Target:  target,
+		Message: strings.Join(rest, " "),
+		Due:     due,
+	})
+	if err != nil {
+		LogError(err)
+		QueueReply(client, event, "could not save the reminder: "+err.Error())
+
+		return
+	}
+
+	QueueReply(client, event, fmt.Sprintf("Ok, I'll remind you on %s (reminder %d).",
+		reminder.Due.In(location).Format(reminderTimeLayout), reminder.ID))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseReminderTime(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no timezone data:", err)
+	}
+
+	now := time.Date(2025, 6, 10, 14, 0, 0, 0, berlin)
+
+	tests := []struct {
+		args []string
+		due  time.Time
+		rest []string
+		err  error
+	}{
+		{[]string{"10m", "tea"}, now.Add(10 * time.Minute), []string{"tea"}, nil},
+		{[]string{"2h30m"}, now.Add(150 * time.Minute), []string{}, nil},
+		{[]string{"1d", "call", "mum"}, now.Add(24 * time.Hour), []string{"call", "mum"}, nil},
+		{[]string{"1200"}, now.Add(20 * time.Minute), []string{}, nil},
+		{[]string{"tomorrow", "renew"}, time.Date(2025, 6, 11, 9, 0, 0, 0, berlin), []string{"renew"}, nil},
+		{[]string{"tomorrow", "18:30", "x"}, time.Date(2025, 6, 11, 18, 30, 0, 0, berlin), []string{"x"}, nil},
+		{[]string{"today", "9"}, time.Date(2025, 6, 10, 9, 0, 0, 0, berlin), []string{}, nil},
+		{[]string{"18:30"}, time.Date(2025, 6, 10, 18, 30, 0, 0, berlin), []string{}, nil},
+		{[]string{"13:00"}, time.Date(2025, 6, 11, 13, 0, 0, 0, berlin), []string{}, nil},
+		{[]string{"2025-12-24", "18:00", "gifts"}, time.Date(2025, 12, 24, 18, 0, 0, 0, berlin), []string{"gifts"}, nil},
+		{[]string{"2025-12-24T18:00"}, time.Date(2025, 12, 24, 18, 0, 0, 0, berlin), []string{}, nil},
+		{[]string{"2025-12-24"}, time.Date(2025, 12, 24, 9, 0, 0, 0, berlin), []string{}, nil},
+		{[]string{"25:00"}, time.Time{}, nil, errInvalidReminderTime},
+		{[]string{"soon"}, time.Time{}, nil, errInvalidReminderTime},
+		{nil, time.Time{}, nil, errInvalidReminderTime},
+	}
+
+	for _, test := range tests {
+		due, rest, err := parseReminderTime(test.args, now, berlin)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%q: got error %v, want %v", test.args, err, test.err)
+
+			continue
+		}
+
+		if !due.Equal(test.due) || !slices.Equal(rest, test.rest) {
+			t.Errorf("%q: got %v %q, want %v %q", test.args, due, rest, test.due, test.rest)
+		}
+	}
+}
+
+func TestRemindersReplace(t *testing.T) {
+	reminders := NewReminders()
+
+	reminders.Add(Reminder{Nick: "nick", Message: "memory only"})
+	reminders.Add(Reminder{ID: 7, Nick: "nick", Message: "stored", stored: true})
+
+	memoryOnly := reminders.Replace([]Reminder{{ID: 7, Nick: "nick", Message: "stored", stored: true}})
+	if len(memoryOnly) != 1 || memoryOnly[0].Message != "memory only" {
+		t.Fatalf("got %+v, want only the reminder that was never stored", memoryOnly)
+	}
+
+	if got := reminders.For("NICK"); len(got) != 1 || got[0].ID != 7 {
+		t.Errorf("got %+v, want the loaded reminder", got)
+	}
+
+	if added := reminders.Add(Reminder{Nick: "nick"}); added.ID != 8 {
+		t.Errorf("got id %d for a new reminder, want 8", added.ID)
+	}
+}
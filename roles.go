@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+const (
+	RoleOwner   = "owner"
+	RoleAdmin   = "admin"
+	RoleOp      = "op"
+	RoleTrusted = "trusted"
+	RoleUser    = "user"
+)
+
+// builtinRoleRanks are the ranks of the roles that exist without any config.
+// A role's rank can be changed and new roles added under [ircd.x.roles].
+var builtinRoleRanks = map[string]int{
+	RoleOwner:   100, //nolint: mnd,gomnd
+	RoleAdmin:   75,  //nolint: mnd,gomnd
+	RoleOp:      60,  //nolint: mnd,gomnd
+	RoleTrusted: 50,  //nolint: mnd,gomnd
+	RoleUser:    0,
+}
+
+// defaultPermissions are the roles built-in commands need unless the config
+// says otherwise. Every built-in command is listed, lua commands are open to
+// everyone.
+var defaultPermissions = map[string]string{
+	"set":       RoleAdmin,
+	"get":       RoleAdmin,
+	"getall":    RoleAdmin,
+	"ignore":    RoleAdmin,
+	"join":      RoleAdmin,
+	"leave":     RoleAdmin,
+	"cmd":       RoleAdmin,
+	"load":      RoleAdmin,
+	"unload":    RoleAdmin,
+	"list":      RoleAdmin,
+	"ua":        RoleAdmin,
+	"reload":    RoleAdmin,
+	"diff":      RoleAdmin,
+	"revert":    RoleAdmin,
+	"kick":      RoleOp,
+	"ban":       RoleOp,
+	"unban":     RoleOp,
+	"quiet":     RoleOp,
+	"unquiet":   RoleOp,
+	"op":        RoleOp,
+	"voice":     RoleOp,
+	"topic":     RoleOp,
+	"mode":      RoleOp,
+	"help":      RoleUser,
+	"memstats":  RoleUser,
+	"channels":  RoleUser,
+	"queue":     RoleUser,
+	"schedules": RoleUser,
+	"summarize": RoleUser,
+	"links":     RoleUser,
+	"seen":      RoleUser,
+	"tell":      RoleUser,
+	"remind":    RoleUser,
+	"forget":    RoleUser,
+	"whois":     RoleUser,
+	"roll":      RoleUser,
+}
+
+// maxAliasDepth stops aliases that expand to each other.
+const maxAliasDepth = 8
+
+func isBuiltinCommand(command string) bool {
+	_, ok := defaultPermissions[command]
+
+	return ok
+}
+
+// expandAlias replaces an alias at the start of a command line with the
+// command it stands for, so the permission check sees the command that
+// actually runs. Built-in and lua commands win over aliases of the same
+// name.
+func expandAlias(appConfig *TomlConfig, cmd string) string {
+	for range maxAliasDepth {
+		name, _, _ := strings.Cut(cmd, " ")
+		if isBuiltinCommand(name) {
+			return cmd
+		}
+
+		if _, ok := appConfig.LuaCommands[name]; ok {
+			return cmd
+		}
+
+		alias, ok := appConfig.Aliases[name]
+		if !ok {
+			return cmd
+		}
+
+		cmd, _ = splitCommand(strings.TrimSpace(alias.Alias), []string{commandMarker})
+	}
+
+	slog.Warn("alias expands too many times", "network", appConfig.IRCDName, "alias", cmd)
+
+	return cmd
+}
+
+func roleRank(appConfig *TomlConfig, role string) (int, bool) {
+	if configured, ok := appConfig.Roles[role]; ok && configured.Rank != 0 {
+		return configured.Rank, true
+	}
+
+	rank, ok := builtinRoleRanks[role]
+
+	return rank, ok
+}
+
+func roleAppliesTo(role Role, channel string) bool {
+	if len(role.Channels) == 0 {
+		return true
+	}
+
+	for _, roleChannel := range role.Channels {
+		if strings.EqualFold(roleChannel, channel) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isChannelOp reports whether the source of an event has op, or higher, in
+// a channel according to girc's state.
+func isChannelOp(client *girc.Client, event girc.Event, channel string) bool {
+	if channel == "" || event.Source == nil || client == nil || !client.IsConnected() {
+		return false
+	}
+
+	user := client.LookupUser(event.Source.Name)
+	if user == nil || user.Perms == nil {
+		return false
+	}
+
+	perms, ok := user.Perms.Lookup(channel)
+
+	return ok && perms.IsAdmin()
+}
+
+// userRole returns the highest ranking role the source of an event has in a
+// channel. Admins from admins, adminAccounts and adminMasks always have at
+// least the admin role and channel operators the op role in their channel.
+func userRole(client *girc.Client, event girc.Event, appConfig *TomlConfig, channel string) (string, int) {
+	bestRole := RoleUser
+	bestRank, _ := roleRank(appConfig, RoleUser)
+
+	if isAdmin(client, event, appConfig) {
+		bestRole = RoleAdmin
+		bestRank, _ = roleRank(appConfig, RoleAdmin)
+	} else if isChannelOp(client, event, channel) {
+		bestRole = RoleOp
+		bestRank, _ = roleRank(appConfig, RoleOp)
+	}
+
+	if event.Source == nil {
+		return bestRole, bestRank
+	}
+
+	mask := event.Source.String()
+	account := ""
+	accountLooked := false
+
+	for name, role := range appConfig.Roles {
+		rank, _ := roleRank(appConfig, name)
+		if rank <= bestRank || !roleAppliesTo(role, channel) {
+			continue
+		}
+
+		matched := false
+
+		for _, roleMask := range role.Masks {
+			if matchGlob(roleMask, mask) {
+				matched = true
+
+				break
+			}
+		}
+
+		if !matched && len(role.Accounts) > 0 {
+			if !accountLooked {
+				account = sourceAccount(client, event)
+				accountLooked = true
+			}
+
+			for _, roleAccount := range role.Accounts {
+				if account != "" && strings.EqualFold(roleAccount, account) {
+					matched = true
+
+					break
+				}
+			}
+		}
+
+		if matched {
+			bestRole = name
+			bestRank = rank
+		}
+	}
+
+	return bestRole, bestRank
+}
+
+// requiredRole looks a command up in channelPermissions, then permissions
+// and finally the defaults.
+func requiredRole(appConfig *TomlConfig, channel, command string) string {
+	for permissionChannel, permissions := range appConfig.ChannelPermissions {
+		if !strings.EqualFold(permissionChannel, channel) {
+			continue
+		}
+
+		if role, ok := permissions[command]; ok {
+			return role
+		}
+	}
+
+	if role, ok := appConfig.Permissions[command]; ok {
+		return role
+	}
+
+	if role, ok := defaultPermissions[command]; ok {
+		return role
+	}
+
+	return RoleUser
+}
+
+// permissionName is the name a command goes by in the ACLs. Custom commands
+// and user agent actions can be given their own entries as "cmd:name" and
+// "ua:name", otherwise the entry for cmd or ua applies.
+func permissionName(appConfig *TomlConfig, channel string, args []string) string {
+	if len(args) < 2 || (args[0] != "cmd" && args[0] != "ua") { //nolint: mnd,gomnd
+		return args[0]
+	}
+
+	specific := args[0] + ":" + args[1]
+
+	for permissionChannel, permissions := range appConfig.ChannelPermissions {
+		if _, ok := permissions[specific]; ok && strings.EqualFold(permissionChannel, channel) {
+			return specific
+		}
+	}
+
+	if _, ok := appConfig.Permissions[specific]; ok {
+		return specific
+	}
+
+	return args[0]
+}
+
+// checkPermission decides whether the source of an event may run a command
+// in the channel the event came from.
+func checkPermission(client *girc.Client, event girc.Event, appConfig *TomlConfig, args []string) bool {
+	channel := ""
+	if !isPrivateMessage(event) && len(event.Params) > 0 {
+		channel = event.Params[0]
+	}
+
+	return checkPermissionIn(client, event, appConfig, channel, args)
+}
+
+// checkPermissionIn is checkPermission for commands that act on another
+// channel. Denied attempts get the same error every time. Denials and uses
+// of commands that need more than the user role are logged and audited.
+// With adminOnly set every command needs at least the admin role.
+func checkPermissionIn(client *girc.Client, event girc.Event, appConfig *TomlConfig, channel string, args []string) bool {
+	command := permissionName(appConfig, channel, args)
+	required := requiredRole(appConfig, channel, command)
+
+	requiredRank, ok := roleRank(appConfig, required)
+	if !ok {
+		slog.Warn("unknown role required, only owners may use the command", "network", appConfig.IRCDName,
+			"role", required, "command", command)
+
+		requiredRank, _ = roleRank(appConfig, RoleOwner)
+	}
+
+	if adminRank, _ := roleRank(appConfig, RoleAdmin); appConfig.AdminOnly && requiredRank < adminRank {
+		required, requiredRank = RoleAdmin, adminRank
+	}
+
+	userRank, _ := roleRank(appConfig, RoleUser)
+	if requiredRank <= userRank {
+		return true
+	}
+
+	role, rank := userRole(client, event, appConfig, channel)
+	allowed := rank >= requiredRank
+
+	mask := ""
+	if event.Source != nil {
+		mask = event.Source.String()
+	}
+
+	slog.Info("permission check", "network", appConfig.IRCDName, "mask", mask, "role", role, "channel", channel,
+		"command", command, "required", required, "allowed", allowed)
+
+	go recordPermissionCheck(appConfig, channel, mask, eventAccount(client, event), command, role, allowed)
+
+	emitEvent(BotEvent{
+		Type:    EventCommand,
+		Network: appConfig.IRCDName,
+		Channel: channel,
+		Nick:    mask,
+		Command: command,
+		Role:    role,
+		Allowed: &allowed,
+	})
+
+	if !allowed {
+		QueueReply(client, event, fmt.Sprintf("%s: %s needs the %s role", errPermissionDenied.Error(), command, required))
+	}
+
+	return allowed
+}
+
+func createPermissionAuditTable(appConfig *TomlConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx, `create table if not exists permission_audit (
+			id serial primary key,
+			network text not null,
+			channel text not null,
+			mask text not null,
+			account text not null,
+			command text not null,
+			role text not null,
+			allowed boolean not null,
+			dateadded timestamp default current_timestamp
+		)`)
+
+	return err
+}
+
+func recordPermissionCheck(appConfig *TomlConfig, channel, mask, account, command, role string, allowed bool) {
+	if appConfig.pool == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx,
+		`insert into permission_audit (network, channel, mask, account, command, role, allowed)
+			values ($1, $2, $3, $4, $5, $6, $7)`,
+		appConfig.IRCDName, channel, mask, account, command, role, allowed)
+	if err != nil {
+		LogError(err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lrstanley/girc"
+)
+
+func TestRequiredRole(t *testing.T) {
+	appConfig := &TomlConfig{
+		Permissions:        map[string]string{"roll": RoleTrusted, "cmd:digest": RoleTrusted},
+		ChannelPermissions: map[string]Permissions{"#Offtopic": {"roll": RoleUser}},
+	}
+
+	tests := []struct {
+		channel string
+		command string
+		want    string
+	}{
+		{"#milla", "roll", RoleTrusted},
+		{"#offtopic", "roll", RoleUser},
+		{"#milla", "set", RoleAdmin},
+		{"#milla", "kick", RoleOp},
+		{"#milla", "summarize", RoleUser},
+		{"#milla", "cmd:digest", RoleTrusted},
+		{"#milla", "myluacommand", RoleUser},
+	}
+
+	for _, test := range tests {
+		if got := requiredRole(appConfig, test.channel, test.command); got != test.want {
+			t.Errorf("%s in %s: got %s, want %s", test.command, test.channel, got, test.want)
+		}
+	}
+}
+
+func TestPermissionName(t *testing.T) {
+	appConfig := &TomlConfig{
+		Permissions:        map[string]string{"cmd:digest": RoleTrusted},
+		ChannelPermissions: map[string]Permissions{"#milla": {"ua:weather": RoleUser}},
+	}
+
+	tests := []struct {
+		channel string
+		args    []string
+		want    string
+	}{
+		{"#milla", []string{"cmd", "digest"}, "cmd:digest"},
+		{"#milla", []string{"cmd", "other"}, "cmd"},
+		{"#milla", []string{"ua", "weather"}, "ua:weather"},
+		{"#offtopic", []string{"ua", "weather"}, "ua"},
+		{"#milla", []string{"cmd"}, "cmd"},
+		{"#milla", []string{"roll", "1", "6"}, "roll"},
+	}
+
+	for _, test := range tests {
+		if got := permissionName(appConfig, test.channel, test.args); got != test.want {
+			t.Errorf("%q in %s: got %s, want %s", test.args, test.channel, got, test.want)
+		}
+	}
+}
+
+func TestExpandAlias(t *testing.T) {
+	appConfig := &TomlConfig{
+		Aliases: map[string]Alias{
+			"digest": {Alias: "/ua web_search_tool"},
+			"short":  {Alias: "/digest"},
+			"roll":   {Alias: "/set Apikey x"},
+			"loop":   {Alias: "/loop"},
+		},
+		LuaCommands: map[string]LuaCommand{"mylua": {}},
+	}
+
+	tests := map[string]string{
+		"digest":     "ua web_search_tool",
+		"short":      "ua web_search_tool",
+		"roll 1 6":   "roll 1 6",
+		"mylua args": "mylua args",
+		"unknown":    "unknown",
+		"loop":       "loop",
+	}
+
+	for cmd, want := range tests {
+		if got := expandAlias(appConfig, cmd); got != want {
+			t.Errorf("%q: got %q, want %q", cmd, got, want)
+		}
+	}
+}
+
+func TestCheckPermission(t *testing.T) {
+	client := girc.New(girc.Config{Server: "irc.example.com", Nick: "milla", User: "milla"})
+	appConfig := &TomlConfig{
+		IRCDName:   "test",
+		AdminMasks: []string{"*!*@admin.example.com"},
+		Roles: map[string]Role{
+			RoleTrusted: {Masks: []string{"*!*@trusted.example.com"}, Channels: []string{"#milla"}},
+		},
+		Permissions: map[string]string{"roll": RoleTrusted},
+	}
+
+	tests := []struct {
+		source  string
+		channel string
+		command string
+		want    bool
+	}{
+		{"nick!user@host", "#milla", "help", true},
+		{"nick!user@host", "#milla", "set", false},
+		{"boss!user@admin.example.com", "#milla", "set", true},
+		{"boss!user@admin.example.com", "#milla", "roll", true},
+		{"friend!user@trusted.example.com", "#milla", "roll", true},
+		{"friend!user@trusted.example.com", "#other", "roll", false},
+		{"friend!user@trusted.example.com", "#milla", "set", false},
+	}
+
+	for _, test := range tests {
+		event := girc.Event{Source: girc.ParseSource(test.source), Command: girc.PRIVMSG, Params: []string{test.channel, "/" + test.command}}
+
+		if got := checkPermission(client, event, appConfig, []string{test.command}); got != test.want {
+			t.Errorf("%s running %s in %s: got %v, want %v", test.source, test.command, test.channel, got, test.want)
+		}
+	}
+
+	adminOnly := *appConfig
+	adminOnly.AdminOnly = true
+
+	event := girc.Event{Source: girc.ParseSource("nick!user@host"), Command: girc.PRIVMSG, Params: []string{"#milla", "/help"}}
+	if checkPermission(client, event, &adminOnly, []string{"help"}) {
+		t.Error("adminOnly let a user run help")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	"slices"
+	"sync"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -31,8 +32,11 @@ func GetFeed(feed FeedConfig,
 
 	parsedFeed, err := feed.FeedParser.ParseURLWithContext(feed.URL, ctx)
 	if err != nil {
+		rssFetches.Inc(groupName, feed.Name, "error")
 		LogError(err)
 	} else {
+		rssFetches.Inc(groupName, feed.Name, "ok")
+
 		if len(parsedFeed.Items) > 0 {
 			query := fmt.Sprintf("select newest_unix_time from rss where name = '%s'", rowName)
 
@@ -65,7 +69,7 @@ func GetFeed(feed FeedConfig,
 
 			for _, item := range parsedFeed.Items {
 				if item.PublishedParsed.Unix() > newestFromDB {
-					client.Cmd.Message(channel[0], feed.Name[0:Min(20, len(feed.Name))]+": "+parsedFeed.Title+": "+item.Title+" >>> "+item.Link)
+					QueueMessage(client, PriorityBulk, channel[0], feed.Name[0:Min(20, len(feed.Name))]+": "+parsedFeed.Title+": "+item.Title+" >>> "+item.Link)
 				}
 			}
 
@@ -83,6 +87,7 @@ func GetFeed(feed FeedConfig,
 }
 
 func feedDispatcher(
+	ctx context.Context,
 	config RSSConfig,
 	client *girc.Client,
 	pool *pgxpool.Pool,
@@ -126,26 +131,46 @@ func feedDispatcher(
 				go GetFeed(feed, client, pool, channel, groupName)
 			}
 
-			time.Sleep(time.Duration(period) * time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(period) * time.Second):
+			}
 		} else {
-			time.Sleep(time.Duration(10) * time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(10) * time.Second):
+			}
 		}
 	}
 }
 
-func ParseRSSConfig(rssConfFilePath string) *RSSConfig {
+func readRSSConfig(rssConfFilePath string) (*RSSConfig, error) {
 	file, err := os.Open(rssConfFilePath)
 	if err != nil {
-		LogError(err)
-
-		return nil
+		return nil, err
 	}
+	defer file.Close()
 
 	var config *RSSConfig
 
 	decoder := json.NewDecoder(file)
 
-	err = decoder.Decode(&config)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s: %w", rssConfFilePath, err)
+	}
+
+	// a file with just null in it decodes without an error.
+	if config == nil {
+		return nil, fmt.Errorf("%s: %w", rssConfFilePath, errEmptyRSSConfig)
+	}
+
+	return config, nil
+}
+
+func ParseRSSConfig(rssConfFilePath string) *RSSConfig {
+	config, err := readRSSConfig(rssConfFilePath)
 	if err != nil {
 		LogError(err)
 
@@ -155,7 +180,9 @@ func ParseRSSConfig(rssConfFilePath string) *RSSConfig {
 	return config
 }
 
-func runRSS(appConfig *TomlConfig, client *girc.Client) {
+// runRSS waits for the database and then starts the feed dispatchers, they
+// all stop with ctx.
+func runRSS(ctx context.Context, appConfig *TomlConfig, client *girc.Client) {
 	query := fmt.Sprintf(
 		`create table if not exists rss (
 			id serial primary key,
@@ -164,29 +191,67 @@ func runRSS(appConfig *TomlConfig, client *girc.Client) {
 		)`)
 
 	for {
-		if appConfig.pool != nil {
-			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(10)*time.Second)
-			defer cancel()
+		if pool := appConfig.current().pool; pool != nil {
+			queryCtx, cancel := context.WithTimeout(ctx, time.Duration(10)*time.Second)
+			_, err := pool.Exec(queryCtx, query)
 
-			_, err := appConfig.pool.Exec(ctx, query)
-			if err != nil {
-				LogError(err)
-			} else {
+			cancel()
+
+			if err == nil {
 				break
 			}
+
+			LogError(err)
 		}
 
-		time.Sleep(time.Duration(10) * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(10) * time.Second):
+		}
 	}
 
 	log.Print("spawning the RSS feed dispatcher")
 
+	rssGroupsMu.Lock()
+	appConfig.state.rssReady = true
+	rssGroupsMu.Unlock()
+
+	restartRSS(ctx, appConfig, client)
+}
+
+var rssGroupsMu sync.Mutex
+
+// restartRSS stops the running feed dispatchers and starts one for every
+// group in the config, which also picks up changes to the RSS files.
+func restartRSS(ctx context.Context, appConfig *TomlConfig, client *girc.Client) {
+	rssGroupsMu.Lock()
+	defer rssGroupsMu.Unlock()
+
+	state := appConfig.state
+	if !state.rssReady {
+		return
+	}
+
+	for _, cancel := range state.rssGroups {
+		cancel()
+	}
+
+	state.rssGroups = make(map[string]context.CancelFunc)
+
+	appConfig = appConfig.current()
+
 	for groupName, rss := range appConfig.Rss {
 		rssConfig := ParseRSSConfig(rss.RssFile)
 		if rssConfig == nil {
 			log.Print("Could not parse RSS config file " + rss.RssFile + ". Exiting.")
-		} else {
-			go feedDispatcher(*rssConfig, client, appConfig.pool, rss.Channel, groupName, rssConfig.Period)
+
+			continue
 		}
+
+		groupCtx, cancel := context.WithCancel(ctx)
+		state.rssGroups[groupName] = cancel
+
+		go feedDispatcher(groupCtx, *rssConfig, client, appConfig.pool, rss.Channel, groupName, rssConfig.Period)
 	}
 }
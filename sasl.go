@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lrstanley/girc"
+)
+
+const (
+	SaslPlain       = "PLAIN"
+	SaslExternal    = "EXTERNAL"
+	SaslScramSHA256 = "SCRAM-SHA-256"
+
+	scramNonceLength = 24
+)
+
+var (
+	errUnknSaslMechanism = errors.New("saslMechanism must be one of PLAIN, EXTERNAL or SCRAM-SHA-256")
+	errSaslNeedsUserPass = errors.New("SASL needs both ircSaslUser and ircSaslPass")
+	errSaslNeedsCert     = errors.New("SASL EXTERNAL needs clientCertPath")
+	errScramBadServer    = errors.New("SCRAM: invalid server message")
+)
+
+// SASLScramSHA256 implements SCRAM-SHA-256 (RFC 7677) for girc, which calls
+// Encode once for every AUTHENTICATE the server sends.
+type SASLScramSHA256 struct {
+	User string
+	Pass string
+
+	mu                 sync.Mutex
+	clientNonce        string
+	clientFirstBare    string
+	expectedServerSign []byte
+}
+
+func (sasl *SASLScramSHA256) Method() string {
+	return SaslScramSHA256
+}
+
+func scramEscape(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+func scramAttributes(message string) map[string]string {
+	attributes := make(map[string]string)
+
+	for _, part := range strings.Split(message, ",") {
+		key, value, found := strings.Cut(part, "=")
+		if found {
+			attributes[key] = value
+		}
+	}
+
+	return attributes
+}
+
+func scramHMAC(key, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+
+	return mac.Sum(nil)
+}
+
+// Encode returns an empty string on any error which makes girc give up on
+// the connection.
+func (sasl *SASLScramSHA256) Encode(params []string) string {
+	sasl.mu.Lock()
+	defer sasl.mu.Unlock()
+
+	if len(params) != 1 {
+		return ""
+	}
+
+	if params[0] == "+" {
+		nonce := make([]byte, scramNonceLength)
+		if _, err := rand.Read(nonce); err != nil {
+			LogError(err)
+
+			return ""
+		}
+
+		sasl.clientNonce = base64.RawStdEncoding.EncodeToString(nonce)
+		sasl.clientFirstBare = "n=" + scramEscape(sasl.User) + ",r=" + sasl.clientNonce
+		sasl.expectedServerSign = nil
+
+		return base64.StdEncoding.EncodeToString([]byte("n,," + sasl.clientFirstBare))
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(params[0])
+	if err != nil {
+		LogError(err)
+
+		return ""
+	}
+
+	serverMessage := string(decoded)
+	attributes := scramAttributes(serverMessage)
+
+	if sasl.expectedServerSign != nil {
+		if serverError, ok := attributes["e"]; ok {
+			LogError(fmt.Errorf("%w: %s", errScramBadServer, serverError))
+
+			return ""
+		}
+
+		signature, err := base64.StdEncoding.DecodeString(attributes["v"])
+		if err != nil || !hmac.Equal(signature, sasl.expectedServerSign) {
+			LogError(fmt.Errorf("%w: server signature does not match", errScramBadServer))
+
+			return ""
+		}
+
+		return "+"
+	}
+
+	serverNonce := attributes["r"]
+
+	salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+	if err != nil || !strings.HasPrefix(serverNonce, sasl.clientNonce) {
+		LogError(errScramBadServer)
+
+		return ""
+	}
+
+	iterations, err := strconv.Atoi(attributes["i"])
+	if err != nil || iterations <= 0 {
+		LogError(errScramBadServer)
+
+		return ""
+	}
+
+	saltedPassword, err := pbkdf2.Key(sha256.New, sasl.Pass, salt, iterations, sha256.Size)
+	if err != nil {
+		LogError(err)
+
+		return ""
+	}
+
+	clientKey := scramHMAC(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := scramHMAC(saltedPassword, []byte("Server Key"))
+
+	clientFinalBare := "c=biws,r=" + serverNonce
+	authMessage := []byte(sasl.clientFirstBare + "," + serverMessage + "," + clientFinalBare)
+
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= clientSignature[i]
+	}
+
+	sasl.expectedServerSign = scramHMAC(serverKey, authMessage)
+
+	return base64.StdEncoding.EncodeToString(
+		[]byte(clientFinalBare + ",p=" + base64.StdEncoding.EncodeToString(clientKey)))
+}
+
+func getSaslMech(appConfig *TomlConfig) (girc.SASLMech, error) {
+	mechanism := strings.ToUpper(appConfig.SaslMechanism)
+
+	switch mechanism {
+	case SaslPlain, SaslScramSHA256:
+		if appConfig.IrcSaslUser == "" || appConfig.IrcSaslPass == "" {
+			return nil, errSaslNeedsUserPass
+		}
+
+		if mechanism == SaslPlain {
+			return &girc.SASLPlain{User: appConfig.IrcSaslUser, Pass: appConfig.IrcSaslPass}, nil
+		}
+
+		return &SASLScramSHA256{User: appConfig.IrcSaslUser, Pass: appConfig.IrcSaslPass}, nil
+	case SaslExternal:
+		if appConfig.ClientCertPath == "" {
+			return nil, errSaslNeedsCert
+		}
+
+		return &girc.SASLExternal{Identity: appConfig.IrcSaslUser}, nil
+	default:
+		return nil, errUnknSaslMechanism
+	}
+}
+
+// loadClientCert loads the client certificate used for CertFP and SASL
+// EXTERNAL. Without clientKeyPath the key is expected in the same file.
+func loadClientCert(appConfig *TomlConfig) (tls.Certificate, error) {
+	keyPath := appConfig.ClientKeyPath
+	if keyPath == "" {
+		keyPath = appConfig.ClientCertPath
+	}
+
+	cert, err := tls.LoadX509KeyPair(appConfig.ClientCertPath, keyPath)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid client certificate %s: %w", appConfig.ClientCertPath, err)
+	}
+
+	return cert, nil
+}
+
+// setupAuth configures SASL and the client certificate and reports how
+// authentication went. If SASL is off, or the server does not do it, and
+// nickServIdentify is set, milla identifies with NickServ once connected.
+func setupAuth(irc *girc.Client, appConfig *TomlConfig) error {
+	if appConfig.ClientCertPath != "" {
+		cert, err := loadClientCert(appConfig)
+		if err != nil {
+			return err
+		}
+
+		irc.Config.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// configs from before saslMechanism existed used PLAIN when there was a
+	// password and only the client certificate otherwise.
+	if appConfig.EnableSasl && appConfig.SaslMechanism == "" {
+		appConfig.SaslMechanism = SaslPlain
+
+		if appConfig.IrcSaslPass == "" && appConfig.ClientCertPath != "" {
+			appConfig.SaslMechanism = SaslExternal
+		}
+	}
+
+	if appConfig.EnableSasl {
+		mech, err := getSaslMech(appConfig)
+		if err != nil {
+			return err
+		}
+
+		irc.Config.SASL = mech
+	}
+
+	mechanism := strings.ToUpper(appConfig.SaslMechanism)
+
+	var (
+		loggedInMu sync.Mutex
+		loggedIn   bool
+	)
+
+	// not a background handler, so the login is recorded before the
+	// CONNECTED handler below decides whether to fall back to NickServ.
+	irc.Handlers.Add(girc.RPL_LOGGEDIN, func(_ *girc.Client, event girc.Event) {
+		appConfig := appConfig.current()
+
+		loggedInMu.Lock()
+		loggedIn = true
+		loggedInMu.Unlock()
+
+		slog.Info("authenticated", "network", appConfig.IRCDName)
+		logMessageContent(nil, "authenticated", "network", appConfig.IRCDName, "text", event.Last())
+	})
+
+	for _, failure := range []string{girc.RPL_NICKLOCKED, girc.ERR_SASLFAIL, girc.ERR_SASLTOOLONG, girc.ERR_SASLABORTED} {
+		irc.Handlers.AddBg(failure, func(_ *girc.Client, event girc.Event) {
+			appConfig := appConfig.current()
+
+			slog.Warn("SASL authentication failed", "network", appConfig.IRCDName, "mechanism", mechanism,
+				"user", appConfig.IrcSaslUser, "numeric", event.Command)
+			logMessageContent(nil, "SASL authentication failed", "network", appConfig.IRCDName, "text", event.Last())
+		})
+	}
+
+	irc.Handlers.AddBg(girc.RPL_SASLMECHS, func(_ *girc.Client, event girc.Event) {
+		appConfig := appConfig.current()
+
+		if len(event.Params) < 2 { //nolint: mnd,gomnd
+			return
+		}
+
+		slog.Warn("server does not support the SASL mechanism", "network", appConfig.IRCDName,
+			"mechanism", mechanism, "supported", event.Params[1])
+	})
+
+	irc.Handlers.AddBg(girc.CONNECTED, func(client *girc.Client, _ girc.Event) {
+		appConfig := appConfig.current()
+
+		loggedInMu.Lock()
+		authenticated := loggedIn
+		loggedIn = false
+		loggedInMu.Unlock()
+
+		if authenticated {
+			return
+		}
+
+		if appConfig.EnableSasl && !client.HasCapability("sasl") {
+			slog.Warn("server does not support SASL", "network", appConfig.IRCDName)
+		}
+
+		if !appConfig.NickServIdentify || appConfig.IrcSaslPass == "" {
+			if appConfig.EnableSasl {
+				slog.Warn("connected without authenticating", "network", appConfig.IRCDName)
+			}
+
+			return
+		}
+
+		slog.Info("identifying", "network", appConfig.IRCDName, "nickserv", appConfig.NickServName)
+
+		identify := "IDENTIFY "
+		if appConfig.IrcSaslUser != "" {
+			identify += appConfig.IrcSaslUser + " "
+		}
+
+		client.Cmd.Message(appConfig.NickServName, identify+appConfig.IrcSaslPass)
+	})
+
+	// NickServ answers IDENTIFY with a NOTICE, log it so failures show up.
+	irc.Handlers.AddBg(girc.NOTICE, func(_ *girc.Client, event girc.Event) {
+		appConfig := appConfig.current()
+
+		if appConfig.NickServIdentify && event.Source != nil &&
+			strings.EqualFold(event.Source.Name, appConfig.NickServName) {
+			logMessageContent(nil, "nickserv", "network", appConfig.IRCDName, "from", event.Source.Name, "text", event.Last())
+		}
+	})
+
+	return nil
+}
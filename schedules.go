@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+const (
+	scheduleCheckInterval = 15 * time.Second
+	// a run that is later than this was missed, e.g. because the bot was
+	// down or disconnected, and only happens if the job has catchUp set.
+	scheduleMissedAfter = 2 * time.Minute
+)
+
+var errScheduleAction = errors.New("a schedule needs exactly one of customCommand, alias, luaFunction or userAgentAction")
+
+type scheduleState struct {
+	expression string
+	cron       *CronSchedule
+	err        error
+	lastRun    time.Time
+	running    bool
+}
+
+// Scheduler keeps track of when each of a network's schedules last ran and
+// whether it is still running. The schedules themselves are read from the
+// config on every check so a reload picks up changes.
+type Scheduler struct {
+	mu      sync.Mutex
+	started time.Time
+	states  map[string]*scheduleState
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{started: time.Now(), states: make(map[string]*scheduleState)}
+}
+
+// state returns the state for a schedule, parsing its cron expression again
+// if it changed. Callers hold the lock.
+func (scheduler *Scheduler) state(name string, schedule Schedule) *scheduleState {
+	state, ok := scheduler.states[name]
+	if !ok {
+		state = &scheduleState{lastRun: scheduler.started}
+		scheduler.states[name] = state
+	}
+
+	if (state.cron == nil && state.err == nil) || state.expression != schedule.Cron {
+		state.expression = schedule.Cron
+		state.cron, state.err = ParseCron(schedule.Cron)
+	}
+
+	return state
+}
+
+func (scheduler *Scheduler) SetLastRun(name string, lastRun time.Time) {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	state, ok := scheduler.states[name]
+	if !ok {
+		state = &scheduleState{}
+		scheduler.states[name] = state
+	}
+
+	state.lastRun = lastRun
+}
+
+func scheduleLocation(appConfig *TomlConfig, schedule Schedule) *time.Location {
+	timezone := schedule.Timezone
+	if timezone == "" {
+		timezone = appConfig.DefaultTimezone
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.UTC
+	}
+
+	return location
+}
+
+func validateSchedule(schedule Schedule) error {
+	if _, err := ParseCron(schedule.Cron); err != nil {
+		return err
+	}
+
+	actions := 0
+
+	for _, action := range []string{schedule.CustomCommand, schedule.Alias, schedule.LuaFunction, schedule.UserAgentAction} {
+		if action != "" {
+			actions++
+		}
+	}
+
+	if actions != 1 {
+		return errScheduleAction
+	}
+
+	if len(schedule.Channel) == 0 || schedule.Channel[0] == "" {
+		return errNoChannel
+	}
+
+	return nil
+}
+
+func createScheduleRunsTable(appConfig *TomlConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx, `create table if not exists schedule_runs (
+			network text not null,
+			name text not null,
+			last_run timestamptz not null,
+			primary key (network, name)
+		)`)
+
+	return err
+}
+
+// loadScheduleRuns reads when the schedules last ran, so runs that were
+// missed while the bot was down are noticed.
+func loadScheduleRuns(appConfig *TomlConfig) {
+	if appConfig.pool == nil || appConfig.scheduler == nil {
+		return
+	}
+
+	if err := createScheduleRunsTable(appConfig); err != nil {
+		LogError(err)
+
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	rows, err := appConfig.pool.Query(ctx,
+		"select name, last_run from schedule_runs where network = $1", appConfig.IRCDName)
+	if err != nil {
+		LogError(err)
+
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			name    string
+			lastRun time.Time
+		)
+
+		if err := rows.Scan(&name, &lastRun); err != nil {
+			LogError(err)
+
+			continue
+		}
+
+		appConfig.scheduler.SetLastRun(name, lastRun)
+	}
+}
+
+func saveScheduleRun(appConfig *TomlConfig, name string, lastRun time.Time) error {
+	if appConfig.pool == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx,
+		`insert into schedule_runs (network, name, last_run) values ($1, $2, $3)
+			on conflict (network, name) do update set last_run = excluded.last_run`,
+		appConfig.IRCDName, name, lastRun)
+
+	return err
+}
+
+// runSchedule runs a job as if the bot had sent the command in the channel.
+// The schedule comes from the config so no permissions are checked.
+func runSchedule(client *girc.Client, appConfig *TomlConfig, name string, schedule Schedule) {
+	channel := schedule.Channel[0]
+	event := girc.Event{
+		Source:  &girc.Source{Name: client.GetNick()},
+		Command: girc.PRIVMSG,
+		Params:  []string{channel, ""},
+	}
+
+	slog.Info("running schedule", "network", appConfig.IRCDName, "schedule", name, "channel", channel)
+
+	switch {
+	case schedule.CustomCommand != "":
+		handleCustomCommand([]string{"cmd", schedule.CustomCommand}, client, event, appConfig)
+	case schedule.Alias != "":
+		alias, ok := appConfig.Aliases[schedule.Alias]
+		if !ok {
+			slog.Warn("schedule has no such alias", "network", appConfig.IRCDName, "schedule", name, "alias", schedule.Alias)
+
+			return
+		}
+
+		cmd, _ := splitCommand(strings.TrimSpace(alias.Alias), []string{commandMarker})
+		dispatchCommand(client, event, appConfig, expandAlias(appConfig, cmd))
+	case schedule.LuaFunction != "":
+		if _, ok := appConfig.LuaCommands[schedule.LuaFunction]; !ok {
+			slog.Warn("schedule has no such lua command", "network", appConfig.IRCDName, "schedule", name, "lua", schedule.LuaFunction)
+
+			return
+		}
+
+		result := RunLuaFunc(schedule.LuaFunction, schedule.Args, client, appConfig)
+		if result != "" {
+			SendToIRC(client, event, result, appConfig.ChromaFormatter)
+		}
+	case schedule.UserAgentAction != "":
+		response := UserAgentsGet(schedule.UserAgentAction, schedule.Args, appConfig)
+		SendToIRC(client, event, response, appConfig.ChromaFormatter)
+	}
+}
+
+// checkSchedules starts the jobs that are due. A job that is still running
+// from last time is skipped, and of the runs that were missed only one
+// happens, and only if the job has catchUp set.
+func checkSchedules(client *girc.Client, appConfig *TomlConfig) {
+	if !client.IsConnected() {
+		return
+	}
+
+	scheduler := appConfig.scheduler
+	now := time.Now()
+
+	// the runs are saved once the lock is released, the database can be
+	// slow and the jobs that finish need the lock.
+	var ran []string
+
+	scheduler.mu.Lock()
+
+	for name, schedule := range appConfig.Schedules {
+		if validateSchedule(schedule) != nil {
+			continue
+		}
+
+		state := scheduler.state(name, schedule)
+
+		next := state.cron.Next(state.lastRun.In(scheduleLocation(appConfig, schedule)))
+		if next.IsZero() || now.Before(next) {
+			continue
+		}
+
+		state.lastRun = now
+		ran = append(ran, name)
+
+		if now.Sub(next) > scheduleMissedAfter && !schedule.CatchUp {
+			slog.Warn("schedule missed its run", "network", appConfig.IRCDName, "schedule", name, "at", next.Format(time.RFC1123))
+
+			continue
+		}
+
+		if state.running {
+			slog.Warn("schedule is still running, skipping this run", "network", appConfig.IRCDName, "schedule", name)
+
+			continue
+		}
+
+		state.running = true
+
+		go func() {
+			defer func() {
+				scheduler.mu.Lock()
+				state.running = false
+				scheduler.mu.Unlock()
+			}()
+
+			runSchedule(client, appConfig, name, schedule)
+		}()
+	}
+
+	scheduler.mu.Unlock()
+
+	for _, name := range ran {
+		if err := saveScheduleRun(appConfig, name, now); err != nil {
+			LogError(err)
+		}
+	}
+}
+
+func setupSchedules(ctx context.Context, irc *girc.Client, appConfig *TomlConfig) {
+	appConfig.scheduler = NewScheduler()
+
+	for name, schedule := range appConfig.Schedules {
+		if err := validateSchedule(schedule); err != nil {
+			slog.Error("schedule", "network", appConfig.IRCDName, "schedule", name, "error", err)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(scheduleCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				checkSchedules(irc, appConfig.current())
+			}
+		}
+	}()
+}
+
+// schedulesStatus backs the schedules command.
+func schedulesStatus(appConfig *TomlConfig) []string {
+	names := make([]string, 0, len(appConfig.Schedules))
+	for name := range appConfig.Schedules {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		return []string{"no schedules"}
+	}
+
+	scheduler := appConfig.scheduler
+
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	lines := make([]string, 0, len(names))
+
+	for _, name := range names {
+		schedule := appConfig.Schedules[name]
+
+		if err := validateSchedule(schedule); err != nil {
+			lines = append(lines, fmt.Sprintf("%s: %v", name, err))
+
+			continue
+		}
+
+		state := scheduler.state(name, schedule)
+		location := scheduleLocation(appConfig, schedule)
+		next := state.cron.Next(state.lastRun.In(location))
+
+		status := "next run " + next.Format(reminderTimeLayout)
+		if next.IsZero() {
+			status = "never runs"
+		}
+
+		if state.running {
+			status = "running"
+		}
+
+		lines = append(lines, fmt.Sprintf("%s: %q in %s, %s, last run %s",
+			name, schedule.Cron, schedule.Channel[0], status, state.lastRun.In(location).Format(reminderTimeLayout)))
+	}
+
+	return lines
+}
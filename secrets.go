@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const (
+	envPrefix  = "env:"
+	filePrefix = "file:"
+)
+
+var (
+	errEnvNotSet     = errors.New("environment variable is not set")
+	errSecretUnread  = errors.New("could not read secret file")
+	errSecretIsEmpty = errors.New("secret file is empty")
+)
+
+// resolveSecret turns an env:NAME or file:/path reference into the value it
+// points at. Anything else is returned as it is.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, envPrefix):
+		name := strings.TrimPrefix(value, envPrefix)
+
+		resolved, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("%w: %s", errEnvNotSet, name)
+		}
+
+		return resolved, nil
+	case strings.HasPrefix(value, filePrefix):
+		path := strings.TrimPrefix(value, filePrefix)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", errSecretUnread, err)
+		}
+
+		// secret files usually end in a newline that isn't part of the secret.
+		resolved := strings.TrimRight(string(data), "\r\n")
+		if resolved == "" {
+			return "", fmt.Errorf("%w: %s", errSecretIsEmpty, path)
+		}
+
+		return resolved, nil
+	}
+
+	return value, nil
+}
+
+// resolveSecrets replaces every env: and file: reference in the config with
+// the value it points at. path is where in the config the value is, it is
+// only used for the errors, which are all returned together.
+func resolveSecrets(value reflect.Value, path string) error {
+	switch value.Kind() {
+	case reflect.String:
+		resolved, err := resolveSecret(value.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		value.SetString(resolved)
+	case reflect.Struct:
+		var errs []error
+
+		for i := range value.NumField() {
+			field := value.Type().Field(i)
+
+			name := tomlName(field)
+			if !field.IsExported() || name == "" || name == "-" {
+				continue
+			}
+
+			errs = append(errs, resolveSecrets(value.Field(i), joinConfigPath(path, name)))
+		}
+
+		return errors.Join(errs...)
+	case reflect.Map:
+		var errs []error
+
+		iter := value.MapRange()
+		for iter.Next() {
+			// map values can't be set in place, resolve a copy and put it back.
+			element := reflect.New(iter.Value().Type()).Elem()
+			element.Set(iter.Value())
+
+			errs = append(errs, resolveSecrets(element, joinConfigPath(path, fmt.Sprint(iter.Key().Interface()))))
+
+			value.SetMapIndex(iter.Key(), element)
+		}
+
+		return errors.Join(errs...)
+	case reflect.Slice, reflect.Array:
+		var errs []error
+
+		for i := range value.Len() {
+			errs = append(errs, resolveSecrets(value.Index(i), fmt.Sprintf("%s[%d]", path, i)))
+		}
+
+		return errors.Join(errs...)
+	default:
+	}
+
+	return nil
+}
+
+func joinConfigPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+
+	return path + "." + name
+}
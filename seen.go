@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/lrstanley/girc"
+)
+
+const maxTellsPerNick = 10
+
+var (
+	errNoDatabase   = errors.New("no database connection")
+	errTooManyTells = errors.New("that nick already has too many messages waiting")
+)
+
+// pendingTells remembers which nicks have messages waiting so the tells
+// table is only queried when one of them speaks or joins.
+type pendingTells struct {
+	mu    sync.Mutex
+	nicks map[string]bool
+}
+
+func newPendingTells() *pendingTells {
+	return &pendingTells{nicks: make(map[string]bool)}
+}
+
+func (pending *pendingTells) Add(nick string) {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+
+	pending.nicks[strings.ToLower(nick)] = true
+}
+
+func (pending *pendingTells) Remove(nick string) {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+
+	delete(pending.nicks, strings.ToLower(nick))
+}
+
+func (pending *pendingTells) Has(nick string) bool {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+
+	return pending.nicks[strings.ToLower(nick)]
+}
+
+// formatAgo turns a duration into something like 2d 3h ago.
+func formatAgo(duration time.Duration) string {
+	if duration < time.Minute {
+		return "just now"
+	}
+
+	days := int(duration.Hours()) / 24      //nolint: mnd,gomnd
+	hours := int(duration.Hours()) % 24     //nolint: mnd,gomnd
+	minutes := int(duration.Minutes()) % 60 //nolint: mnd,gomnd
+
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh ago", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm ago", hours, minutes)
+	default:
+		return fmt.Sprintf("%dm ago", minutes)
+	}
+}
+
+func createSeenTables(appConfig *TomlConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx, `create table if not exists seen (
+			network text not null,
+			nick text not null,
+			display_nick text not null,
+			action text not null,
+			channel text not null,
+			message text not null,
+			seen_at timestamptz not null,
+			primary key (network, nick)
+		)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = appConfig.pool.Exec(ctx, `create table if not exists tells (
+			id serial primary key,
+			network text not null,
+			sender text not null,
+			recipient text not null,
+			channel text not null,
+			message text not null,
+			created timestamptz not null default now()
+		)`)
+
+	return err
+}
+
+// loadTells creates the tables and finds the nicks with messages waiting.
+func loadTells(appConfig *TomlConfig) {
+	if appConfig.pool == nil || appConfig.tells == nil {
+		return
+	}
+
+	if err := createSeenTables(appConfig); err != nil {
+		LogError(err)
+
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	rows, err := appConfig.pool.Query(ctx,
+		"select distinct recipient from tells where network = $1", appConfig.IRCDName)
+	if err != nil {
+		LogError(err)
+
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var nick string
+
+		if err := rows.Scan(&nick); err != nil {
+			LogError(err)
+
+			continue
+		}
+
+		appConfig.tells.Add(nick)
+	}
+}
+
+func recordSeen(appConfig *TomlConfig, nick, action, channel, message string) {
+	if appConfig.pool == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	_, err := appConfig.pool.Exec(ctx,
+		`insert into seen (network, nick, display_nick, action, channel, message, seen_at)
+			values ($1, lower($2), $2, $3, $4, $5, now())
+			on conflict (network, nick) do update set display_nick = excluded.display_nick,
+				action = excluded.action, channel = excluded.channel,
+				message = excluded.message, seen_at = excluded.seen_at`,
+		appConfig.IRCDName, nick, action, channel, message)
+	if err != nil {
+		LogError(err)
+	}
+}
+
+func lookupSeen(appConfig *TomlConfig, nick string) (string, error) {
+	if appConfig.pool == nil {
+		return "", errNoDatabase
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	var (
+		displayNick, action, channel, message string
+		seenAt                                time.Time
+	)
+
+	err := appConfig.pool.QueryRow(ctx,
+		"select display_nick, action, channel, message, seen_at from seen where network = $1 and nick = lower($2)",
+		appConfig.IRCDName, nick).Scan(&displayNick, &action, &channel, &message, &seenAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Sprintf("I haven't seen %s", nick), nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	ago := formatAgo(time.Since(seenAt))
+
+	switch action {
+	case "message":
+		return fmt.Sprintf("%s was last seen %s in %s saying: %s", displayNick, ago, channel, message), nil
+	case "join":
+		return fmt.Sprintf("%s was last seen %s joining %s", displayNick, ago, channel), nil
+	case "part":
+		return fmt.Sprintf("%s was last seen %s leaving %s: %s", displayNick, ago, channel, message), nil
+	case "quit":
+		return fmt.Sprintf("%s was last seen %s quitting: %s", displayNick, ago, message), nil
+	case "nick":
+		return fmt.Sprintf("%s was last seen %s %s", displayNick, ago, message), nil
+	}
+
+	return fmt.Sprintf("%s was last seen %s", displayNick, ago), nil
+}
+
+func saveTell(appConfig *TomlConfig, sender, recipient, channel, message string) error {
+	if appConfig.pool == nil {
+		return errNoDatabase
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	var count int
+
+	err := appConfig.pool.QueryRow(ctx,
+		"select count(*) from tells where network = $1 and recipient = lower($2)",
+		appConfig.IRCDName, recipient).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count >= maxTellsPerNick {
+		return errTooManyTells
+	}
+
+	_, err = appConfig.pool.Exec(ctx,
+		"insert into tells (network, sender, recipient, channel, message) values ($1, $2, lower($3), $4, $5)",
+		appConfig.IRCDName, sender, recipient, channel, message)
+	if err != nil {
+		return err
+	}
+
+	appConfig.tells.Add(recipient)
+
+	return nil
+}
+
+// deliverTells sends a nick the messages left for them. They go to the
+// channel the nick just spoke in or joined, or privately if the message was
+// left in a private query.
+func deliverTells(client *girc.Client, appConfig *TomlConfig, nick, channel string) {
+	if appConfig.pool == nil || !appConfig.tells.Has(nick) {
+		return
+	}
+
+	appConfig.tells.Remove(nick)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.RequestTimeout)*time.Second)
+	defer cancel()
+
+	rows, err := appConfig.pool.Query(ctx,
+		`delete from tells where network = $1 and recipient = lower($2)
+			returning sender, channel, message, created`,
+		appConfig.IRCDName, nick)
+	if err != nil {
+		LogError(err)
+
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			sender, from, message string
+			created               time.Time
+		)
+
+		if err := rows.Scan(&sender, &from, &message, &created); err != nil {
+			LogError(err)
+
+			continue
+		}
+
+		text := fmt.Sprintf("%s: %s said %s: %s", nick, sender, formatAgo(time.Since(created)), message)
+
+		target := channel
+		if !girc.IsValidChannel(from) {
+			target = nick
+		}
+
+		QueueMessage(client, PriorityInteractive, target, text)
+	}
+}
+
+// trackSeen records what everyone in the bot's channels did last and hands
+// out the messages left with /tell.
+func trackSeen(irc *girc.Client, appConfig *TomlConfig) {
+	appConfig.tells = newPendingTells()
+
+	fromBot := func(client *girc.Client, event girc.Event) bool {
+		return event.Source == nil || strings.EqualFold(event.Source.Name, client.GetNick())
+	}
+
+	irc.Handlers.AddBg(girc.PRIVMSG, func(client *girc.Client, event girc.Event) {
+		appConfig := appConfig.current()
+
+		if fromBot(client, event) || !girc.IsValidChannel(event.Params[0]) {
+			return
+		}
+
+		recordSeen(appConfig, event.Source.Name, "message", event.Params[0], event.Last())
+		deliverTells(client, appConfig, event.Source.Name, event.Params[0])
+	})
+
+	irc.Handlers.AddBg(girc.JOIN, func(client *girc.Client, event girc.Event) {
+		appConfig := appConfig.current()
+
+		if fromBot(client, event) {
+			return
+		}
+
+		recordSeen(appConfig, event.Source.Name, "join", event.Params[0], "")
+		deliverTells(client, appConfig, event.Source.Name, event.Params[0])
+	})
+
+	irc.Handlers.AddBg(girc.PART, func(client *girc.Client, event girc.Event) {
+		appConfig := appConfig.current()
+
+		if fromBot(client, event) {
+			return
+		}
+
+		reason := ""
+		if len(event.Params) > 1 {
+			reason = event.Last()
+		}
+
+		recordSeen(appConfig, event.Source.Name, "part", event.Params[0], reason)
+	})
+
+	irc.Handlers.AddBg(girc.QUIT, func(client *girc.Client, event girc.Event) {
+		appConfig := appConfig.current()
+
+		if fromBot(client, event) {
+			return
+		}
+
+		recordSeen(appConfig, event.Source.Name, "quit", "", event.Last())
+	})
+
+	irc.Handlers.AddBg(girc.NICK, func(client *girc.Client, event girc.Event) {
+		appConfig := appConfig.current()
+
+		if event.Source == nil || len(event.Params) == 0 || strings.EqualFold(event.Last(), client.GetNick()) {
+			return
+		}
+
+		recordSeen(appConfig, event.Source.Name, "nick", "", "changing their nick to "+event.Last())
+		recordSeen(appConfig, event.Last(), "nick", "", "changing their nick from "+event.Source.Name)
+	})
+}
+
+func handleSeenCommand(args []string, client *girc.Client, event girc.Event, appConfig *TomlConfig) {
+	if len(args) < 2 { //nolint: mnd,gomnd
+		QueueReply(client, event, errNotEnoughArgs.Error())
+
+		return
+	}
+
+	if strings.EqualFold(args[1], event.Source.Name) {
+		QueueReply(client, event, "you're right here")
+
+		return
+	}
+
+	reply, err := lookupSeen(appConfig, args[1])
+	if err != nil {
+		LogError(err)
+		QueueReply(client, event, err.Error())
+
+		return
+	}
+
+	QueueReply(client, event, reply)
+}
+
+func handleTellCommand(args []string, client *girc.Client, event girc.Event, appConfig *TomlConfig) {
+	if len(args) < 3 { //nolint: mnd,gomnd
+		QueueReply(client, event, errNotEnoughArgs.Error())
+
+		return
+	}
+
+	channel := event.Params[0]
+	if isPrivateMessage(event) {
+		channel = event.Source.Name
+	}
+
+	err := saveTell(appConfig, event.Source.Name, args[1], channel, strings.Join(args[2:], " "))
+	if err != nil {
+		slog.Error("tell", "network", appConfig.IRCDName, "error", err)
+		QueueReply(client, event, err.Error())
+
+		return
+	}
+
+	QueueReply(client, event, fmt.Sprintf("I'll tell %s when I see them.", args[1]))
+}
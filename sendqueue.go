@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+type SendPriority int
+
+const (
+	PriorityInteractive SendPriority = iota
+	PriorityAlert
+	PriorityBulk
+	priorityCount
+)
+
+var priorityNames = [priorityCount]string{"interactive", "alert", "bulk"}
+
+const (
+	// sendQueuePruneInterval is how often idle targets are forgotten.
+	sendQueuePruneInterval = time.Minute
+	// partedTTL is how long messages for a parted channel are dropped. It
+	// only has to outlast answers that were still being worked on.
+	partedTTL = 10 * time.Minute
+)
+
+var sendQueueStats = expvar.NewMap("SendQueue")
+
+var (
+	sendQueuesMu sync.RWMutex
+	sendQueues   = make(map[*girc.Client]*SendQueue)
+)
+
+// queuedMessage is what the queue schedules. It usually holds a single
+// PRIVMSG but a multiline batch is kept together so it goes out in one go.
+type queuedMessage struct {
+	Target string
+	Events []*girc.Event
+	// Reply is set for answers to someone, the loop detector only looks at
+	// those. To is the nick that was answered.
+	Reply bool
+	To    string
+}
+
+type tokenBucket struct {
+	tokens float64
+	rate   float64
+	burst  float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		tokens: float64(burst),
+		rate:   rate,
+		burst:  float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (bucket *tokenBucket) refill(now time.Time) {
+	// a bucket made after now was taken has nothing to refill yet.
+	if now.Before(bucket.last) {
+		return
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+
+	bucket.last = now
+}
+
+func (bucket *tokenBucket) ready(now time.Time) bool {
+	bucket.refill(now)
+
+	return bucket.tokens >= 1
+}
+
+// take uses up tokens for count lines. A batch can cost more than the bucket
+// holds, the bucket then goes below zero and the lines after it wait longer.
+func (bucket *tokenBucket) take(count int) {
+	bucket.tokens -= float64(count)
+}
+
+// wait returns how long it will take for the bucket to have a token.
+func (bucket *tokenBucket) wait() time.Duration {
+	if bucket.tokens >= 1 || bucket.rate <= 0 {
+		return 0
+	}
+
+	return time.Duration((1 - bucket.tokens) / bucket.rate * float64(time.Second))
+}
+
+// SendQueue sits in front of girc's Send and decides which message goes out
+// next. Higher priorities are always drained first, and within a priority a
+// target that has used up its own budget does not hold up the other targets.
+type SendQueue struct {
+	mu          sync.Mutex
+	client      *girc.Client
+	name        string
+	queues      [priorityCount][]queuedMessage
+	global      *tokenBucket
+	targets     map[string]*tokenBucket
+	parted      map[string]time.Time
+	targetRate  float64
+	targetBurst int
+	maxDepth    int
+	wake        chan struct{}
+}
+
+func NewSendQueue(client *girc.Client, appConfig *TomlConfig) *SendQueue {
+	return &SendQueue{
+		client:      client,
+		name:        appConfig.IRCDName,
+		global:      newTokenBucket(appConfig.SendQueueGlobalRate, appConfig.SendQueueGlobalBurst),
+		targets:     make(map[string]*tokenBucket),
+		parted:      make(map[string]time.Time),
+		targetRate:  appConfig.SendQueueTargetRate,
+		targetBurst: appConfig.SendQueueTargetBurst,
+		maxDepth:    appConfig.SendQueueMaxDepth,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+func (queue *SendQueue) statKey(suffix string) string {
+	return queue.name + "." + suffix
+}
+
+func (queue *SendQueue) updateDepth(priority SendPriority) {
+	depth := new(expvar.Int)
+	depth.Set(int64(len(queue.queues[priority])))
+	sendQueueStats.Set(queue.statKey("depth."+priorityNames[priority]), depth)
+}
+
+func (queue *SendQueue) Enqueue(priority SendPriority, target string, events ...*girc.Event) {
+	queue.enqueue(priority, queuedMessage{Target: target, Events: events})
+}
+
+func (queue *SendQueue) enqueue(priority SendPriority, msg queuedMessage) {
+	target := msg.Target
+
+	queue.mu.Lock()
+
+	if _, parted := queue.parted[strings.ToLower(target)]; parted {
+		queue.mu.Unlock()
+		sendQueueStats.Add(queue.statKey("dropped.parted"), 1)
+
+		return
+	}
+
+	if queue.maxDepth > 0 && len(queue.queues[priority]) >= queue.maxDepth {
+		queue.mu.Unlock()
+		sendQueueStats.Add(queue.statKey("dropped.full."+priorityNames[priority]), 1)
+		slog.Warn("send queue is full, dropping message", "network", queue.name, "priority", priorityNames[priority], "target", target)
+
+		return
+	}
+
+	queue.queues[priority] = append(queue.queues[priority], msg)
+	queue.updateDepth(priority)
+	queue.mu.Unlock()
+
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SendNow sends events right away if the global bucket has a token and
+// drops them otherwise. It leaves the target's bucket alone, so it is meant
+// for things like typing notifications that must not hold up the messages
+// they are about.
+func (queue *SendQueue) SendNow(target string, events ...*girc.Event) {
+	queue.mu.Lock()
+
+	_, parted := queue.parted[strings.ToLower(target)]
+	if parted || !queue.client.IsConnected() || !queue.global.ready(time.Now()) {
+		queue.mu.Unlock()
+		sendQueueStats.Add(queue.statKey("dropped.now"), 1)
+
+		return
+	}
+
+	queue.global.take(len(events))
+	queue.mu.Unlock()
+
+	sendEvents(queue.client, events)
+}
+
+// Drop removes everything queued for a target and stops accepting new
+// messages for it until the bot joins it again.
+func (queue *SendQueue) Drop(target string) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	queue.parted[strings.ToLower(target)] = time.Now()
+
+	for priority := range priorityCount {
+		kept := queue.queues[priority][:0]
+
+		for _, msg := range queue.queues[priority] {
+			if strings.EqualFold(msg.Target, target) {
+				sendQueueStats.Add(queue.statKey("dropped.parted"), 1)
+
+				continue
+			}
+
+			kept = append(kept, msg)
+		}
+
+		queue.queues[priority] = kept
+		queue.updateDepth(priority)
+	}
+}
+
+func (queue *SendQueue) Rejoined(target string) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	delete(queue.parted, strings.ToLower(target))
+}
+
+func (queue *SendQueue) Depths() [priorityCount]int {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	var depths [priorityCount]int
+
+	for priority := range priorityCount {
+		depths[priority] = len(queue.queues[priority])
+	}
+
+	return depths
+}
+
+func (queue *SendQueue) targetBucket(target string) *tokenBucket {
+	key := strings.ToLower(target)
+
+	bucket, ok := queue.targets[key]
+	if !ok {
+		bucket = newTokenBucket(queue.targetRate, queue.targetBurst)
+		queue.targets[key] = bucket
+	}
+
+	return bucket
+}
+
+// prune forgets the buckets of targets that have nothing queued and a full
+// bucket, they would be created the same way again, and parted channels
+// that were left long enough ago.
+func (queue *SendQueue) prune(now time.Time) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	queued := make(map[string]bool)
+
+	for priority := range priorityCount {
+		for _, msg := range queue.queues[priority] {
+			queued[strings.ToLower(msg.Target)] = true
+		}
+	}
+
+	for target, bucket := range queue.targets {
+		bucket.refill(now)
+
+		if !queued[target] && bucket.tokens >= bucket.burst {
+			delete(queue.targets, target)
+		}
+	}
+
+	for target, partedAt := range queue.parted {
+		if now.Sub(partedAt) > partedTTL {
+			delete(queue.parted, target)
+		}
+	}
+}
+
+// next pops the next sendable message. If nothing can be sent right now it
+// returns how long to wait before trying again.
+func (queue *SendQueue) next() (*queuedMessage, time.Duration) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	now := time.Now()
+
+	if !queue.global.ready(now) {
+		return nil, queue.global.wait()
+	}
+
+	var shortestWait time.Duration
+
+	for priority := range priorityCount {
+		for index, msg := range queue.queues[priority] {
+			bucket := queue.targetBucket(msg.Target)
+			if !bucket.ready(now) {
+				if wait := bucket.wait(); shortestWait == 0 || wait < shortestWait {
+					shortestWait = wait
+				}
+
+				continue
+			}
+
+			// every line of a multiline batch goes out on its own.
+			bucket.take(len(msg.Events))
+			queue.global.take(len(msg.Events))
+
+			queue.queues[priority] = append(queue.queues[priority][:index], queue.queues[priority][index+1:]...)
+			queue.updateDepth(priority)
+
+			return &msg, 0
+		}
+	}
+
+	return nil, shortestWait
+}
+
+// Run sends queued messages until ctx is cancelled.
+func (queue *SendQueue) Run(ctx context.Context) {
+	pruneTicker := time.NewTicker(sendQueuePruneInterval)
+	defer pruneTicker.Stop()
+
+	for {
+		if !queue.client.IsConnected() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+
+			continue
+		}
+
+		msg, wait := queue.next()
+		if msg != nil {
+			sendEvents(queue.client, msg.Events)
+
+			if msg.Reply {
+				noteReply(queue.client, msg.Target, msg.To)
+			}
+
+			sendQueueStats.Add(queue.statKey("sent"), 1)
+
+			continue
+		}
+
+		var timer <-chan time.Time
+		if wait > 0 {
+			timer = time.After(wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-queue.wake:
+		case <-timer:
+		case now := <-pruneTicker.C:
+			queue.prune(now)
+		}
+	}
+}
+
+func sendEvents(client *girc.Client, events []*girc.Event) {
+	for _, event := range events {
+		countSent(client, event)
+		client.Send(event)
+	}
+}
+
+func getSendQueue(client *girc.Client) *SendQueue {
+	sendQueuesMu.RLock()
+	defer sendQueuesMu.RUnlock()
+
+	return sendQueues[client]
+}
+
+func registerSendQueue(client *girc.Client, queue *SendQueue) {
+	sendQueuesMu.Lock()
+	defer sendQueuesMu.Unlock()
+
+	sendQueues[client] = queue
+}
+
+func unregisterSendQueue(client *girc.Client) {
+	sendQueuesMu.Lock()
+	defer sendQueuesMu.Unlock()
+
+	delete(sendQueues, client)
+}
+
+func isSelf(client *girc.Client, event girc.Event) bool {
+	return event.Source != nil && strings.EqualFold(event.Source.Name, client.GetNick())
+}
+
+// runSendQueue runs the network's send queue until ctx is cancelled, which
+// happens when the network is stopped.
+func runSendQueue(ctx context.Context, irc *girc.Client, appConfig *TomlConfig) {
+	queue := NewSendQueue(irc, appConfig)
+	registerSendQueue(irc, queue)
+
+	defer unregisterSendQueue(irc)
+
+	irc.Handlers.AddBg(girc.PART, func(client *girc.Client, event girc.Event) {
+		if isSelf(client, event) && len(event.Params) > 0 {
+			queue.Drop(event.Params[0])
+		}
+	})
+
+	irc.Handlers.AddBg(girc.KICK, func(client *girc.Client, event girc.Event) {
+		if len(event.Params) > 1 && strings.EqualFold(event.Params[1], client.GetNick()) {
+			queue.Drop(event.Params[0])
+		}
+	})
+
+	irc.Handlers.AddBg(girc.JOIN, func(client *girc.Client, event girc.Event) {
+		if isSelf(client, event) && len(event.Params) > 0 {
+			queue.Rejoined(event.Params[0])
+		}
+	})
+
+	queue.Run(ctx)
+}
+
+// QueueEvents hands events for a single target to the network's send queue.
+// When the queue is disabled (allowFlood) they are sent directly.
+func QueueEvents(client *girc.Client, priority SendPriority, target string, events ...*girc.Event) {
+	queue := getSendQueue(client)
+	if queue == nil {
+		sendEvents(client, events)
+
+		return
+	}
+
+	queue.Enqueue(priority, target, events...)
+}
+
+// queueReply queues an answer to event at interactive priority.
+func queueReply(client *girc.Client, event girc.Event, target string, events ...*girc.Event) {
+	if target == "" {
+		return
+	}
+
+	var to string
+	if event.Source != nil {
+		to = event.Source.Name
+	}
+
+	queue := getSendQueue(client)
+	if queue == nil {
+		sendEvents(client, events)
+		noteReply(client, target, to)
+
+		return
+	}
+
+	queue.enqueue(PriorityInteractive, queuedMessage{Target: target, Events: events, Reply: true, To: to})
+}
+
+// QueueMessage sends a PRIVMSG through the network's send queue.
+func QueueMessage(client *girc.Client, priority SendPriority, target, message string) {
+	QueueEvents(client, priority, target, &girc.Event{Command: girc.PRIVMSG, Params: []string{target, message}})
+}
+
+// replyTarget is where an answer to event goes. Events from the server have
+// no source, their answer goes to the first parameter.
+func replyTarget(event girc.Event) string {
+	if len(event.Params) > 0 && (event.Source == nil || girc.IsValidChannel(event.Params[0])) {
+		return event.Params[0]
+	}
+
+	if event.Source == nil {
+		return ""
+	}
+
+	return event.Source.Name
+}
+
+// QueueReply is the queued version of girc's Cmd.Reply.
+func QueueReply(client *girc.Client, event girc.Event, message string) {
+	target := replyTarget(event)
+
+	queueReply(client, event, target, &girc.Event{
+		Command: girc.PRIVMSG,
+		Params:  []string{target, message},
+		Tags:    replyTags(client, event),
+	})
+}
+
+// QueueReplyTo is the queued version of girc's Cmd.ReplyTo.
+func QueueReplyTo(client *girc.Client, event girc.Event, message string) {
+	target := replyTarget(event)
+
+	if girc.IsValidChannel(target) && event.Source != nil {
+		message = event.Source.Name + ", " + message
+	}
+
+	queueReply(client, event, target, &girc.Event{
+		Command: girc.PRIVMSG,
+		Params:  []string{target, message},
+		Tags:    replyTags(client, event),
+	})
+}
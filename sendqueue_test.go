@@ -0,0 +1,192 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+func newTestSendQueue(globalBurst, targetBurst int) *SendQueue {
+	client := girc.New(girc.Config{Server: "irc.example.com", Nick: "milla", User: "milla"})
+
+	// the rates are low enough that nothing refills while a test runs.
+	return NewSendQueue(client, &TomlConfig{
+		IRCDName:             "test",
+		SendQueueGlobalRate:  0.001,
+		SendQueueGlobalBurst: globalBurst,
+		SendQueueTargetRate:  0.001,
+		SendQueueTargetBurst: targetBurst,
+	})
+}
+
+func privmsg(target, text string) *girc.Event {
+	return &girc.Event{Command: girc.PRIVMSG, Params: []string{target, text}}
+}
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	bucket := &tokenBucket{tokens: 2, rate: 1, burst: 2, last: start}
+
+	if !bucket.ready(start) {
+		t.Fatal("a full bucket is not ready")
+	}
+
+	bucket.take(3)
+
+	if bucket.ready(start) {
+		t.Fatal("a bucket in debt is ready")
+	}
+
+	if wait := bucket.wait(); wait != 2*time.Second {
+		t.Errorf("got wait %v, want 2s", wait)
+	}
+
+	if bucket.ready(start.Add(1500 * time.Millisecond)) {
+		t.Error("ready before the debt is paid off")
+	}
+
+	if !bucket.ready(start.Add(2 * time.Second)) {
+		t.Error("not ready once the debt is paid off")
+	}
+
+	bucket.refill(start.Add(time.Hour))
+
+	if bucket.tokens != bucket.burst {
+		t.Errorf("got %v tokens, want the burst of %v", bucket.tokens, bucket.burst)
+	}
+}
+
+func TestSendQueuePriorities(t *testing.T) {
+	queue := newTestSendQueue(10, 10)
+
+	queue.Enqueue(PriorityBulk, "#a", privmsg("#a", "bulk"))
+	queue.Enqueue(PriorityAlert, "#a", privmsg("#a", "alert"))
+	queue.Enqueue(PriorityInteractive, "#a", privmsg("#a", "interactive"))
+
+	for _, want := range []string{"interactive", "alert", "bulk"} {
+		msg, _ := queue.next()
+		if msg == nil {
+			t.Fatalf("nothing sent, want %s", want)
+		}
+
+		if got := msg.Events[0].Last(); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestSendQueueTargetBudget(t *testing.T) {
+	queue := newTestSendQueue(10, 1)
+
+	queue.Enqueue(PriorityInteractive, "#a", privmsg("#a", "first"))
+	queue.Enqueue(PriorityInteractive, "#a", privmsg("#a", "second"))
+	queue.Enqueue(PriorityInteractive, "#b", privmsg("#b", "other"))
+
+	for _, want := range []string{"first", "other"} {
+		msg, _ := queue.next()
+		if msg == nil || msg.Events[0].Last() != want {
+			t.Fatalf("got %+v, want %s", msg, want)
+		}
+	}
+
+	msg, wait := queue.next()
+	if msg != nil {
+		t.Fatalf("sent %s with the target's budget used up", msg.Events[0].Last())
+	}
+
+	if wait <= 0 {
+		t.Errorf("got wait %v, want the time until #a has a token", wait)
+	}
+}
+
+func TestSendQueueChargesEveryLine(t *testing.T) {
+	queue := newTestSendQueue(5, 5)
+
+	queue.Enqueue(PriorityInteractive, "#a", privmsg("#a", "one"), privmsg("#a", "two"), privmsg("#a", "three"))
+	queue.Enqueue(PriorityInteractive, "#b", privmsg("#b", "one"), privmsg("#b", "two"), privmsg("#b", "three"))
+
+	if msg, _ := queue.next(); msg == nil {
+		t.Fatal("the first batch was not sent")
+	}
+
+	if tokens := queue.global.tokens; tokens < 1.9 || tokens > 2.1 {
+		t.Errorf("got %v global tokens left, want 2", tokens)
+	}
+
+	if msg, _ := queue.next(); msg == nil {
+		t.Fatal("the second batch was not sent with 2 tokens left")
+	}
+
+	queue.Enqueue(PriorityInteractive, "#c", privmsg("#c", "late"))
+
+	if msg, _ := queue.next(); msg != nil {
+		t.Error("sent a line while the global bucket is in debt")
+	}
+}
+
+func TestSendQueueDropsParted(t *testing.T) {
+	queue := newTestSendQueue(10, 10)
+
+	queue.Enqueue(PriorityBulk, "#a", privmsg("#a", "queued"))
+	queue.Drop("#A")
+	queue.Enqueue(PriorityBulk, "#a", privmsg("#a", "after"))
+
+	if depths := queue.Depths(); depths[PriorityBulk] != 0 {
+		t.Fatalf("got %d bulk messages, want none for a parted channel", depths[PriorityBulk])
+	}
+
+	queue.Rejoined("#a")
+	queue.Enqueue(PriorityBulk, "#a", privmsg("#a", "rejoined"))
+
+	if depths := queue.Depths(); depths[PriorityBulk] != 1 {
+		t.Errorf("got %d bulk messages, want 1 after rejoining", depths[PriorityBulk])
+	}
+}
+
+func TestSendQueuePrune(t *testing.T) {
+	queue := newTestSendQueue(10, 10)
+
+	queue.targets["#idle"] = newTokenBucket(1, 1)
+	queue.targets["#busy"] = newTokenBucket(1, 1)
+	queue.Enqueue(PriorityBulk, "#busy", privmsg("#busy", "waiting"))
+	queue.parted["#old"] = time.Now().Add(-2 * partedTTL)
+	queue.parted["#new"] = time.Now()
+
+	queue.prune(time.Now().Add(time.Second))
+
+	if _, ok := queue.targets["#idle"]; ok {
+		t.Error("kept the bucket of an idle target")
+	}
+
+	if _, ok := queue.targets["#busy"]; !ok {
+		t.Error("dropped the bucket of a target with queued messages")
+	}
+
+	if _, ok := queue.parted["#old"]; ok {
+		t.Error("kept a channel parted long ago")
+	}
+
+	if _, ok := queue.parted["#new"]; !ok {
+		t.Error("forgot a channel that was just parted")
+	}
+}
+
+func TestReplyTarget(t *testing.T) {
+	tests := []struct {
+		name  string
+		event girc.Event
+		want  string
+	}{
+		{"channel", girc.Event{Source: &girc.Source{Name: "nick"}, Params: []string{"#milla", "hi"}}, "#milla"},
+		{"private", girc.Event{Source: &girc.Source{Name: "nick"}, Params: []string{"milla", "hi"}}, "nick"},
+		{"server", girc.Event{Params: []string{"milla", "hi"}}, "milla"},
+		{"nothing", girc.Event{}, ""},
+	}
+
+	for _, test := range tests {
+		if got := replyTarget(test.event); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
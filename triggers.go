@@ -0,0 +1,218 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/lrstanley/girc"
+)
+
+// commandMarker is what marks a command once the bot has been addressed,
+// e.g. "milla: /help".
+const commandMarker = "/"
+
+var (
+	triggerRegexMu    sync.Mutex
+	triggerRegexCache = make(map[string]*regexp.Regexp)
+)
+
+// TriggerMatch is the result of deciding whether a message is for the bot.
+type TriggerMatch struct {
+	// Text is the prompt, or for commands the command line without the
+	// prefix, e.g. "roll 1 6".
+	Text      string
+	IsCommand bool
+}
+
+func compileTriggerRegex(expression string) *regexp.Regexp {
+	triggerRegexMu.Lock()
+	defer triggerRegexMu.Unlock()
+
+	if re, ok := triggerRegexCache[expression]; ok {
+		return re
+	}
+
+	re, err := regexp.Compile(expression)
+	if err != nil {
+		LogError(err)
+	}
+
+	triggerRegexCache[expression] = re
+
+	return re
+}
+
+// getTriggers returns the trigger config that applies to a target. Fields
+// set for a channel under channelTriggers replace the network-wide ones.
+func getTriggers(appConfig *TomlConfig, target string) TriggerConfig {
+	triggers := appConfig.Triggers
+
+	for channel, channelTriggers := range appConfig.ChannelTriggers {
+		if !strings.EqualFold(channel, target) {
+			continue
+		}
+
+		if len(channelTriggers.CommandPrefixes) > 0 {
+			triggers.CommandPrefixes = channelTriggers.CommandPrefixes
+		}
+
+		if len(channelTriggers.NickAliases) > 0 {
+			triggers.NickAliases = channelTriggers.NickAliases
+		}
+
+		if channelTriggers.MentionAnywhere {
+			triggers.MentionAnywhere = true
+		}
+
+		if channelTriggers.Regex != "" {
+			triggers.Regex = channelTriggers.Regex
+		}
+	}
+
+	return triggers
+}
+
+func botNicks(client *girc.Client, appConfig *TomlConfig, triggers TriggerConfig) []string {
+	nicks := []string{appConfig.IrcNick}
+
+	if client != nil && client.IsConnected() {
+		if currentNick := client.GetNick(); currentNick != "" && !strings.EqualFold(currentNick, appConfig.IrcNick) {
+			nicks = append(nicks, currentNick)
+		}
+	}
+
+	return append(nicks, triggers.NickAliases...)
+}
+
+// stripAddress removes a leading "nick:" or "nick," and reports whether the
+// message started with one of the given nicks.
+func stripAddress(message string, nicks []string) (string, bool) {
+	for _, nick := range nicks {
+		if len(message) <= len(nick) || !strings.EqualFold(message[:len(nick)], nick) {
+			continue
+		}
+
+		switch message[len(nick)] {
+		case ':', ',':
+			return strings.TrimSpace(message[len(nick)+1:]), true
+		}
+	}
+
+	return message, false
+}
+
+func isNickChar(char byte) bool {
+	return char == '-' || char == '_' || char == '[' || char == ']' || char == '\\' ||
+		char == '`' || char == '^' || char == '{' || char == '}' || char == '|' ||
+		(char >= '0' && char <= '9') || (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+}
+
+// mentions reports whether any of the nicks appears as a word in message.
+func mentions(message string, nicks []string) bool {
+	lowered := strings.ToLower(message)
+
+	for _, nick := range nicks {
+		nick = strings.ToLower(nick)
+		if nick == "" {
+			continue
+		}
+
+		for offset := 0; ; {
+			index := strings.Index(lowered[offset:], nick)
+			if index < 0 {
+				break
+			}
+
+			start := offset + index
+			end := start + len(nick)
+
+			if (start == 0 || !isNickChar(lowered[start-1])) && (end == len(lowered) || !isNickChar(lowered[end])) {
+				return true
+			}
+
+			offset = end
+		}
+	}
+
+	return false
+}
+
+func splitCommand(text string, prefixes []string) (string, bool) {
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(text, prefix) && len(text) > len(prefix) {
+			return strings.TrimSpace(text[len(prefix):]), true
+		}
+	}
+
+	return text, false
+}
+
+// parseTrigger is the one place that decides whether a PRIVMSG is meant for
+// the bot. It looks at, in order: private queries, "nick:" and "nick,"
+// (including the nick aliases), bare command prefixes such as "!", the
+// regex hook and finally mentions of the nick anywhere in the message.
+func parseTrigger(client *girc.Client, event girc.Event, appConfig *TomlConfig) (TriggerMatch, bool) {
+	message := strings.TrimSpace(event.Last())
+	if message == "" || len(event.Params) == 0 {
+		return TriggerMatch{}, false
+	}
+
+	triggers := getTriggers(appConfig, event.Params[0])
+	nicks := botNicks(client, appConfig, triggers)
+	commandPrefixes := append([]string{commandMarker}, triggers.CommandPrefixes...)
+
+	text, addressed := stripAddress(message, nicks)
+
+	if addressed || isPrivateMessage(event) {
+		if commandLine, ok := splitCommand(text, commandPrefixes); ok {
+			return TriggerMatch{Text: commandLine, IsCommand: true}, true
+		}
+
+		return TriggerMatch{Text: text}, text != ""
+	}
+
+	if commandLine, ok := splitCommand(message, triggers.CommandPrefixes); ok {
+		return TriggerMatch{Text: commandLine, IsCommand: true}, true
+	}
+
+	if triggers.Regex != "" {
+		if re := compileTriggerRegex(triggers.Regex); re != nil {
+			if submatches := re.FindStringSubmatch(message); submatches != nil {
+				prompt := message
+
+				if index := re.SubexpIndex("prompt"); index > 0 && submatches[index] != "" {
+					prompt = strings.TrimSpace(submatches[index])
+				}
+
+				slog.Debug("message matched trigger regex", "network", appConfig.IRCDName)
+
+				return TriggerMatch{Text: prompt}, true
+			}
+		}
+	}
+
+	if triggers.MentionAnywhere && mentions(message, nicks) {
+		return TriggerMatch{Text: message}, true
+	}
+
+	return TriggerMatch{}, false
+}
+
+// commandText returns the command line for runCommand. Aliases call
+// runCommand with their own text which is not addressed to the bot so that
+// falls back to the message itself.
+func commandText(client *girc.Client, event girc.Event, appConfig *TomlConfig) string {
+	match, ok := parseTrigger(client, event, appConfig)
+	if ok && match.IsCommand {
+		return match.Text
+	}
+
+	text := strings.TrimSpace(event.Last())
+	triggers := getTriggers(appConfig, event.Params[0])
+
+	commandLine, _ := splitCommand(text, append([]string{commandMarker}, triggers.CommandPrefixes...))
+
+	return commandLine
+}
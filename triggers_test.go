@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lrstanley/girc"
+)
+
+func TestParseTrigger(t *testing.T) {
+	appConfig := &TomlConfig{
+		IrcNick:  "milla",
+		Triggers: TriggerConfig{CommandPrefixes: []string{"!"}, NickAliases: []string{"mil"}},
+		ChannelTriggers: map[string]TriggerConfig{
+			"#Mentions": {MentionAnywhere: true},
+			"#regex":    {Regex: `^hey bot,? (?P<prompt>.+)`},
+			"#bang":     {CommandPrefixes: []string{"."}},
+		},
+	}
+
+	tests := []struct {
+		target    string
+		message   string
+		want      TriggerMatch
+		triggered bool
+	}{
+		{"#milla", "milla: hello", TriggerMatch{Text: "hello"}, true},
+		{"#milla", "Milla, hello", TriggerMatch{Text: "hello"}, true},
+		{"#milla", "mil: hello", TriggerMatch{Text: "hello"}, true},
+		{"#milla", "milla: /roll 1 6", TriggerMatch{Text: "roll 1 6", IsCommand: true}, true},
+		{"#milla", "milla: !help", TriggerMatch{Text: "help", IsCommand: true}, true},
+		{"#milla", "!help", TriggerMatch{Text: "help", IsCommand: true}, true},
+		{"#milla", "!", TriggerMatch{}, false},
+		{"#milla", "/help", TriggerMatch{}, false},
+		{"#milla", "milla:", TriggerMatch{}, false},
+		{"#milla", "millabot: hello", TriggerMatch{}, false},
+		{"#milla", "hello milla", TriggerMatch{}, false},
+		{"#milla", "   ", TriggerMatch{}, false},
+		{"milla", "hello", TriggerMatch{Text: "hello"}, true},
+		{"milla", "/help", TriggerMatch{Text: "help", IsCommand: true}, true},
+		{"#mentions", "what does milla think?", TriggerMatch{Text: "what does milla think?"}, true},
+		{"#mentions", "ask camilla", TriggerMatch{}, false},
+		{"#regex", "hey bot, what time is it", TriggerMatch{Text: "what time is it"}, true},
+		{"#regex", "hey you", TriggerMatch{}, false},
+		{"#bang", ".help", TriggerMatch{Text: "help", IsCommand: true}, true},
+		{"#bang", "!help", TriggerMatch{}, false},
+	}
+
+	for _, test := range tests {
+		event := girc.Event{
+			Source:  &girc.Source{Name: "nick"},
+			Command: girc.PRIVMSG,
+			Params:  []string{test.target, test.message},
+		}
+
+		match, triggered := parseTrigger(nil, event, appConfig)
+		if triggered != test.triggered || match != test.want {
+			t.Errorf("%s %q: got %+v, %v, want %+v, %v", test.target, test.message, match, triggered, test.want, test.triggered)
+		}
+	}
+}
+
+func TestCommandText(t *testing.T) {
+	appConfig := &TomlConfig{IrcNick: "milla", Triggers: TriggerConfig{CommandPrefixes: []string{"!"}}}
+
+	for message, want := range map[string]string{
+		"milla: /roll 1 6": "roll 1 6",
+		"!roll 1 6":        "roll 1 6",
+		"/roll 1 6":        "roll 1 6",
+	} {
+		event := girc.Event{Command: girc.PRIVMSG, Params: []string{"#milla", message}}
+
+		if got := commandText(nil, event, appConfig); got != want {
+			t.Errorf("%q: got %q, want %q", message, got, want)
+		}
+	}
+}
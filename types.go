@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"log/slog"
 	"runtime"
 	"time"
 
@@ -60,11 +62,42 @@ type TriggeredScripts struct {
 	TriggerTypes []string
 }
 
+type TriggerConfig struct {
+	CommandPrefixes []string `toml:"commandPrefixes"`
+	NickAliases     []string `toml:"nickAliases"`
+	MentionAnywhere bool     `toml:"mentionAnywhere"`
+	Regex           string   `toml:"regex"`
+}
+
+type Role struct {
+	Rank     int      `toml:"rank"`
+	Accounts []string `toml:"accounts"`
+	Masks    []string `toml:"masks"`
+	Channels []string `toml:"channels"`
+}
+
+// Permissions maps command names to the role needed to use them.
+type Permissions map[string]string
+
 type RssFile struct {
 	RssFile string   `toml:"rssFile"`
 	Channel []string `toml:"channel"`
 }
 
+// Schedule runs one of a custom command, an alias, a lua command or a user
+// agent action in a channel whenever its cron expression matches.
+type Schedule struct {
+	Cron            string   `toml:"cron"`
+	Channel         []string `toml:"channel"`
+	CustomCommand   string   `toml:"customCommand"`
+	Alias           string   `toml:"alias"`
+	LuaFunction     string   `toml:"luaFunction"`
+	UserAgentAction string   `toml:"userAgentAction"`
+	Args            string   `toml:"args"`
+	Timezone        string   `toml:"timezone"`
+	CatchUp         bool     `toml:"catchUp"`
+}
+
 type TomlConfig struct {
 	IrcServer                     string                   `toml:"ircServer"`
 	IrcNick                       string                   `toml:"ircNick"`
@@ -77,6 +110,8 @@ type TomlConfig struct {
 	Provider                      string                   `toml:"provider"`
 	Apikey                        string                   `toml:"apikey"`
 	ClientCertPath                string                   `toml:"clientCertPath"`
+	ClientKeyPath                 string                   `toml:"clientKeyPath"`
+	SaslMechanism                 string                   `toml:"saslMechanism"`
 	ServerPass                    string                   `toml:"serverPass"`
 	Bind                          string                   `toml:"bind"`
 	Name                          string                   `toml:"name"`
@@ -93,8 +128,15 @@ type TomlConfig struct {
 	WebIRCHostname                string                   `toml:"webIRCHostname"`
 	WebIRCAddress                 string                   `toml:"webIRCAddress"`
 	RSSFile                       string                   `toml:"rssFile"`
+	OverridesFile                 string                   `toml:"overridesFile"`
+	DefaultTimezone               string                   `toml:"defaultTimezone"`
 	AnthropicVersion              string                   `toml:"anthropicVersion"`
+	NickRegain                    string                   `toml:"nickRegain"`
+	NickServName                  string                   `toml:"nickServName"`
+	QuietMode                     string                   `toml:"quietMode"`
+	QuietMaskPrefix               string                   `toml:"quietMaskPrefix"`
 	Plugins                       []string                 `toml:"plugins"`
+	URLTitleChannels              []string                 `toml:"urlTitleChannels"`
 	Context                       []string                 `toml:"context"`
 	SystemPrompt                  string                   `toml:"systemPrompt"`
 	CustomCommands                map[string]CustomCommand `toml:"customCommands"`
@@ -105,6 +147,12 @@ type TomlConfig struct {
 	Rss                           map[string]RssFile          `toml:"rss"`
 	UserAgentActions              map[string]UserAgentRequest `toml:"userAgentActions"`
 	Aliases                       map[string]Alias            `toml:"aliases"`
+	Schedules                     map[string]Schedule         `toml:"schedules"`
+	Triggers                      TriggerConfig               `toml:"triggers"`
+	ChannelTriggers               map[string]TriggerConfig    `toml:"channelTriggers"`
+	Roles                         map[string]Role             `toml:"roles"`
+	Permissions                   Permissions                 `toml:"permissions"`
+	ChannelPermissions            map[string]Permissions      `toml:"channelPermissions"`
 	RequestTimeout                int                         `toml:"requestTimeout"`
 	MillaReconnectDelay           int                         `toml:"millaReconnectDelay"`
 	IrcPort                       int                         `toml:"ircPort"`
@@ -133,6 +181,11 @@ type TomlConfig struct {
 	DbBackOffRandomizationFactor  float64                     `toml:"dbBackOffRandomizationFactor"`
 	DbBackOffMultiplier           float64                     `toml:"dbBackOffMultiplier"`
 	DbBackOffMaxInterval          int                         `toml:"dbBackOffMaxInterval"`
+	SendQueueGlobalRate           float64                     `toml:"sendQueueGlobalRate"`
+	SendQueueGlobalBurst          int                         `toml:"sendQueueGlobalBurst"`
+	SendQueueTargetRate           float64                     `toml:"sendQueueTargetRate"`
+	SendQueueTargetBurst          int                         `toml:"sendQueueTargetBurst"`
+	SendQueueMaxDepth             int                         `toml:"sendQueueMaxDepth"`
 	EnableSasl                    bool                        `toml:"enableSasl"`
 	SkipTLSVerify                 bool                        `toml:"skipTLSVerify"`
 	UseTLS                        bool                        `toml:"useTLS"`
@@ -141,8 +194,38 @@ type TomlConfig struct {
 	Debug                         bool                        `toml:"debug"`
 	Out                           bool                        `toml:"out"`
 	AdminOnly                     bool                        `toml:"adminOnly"`
+	DisablePrivateMessages        bool                        `toml:"disablePrivateMessages"`
+	PrivateAdminOnly              bool                        `toml:"privateAdminOnly"`
+	PrivateRateLimit              float64                     `toml:"privateRateLimit"`
+	PrivateRateBurst              int                         `toml:"privateRateBurst"`
+	AllowBots                     bool                        `toml:"allowBots"`
+	LoopReplyWindow               int                         `toml:"loopReplyWindow"`
+	LoopStrikes                   int                         `toml:"loopStrikes"`
+	LoopIgnoreDuration            int                         `toml:"loopIgnoreDuration"`
+	InsecureNickAdmins            bool                        `toml:"insecureNickAdmins"`
+	NickServIdentify              bool                        `toml:"nickServIdentify"`
+	RepostNotice                  bool                        `toml:"repostNotice"`
+	RejoinOnKick                  bool                        `toml:"rejoinOnKick"`
+	RejoinDelay                   int                         `toml:"rejoinDelay"`
+	AcceptInvites                 bool                        `toml:"acceptInvites"`
+	ChannelCheckInterval          int                         `toml:"channelCheckInterval"`
+	URLFetchTimeout               int                         `toml:"urlFetchTimeout"`
+	URLFetchMaxBytes              int                         `toml:"urlFetchMaxBytes"`
 	pool                          *pgxpool.Pool
+	queryLimiter                  *rateLimiter
+	ignoreList                    *IgnoreList
+	timedBans                     *TimedBans
+	state                         *configState
+	overrides                     *Overrides
+	reminders                     *Reminders
+	scheduler                     *Scheduler
+	tells                         *pendingTells
 	Admins                        []string   `toml:"admins"`
+	AdminAccounts                 []string   `toml:"adminAccounts"`
+	AdminMasks                    []string   `toml:"adminMasks"`
+	IgnoredNicks                  []string   `toml:"ignoredNicks"`
+	IgnoredMasks                  []string   `toml:"ignoredMasks"`
+	IgnoredAccounts               []string   `toml:"ignoredAccounts"`
 	IrcChannels                   [][]string `toml:"ircChannels"`
 	ScrapeChannels                [][]string `toml:"scrapeChannels"`
 }
@@ -207,9 +290,79 @@ func (config *TomlConfig) deleteTriggeredScript(name string) {
 	delete(config.TriggeredScripts, name)
 }
 
+// Relay mirrors messages between channels on different networks. Ends are
+// network:#channel, with oneWay only the first end is relayed to the others.
+type Relay struct {
+	Ends     []string `toml:"ends"`
+	Ignore   []string `toml:"ignore"`
+	OneWay   bool     `toml:"oneWay"`
+	JoinPart bool     `toml:"joinPart"`
+	NoColors bool     `toml:"noColors"`
+}
+
+// WebhookRoute is one incoming webhook, served at /hooks/<name>. Requests
+// must carry the bearer token, a valid HMAC-SHA256 signature of the body made
+// with the secret, or both if both are set.
+type WebhookRoute struct {
+	Network         string `toml:"network"`
+	Channel         string `toml:"channel"`
+	Token           string `toml:"token"`
+	Secret          string `toml:"secret"`
+	SignatureHeader string `toml:"signatureHeader"`
+	Template        string `toml:"template"`
+	Preset          string `toml:"preset"`
+}
+
+type WebhookServer struct {
+	Listen       string                  `toml:"listen"`
+	MaxBodyBytes int64                   `toml:"maxBodyBytes"`
+	Routes       map[string]WebhookRoute `toml:"routes"`
+}
+
+// Sink is an HTTP endpoint bot events are posted to as JSON. The filters
+// are matched case-insensitively and an empty one lets everything through.
+type Sink struct {
+	URL            string            `toml:"url"`
+	Secret         string            `toml:"secret"`
+	Headers        map[string]string `toml:"headers"`
+	Events         []string          `toml:"events"`
+	Networks       []string          `toml:"networks"`
+	Channels       []string          `toml:"channels"`
+	Watchlists     []string          `toml:"watchlists"`
+	Timeout        int               `toml:"timeout"`
+	MaxTries       uint              `toml:"maxTries"`
+	MaxElapsedTime int               `toml:"maxElapsedTime"`
+}
+
+// AdminAPI is the local HTTP API for operating the bot. Every request has to
+// send the token as a bearer token.
+type AdminAPI struct {
+	Enabled bool   `toml:"enabled"`
+	Listen  string `toml:"listen"`
+	Token   string `toml:"token"`
+}
+
+// LoggingConfig sets how milla logs. Content logging writes what people say
+// to the bot and what it answers, prompts and scraped messages included.
+type LoggingConfig struct {
+	Format  string `toml:"format"`
+	Level   string `toml:"level"`
+	Content bool   `toml:"content"`
+}
+
+type MetricsServer struct {
+	Listen string `toml:"listen"`
+}
+
 type AppConfig struct {
-	Ircd  map[string]TomlConfig   `toml:"ircd"`
-	Ghost map[string]GhostNetwork `toml:"ghost"`
+	Ircd     map[string]TomlConfig   `toml:"ircd"`
+	Ghost    map[string]GhostNetwork `toml:"ghost"`
+	Relays   map[string]Relay        `toml:"relay"`
+	Webhooks WebhookServer           `toml:"webhooks"`
+	Sinks    map[string]Sink         `toml:"sink"`
+	Admin    AdminAPI                `toml:"admin"`
+	Metrics  MetricsServer           `toml:"metrics"`
+	Logging  LoggingConfig           `toml:"logging"`
 }
 
 type OllamaRequestOptions struct {
@@ -233,7 +386,9 @@ type OllamaChatResponse struct {
 }
 
 type OllamaChatMessagesResponse struct {
-	Messages OllamaChatResponse `json:"message"`
+	Messages        OllamaChatResponse `json:"message"`
+	PromptEvalCount int                `json:"prompt_eval_count"`
+	EvalCount       int                `json:"eval_count"`
 }
 
 type OllamaChatRequest struct {
@@ -294,12 +449,21 @@ type RSSConfig struct {
 }
 
 func LogError(err error) {
+	message := err.Error()
+
+	var attrs []any
+
 	fn, file, line, ok := runtime.Caller(1)
 	if ok {
-		log.Printf("%s: %s-%d >>> %v", runtime.FuncForPC(fn).Name(), file, line, err)
-	} else {
-		log.Print(err)
+		function := runtime.FuncForPC(fn).Name()
+		message = fmt.Sprintf("%s: %s-%d >>> %v", function, file, line, err)
+		attrs = append(attrs, "func", function, "source", fmt.Sprintf("%s:%d", file, line))
 	}
+
+	slog.Error(err.Error(), attrs...)
+
+	recentErrors.Add(redactString(message))
+	emitEvent(BotEvent{Type: EventError, Error: redactString(err.Error())})
 }
 
 func LogErrorFatal(err error) {
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lrstanley/girc"
+	openai "github.com/sashabaranov/go-openai"
+	"golang.org/x/net/html"
+	"golang.org/x/net/proxy"
+	"google.golang.org/genai"
+)
+
+const (
+	maxURLsPerMessage = 3
+	maxURLRedirects   = 5
+	maxTitleLength    = 300
+	summarizeMaxChars = 12000
+)
+
+var (
+	urlRegex = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+	errPrivateAddress = errors.New("refusing to fetch a private or loopback address")
+	errNotHTML        = errors.New("that is not a web page")
+	errNoText         = errors.New("could not find any text on that page")
+)
+
+// cgnatRange is the shared address space carriers use, it is as internal as
+// the RFC 1918 ranges. thisNetworkRange is 0.0.0.0/8, which some systems
+// connect to as if it was the local host.
+var (
+	cgnatRange       = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)} //nolint: mnd,gomnd
+	thisNetworkRange = &net.IPNet{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)}     //nolint: mnd,gomnd
+)
+
+// trimURL drops the punctuation a link is usually followed by in a
+// sentence. A closing parenthesis stays if it has an opening one in the
+// link, like in wikipedia links.
+func trimURL(link string) string {
+	for link != "" {
+		last := link[len(link)-1]
+
+		switch {
+		case last == ')' && strings.Count(link, "(") >= strings.Count(link, ")"):
+			return link
+		case strings.IndexByte(".,;:!?)]}'\x01", last) >= 0:
+			link = link[:len(link)-1]
+		default:
+			return link
+		}
+	}
+
+	return link
+}
+
+// extractURLs finds the http and https links in a message.
+func extractURLs(message string) []string {
+	var urls []string
+
+	for _, match := range urlRegex.FindAllString(message, -1) {
+		match = trimURL(match)
+
+		if _, err := url.Parse(match); err == nil && !slices.Contains(urls, match) {
+			urls = append(urls, match)
+		}
+	}
+
+	return urls
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !cgnatRange.Contains(ip) &&
+		!thisNetworkRange.Contains(ip)
+}
+
+// checkURLHost refuses a URL whose host is not public. Names are resolved
+// and every address checked, unless lookup is false. That is the case with
+// a proxy, looking the name up here would send it to the local resolver
+// and the proxy resolves it again anyway, so only addresses and localhost
+// are checked.
+func checkURLHost(ctx context.Context, target *url.URL, lookup bool) error {
+	host := strings.TrimSuffix(strings.ToLower(target.Hostname()), ".")
+
+	if ip := net.ParseIP(host); ip != nil {
+		if !isPublicIP(ip) {
+			return errPrivateAddress
+		}
+
+		return nil
+	}
+
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errPrivateAddress
+	}
+
+	if !lookup {
+		return nil
+	}
+
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+		if !isPublicIP(address.IP) {
+			return errPrivateAddress
+		}
+	}
+
+	return nil
+}
+
+// urlHTTPClient returns the client links are fetched with. It goes through
+// GeneralProxy if it is set. Without a proxy the address that is actually
+// dialed is checked too, so a DNS answer that changes in between doesn't
+// get around the check. With a proxy names are only resolved by the proxy,
+// which has to refuse private addresses itself.
+func urlHTTPClient(appConfig *TomlConfig) (*http.Client, error) {
+	timeout := time.Duration(appConfig.URLFetchTimeout) * time.Second
+
+	dialer := &net.Dialer{Timeout: timeout}
+
+	transport := &http.Transport{}
+
+	if appConfig.GeneralProxy != "" {
+		proxyURL, err := url.Parse(appConfig.GeneralProxy)
+		if err != nil {
+			return nil, err
+		}
+
+		proxyDialer, err := proxy.FromURL(proxyURL, dialer)
+		if err != nil {
+			return nil, err
+		}
+
+		transport.Dial = proxyDialer.Dial
+	} else {
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errPrivateAddress
+			}
+
+			return nil
+		}
+
+		transport.DialContext = dialer.DialContext
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if len(via) >= maxURLRedirects {
+				return http.ErrUseLastResponse
+			}
+
+			return checkURLHost(request.Context(), request.URL, appConfig.GeneralProxy == "")
+		},
+	}, nil
+}
+
+type fetchedURL struct {
+	URL           *url.URL
+	ContentType   string
+	ContentLength int64
+	Body          []byte
+}
+
+// fetchURL gets at most URLFetchMaxBytes of a link.
+func fetchURL(ctx context.Context, appConfig *TomlConfig, link string) (*fetchedURL, error) {
+	target, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", target.Scheme)
+	}
+
+	if err := checkURLHost(ctx, target, appConfig.GeneralProxy == ""); err != nil {
+		return nil, err
+	}
+
+	httpClient, err := urlHTTPClient(appConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("User-Agent", "milla")
+	request.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.8")
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("%s: %s", target.Host, response.Status)
+	}
+
+	contentType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+
+	fetched := &fetchedURL{
+		URL:           response.Request.URL,
+		ContentType:   contentType,
+		ContentLength: response.ContentLength,
+	}
+
+	if contentType == "text/html" || contentType == "application/xhtml+xml" {
+		fetched.Body, err = io.ReadAll(io.LimitReader(response.Body, int64(appConfig.URLFetchMaxBytes)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fetched, nil
+}
+
+func collapseSpaces(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// pageTitle returns the og:title of a page, or its title element.
+func pageTitle(body []byte) string {
+	doc, err := html.Parse(strings.NewReader(string(body)))
+	if err != nil {
+		return ""
+	}
+
+	var title, ogTitle string
+
+	var walk func(*html.Node)
+
+	walk = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			switch node.Data {
+			case "title":
+				if title == "" && node.FirstChild != nil {
+					title = node.FirstChild.Data
+				}
+			case "meta":
+				var property, content string
+
+				for _, attribute := range node.Attr {
+					switch attribute.Key {
+					case "property", "name":
+						property = attribute.Val
+					case "content":
+						content = attribute.Val
+					}
+				}
+
+				if property == "og:title" && ogTitle == "" {
+					ogTitle = content
+				}
+			case "body":
+				return
+			}
+		}
+
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+
+	walk(doc)
+
+	if ogTitle != "" {
+		title = ogTitle
+	}
+
+	title = collapseSpaces(title)
+	if runes := []rune(title); len(runes) > maxTitleLength {
+		title = string(runes[:maxTitleLength]) + "..."
+	}
+
+	return title
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value := float64(size)
+	suffixes := []string{"KiB", "MiB", "GiB", "TiB"}
+
+	index := -1
+	for value >= unit && index < len(suffixes)-1 {
+		value /= unit
+		index++
+	}
+
+	return fmt.Sprintf("%.1f %s", value, suffixes[index])
+}
+
+// describeURL is the line posted for a link: the page title, or for
+// anything that isn't a web page the content type and size.
+func describeURL(fetched *fetchedURL) string {
+	if fetched.Body != nil {
+		title := pageTitle(fetched.Body)
+		if title == "" {
+			return ""
+		}
+
+		return fmt.Sprintf("^ %s (%s)", title, fetched.URL.Hostname())
+	}
+
+	if fetched.ContentType == "" {
+		return ""
+	}
+
+	if fetched.ContentLength > 0 {
+		return fmt.Sprintf("^ %s, %s (%s)", fetched.ContentType, formatBytes(fetched.ContentLength), fetched.URL.Hostname())
+	}
+
+	return fmt.Sprintf("^ %s (%s)", fetched.ContentType, fetched.URL.Hostname())
+}
+
+func urlTitlesEnabled(appConfig *TomlConfig, channel string) bool {
+	return slices.ContainsFunc(appConfig.URLTitleChannels, func(name string) bool {
+		return strings.EqualFold(name, channel)
+	})
+}
+
+// URLTitleHandler posts the titles of the links sent to the channels in
+// urlTitleChannels.
+func URLTitleHandler(irc *girc.Client, appConfig *TomlConfig) {
+	irc.Handlers.AddBg(girc.PRIVMSG, func(client *girc.Client, event girc.Event) {
+		appConfig := appConfig.current()
+
+		if event.Source == nil || strings.EqualFold(event.Source.Name, client.GetNick()) {
+			return
+		}
+
+		if !urlTitlesEnabled(appConfig, event.Params[0]) || isIgnored(client, event, appConfig) {
+			return
+		}
+
+		urls := extractURLs(event.Last())
+		if len(urls) > maxURLsPerMessage {
+			urls = urls[:maxURLsPerMessage]
+		}
+
+		for _, link := range urls {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.URLFetchTimeout)*time.Second)
+
+			fetched, err := fetchURL(ctx, appConfig, link)
+
+			cancel()
+
+			if err != nil {
+				slog.Debug("url title", "network", appConfig.IRCDName, "url", link, "error", err)
+
+				continue
+			}
+
+			if line := describeURL(fetched); line != "" {
+				QueueMessage(client, PriorityBulk, event.Params[0], line)
+			}
+		}
+	})
+}
+
+// readableText pulls the text out of a page, leaving out scripts, styles
+// and the navigation around the content.
+func readableText(body []byte) string {
+	doc, err := html.Parse(strings.NewReader(string(body)))
+	if err != nil {
+		return ""
+	}
+
+	skip := map[string]bool{
+		"script": true, "style": true, "noscript": true, "nav": true, "header": true,
+		"footer": true, "aside": true, "form": true, "svg": true, "iframe": true, "head": true,
+	}
+
+	var builder strings.Builder
+
+	var walk func(*html.Node)
+
+	walk = func(node *html.Node) {
+		if builder.Len() >= summarizeMaxChars {
+			return
+		}
+
+		if node.Type == html.ElementNode && skip[node.Data] {
+			return
+		}
+
+		if node.Type == html.TextNode {
+			if text := collapseSpaces(node.Data); text != "" {
+				builder.WriteString(text)
+				builder.WriteString(" ")
+			}
+		}
+
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+
+	walk(doc)
+
+	text := strings.TrimSpace(builder.String())
+	if runes := []rune(text); len(runes) > summarizeMaxChars {
+		text = string(runes[:summarizeMaxChars])
+	}
+
+	return text
+}
+
+// askProvider sends a one-off prompt to the configured provider without
+// touching the chat history.
+func askProvider(client *girc.Client, event girc.Event, appConfig *TomlConfig, prompt string) string {
+	switch appConfig.Provider {
+	case "ollama":
+		var memory []MemoryElement
+
+		return OllamaRequestProcessor(appConfig, client, event, &memory, prompt, appConfig.SystemPrompt)
+	case "gemini":
+		var memory []*genai.Content
+
+		return GeminiRequestProcessor(appConfig, client, event, &memory, prompt, appConfig.SystemPrompt)
+	case "chatgpt":
+		var memory []openai.ChatCompletionMessage
+
+		return ChatGPTRequestProcessor(appConfig, client, event, &memory, prompt, appConfig.SystemPrompt)
+	case "openrouter":
+		var memory []MemoryElement
+
+		return ORRequestProcessor(appConfig, client, event, &memory, prompt)
+	}
+
+	return ""
+}
+
+func handleSummarizeCommand(args []string, client *girc.Client, event girc.Event, appConfig *TomlConfig) {
+	if len(args) < 2 { //nolint: mnd,gomnd
+		QueueReply(client, event, errNotEnoughArgs.Error())
+
+		return
+	}
+
+	stopTyping := StartTyping(client, event)
+	defer stopTyping()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(appConfig.URLFetchTimeout)*time.Second)
+	defer cancel()
+
+	fetched, err := fetchURL(ctx, appConfig, args[1])
+	if err != nil {
+		QueueReply(client, event, err.Error())
+
+		return
+	}
+
+	if fetched.Body == nil {
+		QueueReply(client, event, errNotHTML.Error())
+
+		return
+	}
+
+	text := readableText(fetched.Body)
+	if text == "" {
+		QueueReply(client, event, errNoText.Error())
+
+		return
+	}
+
+	prompt := "Summarize the following web page from " + fetched.URL.String() + " in a few sentences:\n\n" + text
+
+	if result := askProvider(client, event, appConfig, prompt); result != "" {
+		SendToIRC(client, event, result, appConfig.ChromaFormatter)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	for address, want := range map[string]bool{
+		"1.1.1.1":          true,
+		"2606:4700::1":     true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"192.168.1.1":      false,
+		"172.16.0.1":       false,
+		"100.64.0.1":       false,
+		"169.254.1.1":      false,
+		"0.0.0.0":          false,
+		"0.1.2.3":          false,
+		"::1":              false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"224.0.0.1":        false,
+		"::ffff:127.0.0.1": false,
+	} {
+		if got := isPublicIP(net.ParseIP(address)); got != want {
+			t.Errorf("%s: got %v, want %v", address, got, want)
+		}
+	}
+}
+
+func TestCheckURLHostWithoutLookup(t *testing.T) {
+	for link, want := range map[string]error{
+		"http://127.0.0.1/":          errPrivateAddress,
+		"http://[::1]:8080/":         errPrivateAddress,
+		"http://0.0.0.0:8080/":       errPrivateAddress,
+		"http://localhost/":          errPrivateAddress,
+		"http://LOCALHOST./":         errPrivateAddress,
+		"http://admin.localhost/":    errPrivateAddress,
+		"https://1.1.1.1/":           nil,
+		"https://example.com/page":   nil,
+		"https://internal.invalid/x": nil,
+	} {
+		target, err := url.Parse(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := checkURLHost(context.Background(), target, false); !errors.Is(err, want) {
+			t.Errorf("%s: got %v, want %v", link, err, want)
+		}
+	}
+}
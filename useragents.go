@@ -36,8 +36,7 @@ func UserAgentsGet(uaActionName, query string, appConfig *TomlConfig) string {
 		userAgentRequest.Query = appConfig.UserAgentActions[uaActionName].Query
 	}
 
-	log.Println("UserAgentRequest:", appConfig.UserAgentActions[uaActionName])
-	log.Println(userAgentRequest)
+	logMessageContent(nil, "user agent request", "action", uaActionName, "request", userAgentRequest)
 
 	jsonData, err := json.Marshal(userAgentRequest)
 	if err != nil {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 
 	"github.com/lrstanley/girc"
@@ -14,7 +15,31 @@ func Min(x, y int) int {
 	return y
 }
 
+// matchGlob matches IRC style globs where * matches any run of characters
+// and ? a single one, e.g. *!*@*.example.com. It ignores case.
+func matchGlob(pattern, input string) bool {
+	expression := regexp.QuoteMeta(pattern)
+	expression = strings.ReplaceAll(expression, `\*`, ".*")
+	expression = strings.ReplaceAll(expression, `\?`, ".")
+
+	re, err := regexp.Compile("(?i)^" + expression + "$")
+	if err != nil {
+		return false
+	}
+
+	return re.MatchString(input)
+}
+
 func IrcJoin(irc *girc.Client, channel []string) {
+	if state := getChannelState(irc); state != nil {
+		key := ""
+		if len(channel) > 1 {
+			key = channel[1]
+		}
+
+		state.Want(channel[0], key)
+	}
+
 	if len(channel) > 1 && channel[1] != "" {
 		irc.Cmd.JoinKey(channel[0], channel[1])
 	} else {
@@ -57,13 +82,21 @@ func SendToIRC(
 	message string,
 	chromaFormatter string,
 ) {
-	chunks := chunker(message, chromaFormatter)
+	var lines []string
 
-	for _, chunk := range chunks {
+	for _, chunk := range chunker(message, chromaFormatter) {
 		if len(strings.TrimSpace(chunk)) == 0 {
 			continue
 		}
 
-		client.Cmd.Reply(event, chunk)
+		lines = append(lines, chunk)
+	}
+
+	if sendMultiline(client, event, lines) {
+		return
+	}
+
+	for _, line := range lines {
+		QueueReply(client, event, line)
 	}
 }
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+const (
+	maxWebhookLines       = 10
+	httpShutdownTimeout   = 5 * time.Second
+	httpReadHeaderTimeout = 10 * time.Second
+)
+
+var (
+	errWebhookAuth     = errors.New("a webhook route needs a token or a secret")
+	errWebhookTemplate = errors.New("a webhook route needs a template or a preset")
+	errUnknownPreset   = errors.New("unknown webhook preset, use github, gitea or alertmanager")
+	errWebhookTarget   = errors.New("a webhook route needs a network and a channel")
+)
+
+// webhookPresets render the webhooks GitHub, Gitea and Alertmanager send.
+// .Event is the event name from the X-GitHub-Event or X-Gitea-Event header
+// and .Payload the decoded JSON body.
+var webhookPresets = map[string]string{
+	"github": `{{- $repo := .Payload.repository.full_name -}}
+{{- if eq .Event "push" -}}
+[{{$repo}}] {{.Payload.pusher.name}} pushed {{len .Payload.commits}} commit(s) to {{trimPrefix "refs/heads/" .Payload.ref}} {{.Payload.compare}}
+{{- range $i, $commit := .Payload.commits}}{{if lt $i 3}}
+  {{shortSHA $commit.id}} {{firstLine $commit.message}}{{end}}{{end}}
+{{- else if eq .Event "pull_request" -}}
+[{{$repo}}] {{.Payload.sender.login}} {{.Payload.action}} pull request #{{.Payload.number}}: {{.Payload.pull_request.title}} {{.Payload.pull_request.html_url}}
+{{- else if eq .Event "issues" -}}
+[{{$repo}}] {{.Payload.sender.login}} {{.Payload.action}} issue #{{.Payload.issue.number}}: {{.Payload.issue.title}} {{.Payload.issue.html_url}}
+{{- else if eq .Event "issue_comment" -}}
+[{{$repo}}] {{.Payload.sender.login}} commented on #{{.Payload.issue.number}}: {{truncate 200 (firstLine .Payload.comment.body)}} {{.Payload.comment.html_url}}
+{{- else if eq .Event "release" -}}
+[{{$repo}}] {{.Payload.sender.login}} {{.Payload.action}} release {{.Payload.release.tag_name}} {{.Payload.release.html_url}}
+{{- else if eq .Event "workflow_run" -}}
+{{- if eq .Payload.action "completed" -}}
+[{{$repo}}] {{.Payload.workflow_run.name}} on {{.Payload.workflow_run.head_branch}}: {{.Payload.workflow_run.conclusion}} {{.Payload.workflow_run.html_url}}
+{{- end -}}
+{{- else if eq .Event "ping" -}}
+[{{$repo}}] webhook is set up: {{.Payload.zen}}
+{{- end -}}`,
+	"gitea": `{{- $repo := .Payload.repository.full_name -}}
+{{- if eq .Event "push" -}}
+[{{$repo}}] {{.Payload.pusher.login}} pushed {{len .Payload.commits}} commit(s) to {{trimPrefix "refs/heads/" .Payload.ref}} {{.Payload.compare_url}}
+{{- range $i, $commit := .Payload.commits}}{{if lt $i 3}}
+  {{shortSHA $commit.id}} {{firstLine $commit.message}}{{end}}{{end}}
+{{- else if eq .Event "pull_request" -}}
+[{{$repo}}] {{.Payload.sender.login}} {{.Payload.action}} pull request #{{.Payload.number}}: {{.Payload.pull_request.title}} {{.Payload.pull_request.html_url}}
+{{- else if eq .Event "issues" -}}
+[{{$repo}}] {{.Payload.sender.login}} {{.Payload.action}} issue #{{.Payload.issue.number}}: {{.Payload.issue.title}} {{.Payload.issue.html_url}}
+{{- else if eq .Event "issue_comment" -}}
+[{{$repo}}] {{.Payload.sender.login}} commented on #{{.Payload.issue.number}}: {{truncate 200 (firstLine .Payload.comment.body)}} {{.Payload.comment.html_url}}
+{{- else if eq .Event "release" -}}
+[{{$repo}}] {{.Payload.sender.login}} {{.Payload.action}} release {{.Payload.release.tag_name}} {{.Payload.release.html_url}}
+{{- end -}}`,
+	"alertmanager": `{{- range .Payload.alerts -}}
+[{{upper .status}}] {{.labels.alertname}}{{with .labels.severity}} ({{.}}){{end}}: {{with .annotations.summary}}{{.}}{{else}}{{.annotations.description}}{{end}}
+{{end -}}`,
+}
+
+// webhookText is how the template functions see a payload value, keys the
+// payload doesn't have are empty.
+func webhookText(value any) string {
+	if value == nil {
+		return ""
+	}
+
+	return fmt.Sprint(value)
+}
+
+var webhookTemplateFuncs = template.FuncMap{
+	"firstLine": func(text any) string {
+		line, _, _ := strings.Cut(webhookText(text), "\n")
+
+		return line
+	},
+	"shortSHA": func(sha any) string {
+		text := webhookText(sha)
+		if len(text) > 7 { //nolint: mnd,gomnd
+			return text[:7]
+		}
+
+		return text
+	},
+	"trimPrefix": func(prefix string, text any) string {
+		return strings.TrimPrefix(webhookText(text), prefix)
+	},
+	"truncate": func(length int, text any) string {
+		runes := []rune(webhookText(text))
+		if len(runes) > length {
+			return string(runes[:length]) + "..."
+		}
+
+		return string(runes)
+	},
+	"upper": func(text any) string {
+		return strings.ToUpper(webhookText(text))
+	},
+	"orEmpty": func(value any) any {
+		if value == nil {
+			return ""
+		}
+
+		return value
+	},
+}
+
+// emptyMissing ends every action that prints a value with orEmpty, so keys
+// the payload doesn't have print nothing instead of "<no value>".
+func emptyMissing(node parse.Node) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+
+		for _, child := range node.Nodes {
+			emptyMissing(child)
+		}
+	case *parse.ActionNode:
+		if len(node.Pipe.Decl) > 0 {
+			return
+		}
+
+		node.Pipe.Cmds = append(node.Pipe.Cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Pos:      node.Pos,
+			Args:     []parse.Node{parse.NewIdentifier("orEmpty").SetPos(node.Pos)},
+		})
+	case *parse.IfNode:
+		emptyMissing(node.List)
+		emptyMissing(node.ElseList)
+	case *parse.RangeNode:
+		emptyMissing(node.List)
+		emptyMissing(node.ElseList)
+	case *parse.WithNode:
+		emptyMissing(node.List)
+		emptyMissing(node.ElseList)
+	}
+}
+
+// httpListener is one of the HTTP servers milla runs next to the IRC
+// connections.
+type httpListener struct {
+	name   string
+	listen string
+	server *http.Server
+}
+
+// serveHTTP starts serving handler on listen in the background.
+func serveHTTP(name, listen string, handler http.Handler) (*httpListener, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+
+	slog.Info("listening", "server", name, "addr", listener.Addr().String())
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			LogError(err)
+		}
+	}()
+
+	return &httpListener{name: name, listen: listen, server: server}, nil
+}
+
+func (listener *httpListener) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+
+	if err := listener.server.Shutdown(ctx); err != nil {
+		LogError(err)
+	}
+
+	slog.Info("stopped listening", "server", listener.name, "addr", listener.listen)
+}
+
+var (
+	webhooksMu      sync.RWMutex
+	webhooksConfig  WebhookServer
+	webhookRoutes   map[string]*template.Template
+	runningWebhooks *httpListener
+)
+
+func parseWebhookRoute(route WebhookRoute) (*template.Template, error) {
+	if route.Token == "" && route.Secret == "" {
+		return nil, errWebhookAuth
+	}
+
+	if route.Network == "" || route.Channel == "" {
+		return nil, errWebhookTarget
+	}
+
+	text := route.Template
+	if text == "" {
+		preset, ok := webhookPresets[route.Preset]
+		if !ok && route.Preset != "" {
+			return nil, errUnknownPreset
+		}
+
+		text = preset
+	}
+
+	if text == "" {
+		return nil, errWebhookTemplate
+	}
+
+	tmpl, err := template.New("").Funcs(webhookTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, defined := range tmpl.Templates() {
+		if defined.Tree != nil {
+			emptyMissing(defined.Tree.Root)
+		}
+	}
+
+	return tmpl, nil
+}
+
+// verifyWebhook checks the bearer token and the HMAC signature of the body,
+// whichever of them the route has.
+func verifyWebhook(route WebhookRoute, request *http.Request, body []byte) bool {
+	if route.Token != "" {
+		token, found := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(route.Token)) != 1 {
+			return false
+		}
+	}
+
+	if route.Secret != "" {
+		headers := []string{"X-Hub-Signature-256", "X-Gitea-Signature", "X-Signature-256"}
+		if route.SignatureHeader != "" {
+			headers = []string{route.SignatureHeader}
+		}
+
+		signature := ""
+
+		for _, header := range headers {
+			if signature = request.Header.Get(header); signature != "" {
+				break
+			}
+		}
+
+		got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+		if err != nil {
+			return false
+		}
+
+		mac := hmac.New(sha256.New, []byte(route.Secret))
+		mac.Write(body)
+
+		if !hmac.Equal(got, mac.Sum(nil)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func webhookEvent(request *http.Request) string {
+	for _, header := range []string{"X-GitHub-Event", "X-Gitea-Event", "X-Event"} {
+		if event := request.Header.Get(header); event != "" {
+			return event
+		}
+	}
+
+	return ""
+}
+
+func renderWebhook(tmpl *template.Template, event string, payload any) ([]string, error) {
+	var buffer bytes.Buffer
+
+	err := tmpl.Execute(&buffer, map[string]any{"Event": event, "Payload": payload})
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+
+	for _, line := range strings.Split(buffer.String(), "\n") {
+		line = strings.TrimRight(line, " ")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		lines = append(lines, line)
+		if len(lines) == maxWebhookLines {
+			break
+		}
+	}
+
+	return lines, nil
+}
+
+func handleWebhook(writer http.ResponseWriter, request *http.Request) {
+	name := request.PathValue("name")
+
+	webhooksMu.RLock()
+	route, ok := webhooksConfig.Routes[name]
+	tmpl := webhookRoutes[name]
+	maxBytes := webhooksConfig.MaxBodyBytes
+	webhooksMu.RUnlock()
+
+	if !ok || tmpl == nil {
+		http.NotFound(writer, request)
+
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(writer, request.Body, maxBytes))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusRequestEntityTooLarge)
+
+		return
+	}
+
+	if !verifyWebhook(route, request, body) {
+		slog.Warn("webhook rejected a request", "webhook", name, "remote", request.RemoteAddr)
+		http.Error(writer, "unauthorized", http.StatusUnauthorized)
+
+		return
+	}
+
+	var payload any
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(writer, "invalid json: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	lines, err := renderWebhook(tmpl, webhookEvent(request), payload)
+	if err != nil {
+		slog.Error("webhook", "webhook", name, "error", err)
+		http.Error(writer, err.Error(), http.StatusUnprocessableEntity)
+
+		return
+	}
+
+	network := getNetwork(route.Network)
+	if network == nil || !network.Client.IsConnected() {
+		http.Error(writer, "network "+route.Network+" is not connected", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	for _, line := range lines {
+		QueueMessage(network.Client, PriorityBulk, route.Channel, line)
+	}
+
+	writer.WriteHeader(http.StatusAccepted)
+}
+
+func newWebhookMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /hooks/{name}", handleWebhook)
+
+	return mux
+}
+
+// setWebhooks applies the webhook config. The listener is only restarted if
+// the address it listens on changed, route changes take effect right away.
+func setWebhooks(updated WebhookServer) {
+	if updated.MaxBodyBytes == 0 {
+		updated.MaxBodyBytes = 1048576 //nolint: mnd,gomnd
+	}
+
+	routes := make(map[string]*template.Template, len(updated.Routes))
+
+	for name, route := range updated.Routes {
+		tmpl, err := parseWebhookRoute(route)
+		if err != nil {
+			slog.Error("webhook", "webhook", name, "error", err)
+
+			continue
+		}
+
+		routes[name] = tmpl
+	}
+
+	webhooksMu.Lock()
+
+	webhooksConfig = updated
+	webhookRoutes = routes
+
+	if runningWebhooks != nil && runningWebhooks.listen == updated.Listen {
+		webhooksMu.Unlock()
+
+		return
+	}
+
+	// shutting down waits for requests in flight, which need the lock.
+	old := runningWebhooks
+	runningWebhooks = nil
+
+	webhooksMu.Unlock()
+
+	if old != nil {
+		old.shutdown()
+	}
+
+	if updated.Listen == "" {
+		return
+	}
+
+	listener, err := serveHTTP("webhooks", updated.Listen, newWebhookMux())
+	if err != nil {
+		slog.Error("webhooks", "error", err)
+
+		return
+	}
+
+	webhooksMu.Lock()
+	runningWebhooks = listener
+	webhooksMu.Unlock()
+}
+
+func webhooksDiffer(updated WebhookServer) bool {
+	webhooksMu.RLock()
+	defer webhooksMu.RUnlock()
+
+	if updated.MaxBodyBytes == 0 {
+		updated.MaxBodyBytes = webhooksConfig.MaxBodyBytes
+	}
+
+	return !reflect.DeepEqual(updated, webhooksConfig)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	body := []byte(`{"zen":"hi"}`)
+
+	tests := []struct {
+		name    string
+		route   WebhookRoute
+		headers map[string]string
+		want    bool
+	}{
+		{"token", WebhookRoute{Token: "t0ken"}, map[string]string{"Authorization": "Bearer t0ken"}, true},
+		{"wrong token", WebhookRoute{Token: "t0ken"}, map[string]string{"Authorization": "Bearer nope"}, false},
+		{"token without bearer", WebhookRoute{Token: "t0ken"}, map[string]string{"Authorization": "t0ken"}, false},
+		{"github signature", WebhookRoute{Secret: "s3cret"}, map[string]string{"X-Hub-Signature-256": sign("s3cret", body)}, true},
+		{"gitea signature", WebhookRoute{Secret: "s3cret"}, map[string]string{"X-Gitea-Signature": strings.TrimPrefix(sign("s3cret", body), "sha256=")}, true},
+		{"wrong secret", WebhookRoute{Secret: "s3cret"}, map[string]string{"X-Hub-Signature-256": sign("other", body)}, false},
+		{"no signature", WebhookRoute{Secret: "s3cret"}, nil, false},
+		{"custom header", WebhookRoute{Secret: "s3cret", SignatureHeader: "X-Sig"}, map[string]string{"X-Sig": sign("s3cret", body)}, true},
+		{"custom header ignores the others", WebhookRoute{Secret: "s3cret", SignatureHeader: "X-Sig"}, map[string]string{"X-Hub-Signature-256": sign("s3cret", body)}, false},
+		{"token and secret", WebhookRoute{Token: "t0ken", Secret: "s3cret"}, map[string]string{"Authorization": "Bearer t0ken"}, false},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodPost, "/hooks/test", nil)
+		for key, value := range test.headers {
+			request.Header.Set(key, value)
+		}
+
+		if got := verifyWebhook(test.route, request, body); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseWebhookRoute(t *testing.T) {
+	tests := []struct {
+		route WebhookRoute
+		err   error
+	}{
+		{WebhookRoute{Network: "net", Channel: "#c", Preset: "github"}, errWebhookAuth},
+		{WebhookRoute{Token: "t", Preset: "github"}, errWebhookTarget},
+		{WebhookRoute{Token: "t", Network: "net", Channel: "#c"}, errWebhookTemplate},
+		{WebhookRoute{Token: "t", Network: "net", Channel: "#c", Preset: "gitlab"}, errUnknownPreset},
+		{WebhookRoute{Token: "t", Network: "net", Channel: "#c", Preset: "github"}, nil},
+		{WebhookRoute{Token: "t", Network: "net", Channel: "#c", Template: "{{.Payload.text}}"}, nil},
+	}
+
+	for _, test := range tests {
+		if _, err := parseWebhookRoute(test.route); !errors.Is(err, test.err) {
+			t.Errorf("%+v: got %v, want %v", test.route, err, test.err)
+		}
+	}
+
+	if _, err := parseWebhookRoute(WebhookRoute{Token: "t", Network: "net", Channel: "#c", Template: "{{.Payload"}); err == nil {
+		t.Error("a broken template was accepted")
+	}
+}
+
+func renderTest(t *testing.T, route WebhookRoute, event, body string) []string {
+	t.Helper()
+
+	route.Token, route.Network, route.Channel = "t", "net", "#c"
+
+	tmpl, err := parseWebhookRoute(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var payload any
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := renderWebhook(tmpl, event, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return lines
+}
+
+func TestRenderWebhook(t *testing.T) {
+	tests := []struct {
+		name  string
+		route WebhookRoute
+		event string
+		body  string
+		want  []string
+	}{
+		{
+			"github push",
+			WebhookRoute{Preset: "github"},
+			"push",
+			`{"repository":{"full_name":"o/r"},"pusher":{"name":"alice"},"ref":"refs/heads/main","compare":"https://c",
+				"commits":[{"id":"0123456789abcdef","message":"first line\nmore"},{"id":"abc","message":"two"}]}`,
+			[]string{"[o/r] alice pushed 2 commit(s) to main https://c", "  0123456 first line", "  abc two"},
+		},
+		{
+			"github event without a template",
+			WebhookRoute{Preset: "github"},
+			"star",
+			`{"repository":{"full_name":"o/r"}}`,
+			nil,
+		},
+		{
+			"alertmanager",
+			WebhookRoute{Preset: "alertmanager"},
+			"",
+			`{"alerts":[{"status":"firing","labels":{"alertname":"DiskFull","severity":"critical"},"annotations":{"summary":"disk is full"}},
+				{"status":"resolved","labels":{"alertname":"Load"},"annotations":{"description":"load is fine"}}]}`,
+			[]string{"[FIRING] DiskFull (critical): disk is full", "[RESOLVED] Load: load is fine"},
+		},
+		{
+			"missing keys print nothing",
+			WebhookRoute{Template: "{{.Event}}: {{.Payload.missing}}|{{.Payload.nested.missing}}|{{upper .Payload.gone}}"},
+			"test",
+			`{}`,
+			[]string{"test: ||"},
+		},
+		{
+			"truncate counts runes",
+			WebhookRoute{Template: "{{truncate 3 .Payload.text}}"},
+			"",
+			`{"text":"äöüß"}`,
+			[]string{"äöü..."},
+		},
+		{
+			"long output is cut",
+			WebhookRoute{Template: "{{range .Payload.items}}{{.}}\n{{end}}"},
+			"",
+			`{"items":[1,2,3,4,5,6,7,8,9,10,11,12]}`,
+			[]string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"},
+		},
+	}
+
+	for _, test := range tests {
+		if got := renderTest(t, test.route, test.event, test.body); !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHandleWebhook(t *testing.T) {
+	route := WebhookRoute{Network: "nowhere", Channel: "#c", Secret: "s3cret", Template: "{{.Payload.text}}"}
+
+	tmpl, err := parseWebhookRoute(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhooksMu.Lock()
+	oldConfig, oldRoutes := webhooksConfig, webhookRoutes
+	webhooksConfig = WebhookServer{MaxBodyBytes: 64, Routes: map[string]WebhookRoute{"test": route}}
+	webhookRoutes = map[string]*template.Template{"test": tmpl}
+	webhooksMu.Unlock()
+
+	t.Cleanup(func() {
+		webhooksMu.Lock()
+		webhooksConfig, webhookRoutes = oldConfig, oldRoutes
+		webhooksMu.Unlock()
+	})
+
+	tests := []struct {
+		name      string
+		path      string
+		body      string
+		signature string
+		want      int
+	}{
+		{"unknown route", "/hooks/other", `{}`, "", http.StatusNotFound},
+		{"unsigned", "/hooks/test", `{"text":"hi"}`, "", http.StatusUnauthorized},
+		{"bad json", "/hooks/test", `{"text":`, sign("s3cret", []byte(`{"text":`)), http.StatusBadRequest},
+		{"too big", "/hooks/test", `{"text":"` + strings.Repeat("x", 100) + `"}`, "", http.StatusRequestEntityTooLarge},
+		{"network not connected", "/hooks/test", `{"text":"hi"}`, sign("s3cret", []byte(`{"text":"hi"}`)), http.StatusServiceUnavailable},
+	}
+
+	mux := newWebhookMux()
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(test.body))
+		if test.signature != "" {
+			request.Header.Set("X-Hub-Signature-256", test.signature)
+		}
+
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, recorder.Code, test.want)
+		}
+	}
+}